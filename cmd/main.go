@@ -9,12 +9,26 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"webserver/internal/admission"
 	"webserver/internal/cgroup_manager"
+	"webserver/internal/checkpoint"
 	"webserver/internal/config"
+	"webserver/internal/data_volume"
+	"webserver/internal/function_registry"
 	"webserver/internal/healthcheck"
+	"webserver/internal/hot_reload"
 	"webserver/internal/http_server"
+	"webserver/internal/job_manager"
 	"webserver/internal/metrics_collector"
 	"webserver/internal/metrics_reporter"
+	"webserver/internal/module_compiler"
+	"webserver/internal/module_source"
+	"webserver/internal/scheduler"
+	"webserver/internal/scratch"
+	"webserver/internal/secrets"
+	"webserver/internal/shadow"
+	"webserver/internal/signature"
+	"webserver/internal/triggers"
 
 	"github.com/ilyakaznacheev/cleanenv"
 	_ "go.uber.org/automaxprocs"
@@ -102,6 +116,102 @@ func main() {
 		log.Fatal(err)
 	}
 
+	var jobManagerConfig config.JobManagerConfig
+	err = cleanenv.ReadEnv(&jobManagerConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var functionRegistryConfig config.FunctionRegistryConfig
+	err = cleanenv.ReadEnv(&functionRegistryConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var minioConfig config.MinioConfig
+	err = cleanenv.ReadEnv(&minioConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var ociConfig config.OCIConfig
+	err = cleanenv.ReadEnv(&ociConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var moduleSourceConfig config.ModuleSourceConfig
+	err = cleanenv.ReadEnv(&moduleSourceConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var moduleCompilerConfig config.ModuleCompilerConfig
+	err = cleanenv.ReadEnv(&moduleCompilerConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var signatureConfig config.SignatureConfig
+	err = cleanenv.ReadEnv(&signatureConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var admissionConfig config.AdmissionConfig
+	err = cleanenv.ReadEnv(&admissionConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var hotReloadConfig config.HotReloadConfig
+	err = cleanenv.ReadEnv(&hotReloadConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var shadowConfig config.ShadowConfig
+	err = cleanenv.ReadEnv(&shadowConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var schedulerConfig config.SchedulerConfig
+	err = cleanenv.ReadEnv(&schedulerConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var triggersConfig config.TriggersConfig
+	err = cleanenv.ReadEnv(&triggersConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var checkpointConfig config.CheckpointConfig
+	err = cleanenv.ReadEnv(&checkpointConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var scratchConfig config.ScratchConfig
+	err = cleanenv.ReadEnv(&scratchConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var dataConfig config.DataConfig
+	err = cleanenv.ReadEnv(&dataConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var secretsConfig config.SecretsConfig
+	err = cleanenv.ReadEnv(&secretsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	cgroupManagerConfig := &config.CgroupManagerConfig{
 		PodUID:      podUID,
 		ContainerID: containerID,
@@ -126,19 +236,181 @@ func main() {
 	go metricsReporter.Run()
 	slog.Info("Started the Metrics Reporter")
 
+	checkpointManager := &checkpoint.CheckpointManager{
+		Config: &checkpointConfig,
+	}
+	err = checkpointManager.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scratchManager := &scratch.ScratchManager{
+		Config: &scratchConfig,
+	}
+	err = scratchManager.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	secretStore := &secrets.SecretStore{
+		Config: &secretsConfig,
+	}
+	err = secretStore.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	server := http_server.WebServer{
-		Config:        &webServerConfig,
-		ReadyWEXs:     make(map[string][]string),
-		CgroupManager: cgroupManager,
+		Config:            &webServerConfig,
+		ReadyWEXs:         make(map[string][]string),
+		CgroupManager:     cgroupManager,
+		CheckpointManager: checkpointManager,
+		Scratch:           scratchManager,
+		Secrets:           secretStore,
+	}
+	err = server.InitLimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	signatureVerifier := &signature.SignatureVerifier{
+		Config: &signatureConfig,
+	}
+	err = signatureVerifier.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	moduleCompiler := &module_compiler.ModuleCompiler{
+		Config:            &moduleCompilerConfig,
+		NewWasmtimeEngine: server.NewWasmtimeEngine,
+	}
+	// Without trusted keys every module passes, so they are not read to be verified
+	if signatureVerifier.Enabled() {
+		moduleCompiler.Verifier = signatureVerifier.Check
+	}
+	err = moduleCompiler.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.ModuleCompiler = moduleCompiler
+
+	dataVolume := &data_volume.DataVolume{
+		Config: &dataConfig,
+	}
+	err = dataVolume.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	functionRegistry := &function_registry.FunctionRegistry{
+		Config:            &functionRegistryConfig,
+		ModuleCompiler:    moduleCompiler,
+		SignatureVerifier: signatureVerifier,
+		Admission: &admission.Checker{
+			Config:         &admissionConfig,
+			ModuleCompiler: moduleCompiler,
+		},
+		DataVolume: dataVolume,
+	}
+	err = functionRegistry.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var moduleStore module_source.ObjectStore
+	switch {
+	case minioConfig.Endpoint != "" && ociConfig.Repository != "":
+		log.Fatal("MINIO_ENDPOINT and OCI_REPOSITORY can not both be set")
+	case minioConfig.Endpoint != "":
+		moduleStore, err = module_source.NewMinioStore(&minioConfig)
+		slog.Info("Downloading functions from MinIO", "endpoint", minioConfig.Endpoint, "bucket", minioConfig.BucketName)
+	case ociConfig.Repository != "":
+		moduleStore, err = module_source.NewOCIStore(&ociConfig)
+		slog.Info("Pulling functions from an OCI registry", "repository", ociConfig.Repository, "tag", ociConfig.DefaultTag)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if moduleStore != nil {
+		moduleSource := &module_source.ModuleSource{
+			Config: &moduleSourceConfig,
+			Store:  moduleStore,
+		}
+		err = moduleSource.Init()
+		if err != nil {
+			log.Fatal(err)
+		}
+		functionRegistry.ModuleSource = moduleSource
+	}
+	server.FunctionRegistry = functionRegistry
+
+	if moduleCompilerConfig.PrecompileFunctions {
+		go functionRegistry.CompileAll()
+	}
+
+	reloader := &hot_reload.Reloader{
+		Config:   &hotReloadConfig,
+		Registry: functionRegistry,
+	}
+	err = reloader.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.Reloader = reloader
+
+	shadowRunner := &shadow.ShadowRunner{
+		Config:   &shadowConfig,
+		Executor: server.ExecuteShadow,
+	}
+	shadowRunner.Init()
+	server.Shadow = shadowRunner
+
+	jobManager := &job_manager.JobManager{
+		Config:   &jobManagerConfig,
+		Executor: server.ExecuteJob,
+	}
+	jobManager.Init()
+	server.JobManager = jobManager
+
+	functionScheduler := &scheduler.Scheduler{
+		Config:   &schedulerConfig,
+		Executor: server.Execute,
+	}
+	err = functionScheduler.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.Scheduler = functionScheduler
+
+	triggerManager := &triggers.TriggerManager{
+		Config:   &triggersConfig,
+		Executor: server.Execute,
+	}
+	err = triggerManager.Init()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	healthcheck.Init(&healthCheckConfig, &server)
 	go server.Start()
+	functionScheduler.Start()
+	triggerManager.Start()
+	reloader.Start()
 	slog.Info("Started the Web Server", "address", server.Config.Host+":"+strconv.Itoa(server.Config.Port), "pid", os.Getpid(), "cgroup", cgroupManager.GetContainerCgroupPath())
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	<-stop
 
+	if checkpointConfig.EnableCheckpoints && checkpointConfig.CheckpointOnShutdown {
+		checkpoints := checkpointManager.CheckpointAll()
+		slog.Info("Checkpointed in-flight invocations", "count", len(checkpoints))
+	}
+
+	functionScheduler.Stop()
+	triggerManager.Stop()
+	reloader.Stop()
 	slog.Info("Stopped the server gracefully")
 }
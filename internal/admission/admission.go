@@ -0,0 +1,219 @@
+package admission
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"webserver/internal/config"
+	"webserver/internal/module_compiler"
+	"webserver/internal/utils"
+	"webserver/internal/wasm_binary"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+)
+
+const (
+	CheckImports    = "imports"
+	CheckMemory     = "memory"
+	CheckEntrypoint = "entrypoint"
+	CheckProposals  = "proposals"
+
+	StatusPassed  = "passed"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+
+	wasmPageSize = 64 * 1024
+)
+
+// CheckResult is the outcome of one check. Details list the violations of failed checks,
+// and why skipped checks could not run.
+type CheckResult struct {
+	Check   string   `json:"check"`
+	Status  string   `json:"status"`
+	Details []string `json:"details,omitempty"`
+}
+
+type Report struct {
+	Admitted bool          `json:"admitted"`
+	Checks   []CheckResult `json:"checks"`
+}
+
+func (r *Report) add(check string, violations []string) {
+	status := StatusPassed
+	if len(violations) > 0 {
+		status = StatusFailed
+		r.Admitted = false
+	}
+	r.Checks = append(r.Checks, CheckResult{Check: check, Status: status, Details: violations})
+}
+
+func (r *Report) skip(check, reason string) {
+	r.Checks = append(r.Checks, CheckResult{Check: check, Status: StatusSkipped, Details: []string{reason}})
+}
+
+// RejectedError is returned for modules that fail at least one check.
+type RejectedError struct {
+	Report Report
+}
+
+func (e *RejectedError) Error() string {
+	var violations []string
+	for _, check := range e.Report.Checks {
+		if check.Status == StatusFailed {
+			violations = append(violations, check.Details...)
+		}
+	}
+	return "module rejected: " + strings.Join(violations, "; ")
+}
+
+// Checker statically checks modules when they are uploaded, so that modules that could
+// never run are rejected then instead of failing their first invocation.
+type Checker struct {
+	Config         *config.AdmissionConfig
+	ModuleCompiler *module_compiler.ModuleCompiler
+}
+
+func (c *Checker) Enabled() bool {
+	return c.Config.AdmissionChecks
+}
+
+// Check runs every check against the module at path, which runs on runtime ("" when it
+// does not depend on one) with the limits and entrypoint of manifest. It returns a
+// RejectedError along with the report when a check fails.
+func (c *Checker) Check(path, runtime string, manifest config.FunctionManifest) (Report, error) {
+	report := Report{Admitted: true, Checks: []CheckResult{}}
+
+	inspection, err := c.ModuleCompiler.Inspect(path)
+	if err != nil {
+		return Report{}, err
+	}
+
+	if inspection.Kind == module_compiler.KindWasmedgeNative {
+		reason := "native WasmEdge artifacts can not be inspected"
+		for _, check := range []string{CheckImports, CheckMemory, CheckEntrypoint, CheckProposals} {
+			report.skip(check, reason)
+		}
+		return report, nil
+	}
+
+	report.add(CheckImports, c.checkImports(inspection))
+
+	if violations, skipped := checkMemory(inspection, manifest); skipped != "" {
+		report.skip(CheckMemory, skipped)
+	} else {
+		report.add(CheckMemory, violations)
+	}
+
+	report.add(CheckEntrypoint, checkEntrypoint(inspection, runtime, manifest))
+
+	if inspection.Kind == module_compiler.KindWasmtime {
+		// Serialized artifacts were compiled by an engine with the same features as ours
+		report.skip(CheckProposals, "Wasmtime-serialized artifacts are checked when they are loaded")
+	} else {
+		violations, err := c.checkProposals(path)
+		if err != nil {
+			return Report{}, err
+		}
+		report.add(CheckProposals, violations)
+	}
+
+	if !report.Admitted {
+		return report, &RejectedError{Report: report}
+	}
+	return report, nil
+}
+
+func (c *Checker) checkImports(inspection module_compiler.Inspection) []string {
+	var violations []string
+	for _, imp := range inspection.Imports {
+		if !slices.Contains(c.Config.AllowedImportModules, imp.Module) {
+			violations = append(violations, fmt.Sprintf("%s %s.%s is imported from a module that is not allowed", imp.Kind, imp.Module, imp.Name))
+		}
+	}
+	return violations
+}
+
+// checkMemory compares the minimum size of the memories of a module with the most memory
+// an invocation of the function can get. Functions whose manifest has no maximum can be
+// invoked with any amount of memory, so there is nothing to check.
+func checkMemory(inspection module_compiler.Inspection, manifest config.FunctionManifest) ([]string, string) {
+	if manifest.Memory.Max == "" {
+		return nil, "the function's manifest sets no memory max"
+	}
+
+	// Manifests are validated when they are loaded
+	capMiB, err := utils.ParseMemory(manifest.Memory.Max)
+	if err != nil {
+		return nil, fmt.Sprintf("memory max %q: %v", manifest.Memory.Max, err)
+	}
+
+	var pages uint64
+	for _, memory := range inspection.Memories {
+		pages += memory.Min
+	}
+
+	if pages*wasmPageSize > uint64(capMiB)<<20 {
+		return []string{fmt.Sprintf("memories declare a minimum of %d pages (%s), above the function's memory max of %s", pages, utils.FormatMemory(int((pages*wasmPageSize+1<<20-1)>>20)), manifest.Memory.Max)}, ""
+	}
+	return nil, ""
+}
+
+// checkEntrypoint requires the entrypoint named by the manifest, or else the one of the
+// runtime: "_start" on Wasmtime and "_main" on WasmEdge, or either when there is no runtime.
+func checkEntrypoint(inspection module_compiler.Inspection, runtime string, manifest config.FunctionManifest) []string {
+	var candidates []string
+	switch {
+	case manifest.Entrypoint != "":
+		candidates = []string{manifest.Entrypoint}
+	case runtime == module_compiler.RuntimeWasmtime:
+		candidates = []string{"_start"}
+	case runtime == module_compiler.RuntimeWasmedge:
+		candidates = []string{"_main"}
+	default:
+		candidates = []string{"_start", "_main"}
+	}
+
+	for _, export := range inspection.Exports {
+		if export.Kind == wasm_binary.KindFunc && slices.Contains(candidates, export.Name) {
+			return nil
+		}
+	}
+
+	return []string{fmt.Sprintf("module exports no %s function", strings.Join(candidates, " or "))}
+}
+
+// checkProposals validates the module again on engines without the proposals the policy
+// disallows, so that their use is found in code as well as in types.
+func (c *Checker) checkProposals(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations []string
+	for _, proposal := range []struct {
+		name    string
+		allowed bool
+		disable func(*wasmtime.Config)
+	}{
+		{"threads", c.Config.AllowThreads, func(cfg *wasmtime.Config) { cfg.SetWasmThreads(false) }},
+		{"SIMD", c.Config.AllowSIMD, func(cfg *wasmtime.Config) {
+			// Relaxed SIMD depends on SIMD
+			cfg.SetWasmRelaxedSIMD(false)
+			cfg.SetWasmSIMD(false)
+		}},
+	} {
+		if proposal.allowed {
+			continue
+		}
+
+		engineConfig := wasmtime.NewConfig()
+		proposal.disable(engineConfig)
+		if err := wasmtime.ModuleValidate(wasmtime.NewEngineWithConfig(engineConfig), data); err != nil {
+			violations = append(violations, fmt.Sprintf("module uses %s, which is not allowed: %v", proposal.name, err))
+		}
+	}
+
+	return violations, nil
+}
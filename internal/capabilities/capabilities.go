@@ -0,0 +1,176 @@
+package capabilities
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"webserver/internal/determinism"
+	"webserver/internal/secrets"
+	"webserver/internal/wasm_binary"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+	"github.com/second-state/WasmEdge-go/wasmedge"
+)
+
+const (
+	WASI    = "wasi"
+	Secrets = "secrets"
+)
+
+var (
+	ErrUndeclared = errors.New("module imports an undeclared capability")
+	ErrUnknown    = errors.New("unknown capability")
+)
+
+// Default is granted to functions whose manifest declares no capabilities, so that
+// functions written before capabilities existed keep running.
+var Default = []string{WASI}
+
+// Host is the state of an invocation that host imports give access to.
+type Host struct {
+	// WASI configures WASI on WasmEdge. Wasmtime takes it from the store instead.
+	WASI WasmedgeWASI
+	// Secrets are the secrets of the function.
+	Secrets secrets.Secrets
+	// Deterministic replaces the WASI clocks and randomness when it is set.
+	Deterministic *determinism.Source
+}
+
+// WasmedgeWASI are the arguments, environment variables ("KEY=value") and preopened
+// directories ("guest:host") of WASI on WasmEdge.
+type WasmedgeWASI struct {
+	Args     []string
+	Env      []string
+	Preopens []string
+}
+
+// Capability is a set of host imports that functions are granted by declaring it in
+// their manifest. Each runtime only provides the imports of the granted capabilities.
+type Capability struct {
+	// Modules are the import modules the capability's functions are imported from.
+	Modules []string
+	// DefineWasmtime defines the capability's functions in a Wasmtime linker.
+	DefineWasmtime func(linker *wasmtime.Linker, host Host) error
+	// WasmedgeHosts returns the WasmEdge host registrations providing the capability.
+	WasmedgeHosts func(host Host) []wasmedge.HostRegistration
+	// RegisterWasmedge initializes the capability in a WasmEdge VM, and returns the
+	// module it registered for it, if any.
+	RegisterWasmedge func(vm *wasmedge.VM, host Host) (*wasmedge.Module, error)
+}
+
+var capabilities = map[string]Capability{
+	WASI: {
+		Modules:          []string{wasiModule, wasiUnstableModule},
+		DefineWasmtime:   defineWasiWasmtime,
+		WasmedgeHosts:    wasiWasmedgeHosts,
+		RegisterWasmedge: registerWasiWasmedge,
+	},
+	Secrets: {
+		Modules:          []string{HostModule},
+		DefineWasmtime:   defineSecretsWasmtime,
+		RegisterWasmedge: registerSecretsWasmedge,
+	},
+}
+
+// Names lists the known capabilities.
+func Names() []string {
+	names := make([]string, 0, len(capabilities))
+	for name := range capabilities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks that every declared capability is known.
+func Validate(declared []string) error {
+	for _, name := range declared {
+		if _, ok := capabilities[name]; !ok {
+			return fmt.Errorf("%w %q, expected one of %v", ErrUnknown, name, Names())
+		}
+	}
+	return nil
+}
+
+// Granted returns the capabilities of a function that declared the given ones. A nil
+// list means the manifest declares none, while an empty one grants nothing.
+func Granted(declared []string) []string {
+	if declared == nil {
+		return Default
+	}
+	return declared
+}
+
+// Check refuses imports from the modules of capabilities that were not granted, before
+// instantiation fails on them with a less helpful error. Imports that no capability
+// provides are left to instantiation.
+func Check(imports []wasm_binary.Import, granted []string) error {
+	for _, imp := range imports {
+		for name, capability := range capabilities {
+			if slices.Contains(capability.Modules, imp.Module) && !slices.Contains(granted, name) {
+				return fmt.Errorf("%w: %s.%s needs the %q capability", ErrUndeclared, imp.Module, imp.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// DefineWasmtime defines the imports of the granted capabilities in a Wasmtime linker,
+// giving them access to host.
+func DefineWasmtime(linker *wasmtime.Linker, granted []string, host Host) error {
+	for _, name := range granted {
+		capability, ok := capabilities[name]
+		if !ok {
+			return fmt.Errorf("%w %q", ErrUnknown, name)
+		}
+		if err := capability.DefineWasmtime(linker, host); err != nil {
+			return fmt.Errorf("failed to define the %q capability: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// NewWasmedgeConfigure returns a WasmEdge configuration with the host registrations of
+// the granted capabilities.
+func NewWasmedgeConfigure(granted []string, host Host) *wasmedge.Configure {
+	var registrations []interface{}
+	for _, name := range granted {
+		if capabilities[name].WasmedgeHosts == nil {
+			continue
+		}
+		for _, registration := range capabilities[name].WasmedgeHosts(host) {
+			registrations = append(registrations, registration)
+		}
+	}
+	return wasmedge.NewConfigure(registrations...)
+}
+
+// RegisterWasmedge initializes the granted capabilities in vm, which was created with
+// the configuration of NewWasmedgeConfigure, giving them access to host. The returned
+// function releases the modules registered for them once vm was released, even when
+// registering failed.
+func RegisterWasmedge(vm *wasmedge.VM, granted []string, host Host) (func(), error) {
+	var modules []*wasmedge.Module
+	release := func() {
+		for _, module := range modules {
+			module.Release()
+		}
+	}
+
+	for _, name := range granted {
+		capability := capabilities[name]
+		if capability.RegisterWasmedge == nil {
+			continue
+		}
+		module, err := capability.RegisterWasmedge(vm, host)
+		if module != nil {
+			modules = append(modules, module)
+		}
+		if err != nil {
+			return release, fmt.Errorf("failed to register the %q capability: %v", name, err)
+		}
+	}
+
+	return release, nil
+}
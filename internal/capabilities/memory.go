@@ -0,0 +1,50 @@
+package capabilities
+
+import (
+	"errors"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+	"github.com/second-state/WasmEdge-go/wasmedge"
+)
+
+var errOutOfBounds = errors.New("pointer out of bounds")
+
+// view returns length bytes of the linear memory of the calling instance at ptr.
+type view func(ptr, length int32) ([]byte, error)
+
+// wasmtimeView views the memory exported by the caller.
+func wasmtimeView(caller *wasmtime.Caller) (view, error) {
+	export := caller.GetExport("memory")
+	if export == nil || export.Memory() == nil {
+		return nil, errors.New("module exports no memory")
+	}
+	memory := export.Memory().UnsafeData(caller)
+
+	return func(ptr, length int32) ([]byte, error) {
+		start := uint64(uint32(ptr))
+		end := start + uint64(uint32(length))
+		if end > uint64(len(memory)) {
+			return nil, errOutOfBounds
+		}
+		return memory[start:end], nil
+	}, nil
+}
+
+// wasmedgeView views the first memory of the caller.
+func wasmedgeView(frame *wasmedge.CallingFrame) (view, error) {
+	memory := frame.GetMemoryByIndex(0)
+	if memory == nil {
+		return nil, errors.New("module has no memory")
+	}
+
+	return func(ptr, length int32) ([]byte, error) {
+		if length == 0 {
+			return nil, nil
+		}
+		data, err := memory.GetData(uint(uint32(ptr)), uint(uint32(length)))
+		if err != nil {
+			return nil, errOutOfBounds
+		}
+		return data, nil
+	}, nil
+}
@@ -0,0 +1,78 @@
+package capabilities
+
+import (
+	"fmt"
+	"webserver/internal/secrets"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+	"github.com/second-state/WasmEdge-go/wasmedge"
+)
+
+// HostModule is the import module of the host functions that are not WASI.
+const HostModule = "wasmbox"
+
+// secretNotFound is returned by get_secret for secrets the function was not given.
+const secretNotFound = -1
+
+// getSecret implements
+//
+//	get_secret(name_ptr, name_len, buf_ptr, buf_len i32) i32
+//
+// It returns the length of the secret called name, whose value is only written to buf
+// when it fits, or -1 when there is no such secret. Pointers outside of memory trap.
+func getSecret(memory view, values secrets.Secrets, namePtr, nameLen, bufPtr, bufLen int32) (int32, error) {
+	name, err := memory(namePtr, nameLen)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := values[string(name)]
+	if !ok {
+		return secretNotFound, nil
+	}
+
+	if len(value) <= int(uint32(bufLen)) {
+		buf, err := memory(bufPtr, int32(len(value)))
+		if err != nil {
+			return 0, err
+		}
+		copy(buf, value)
+	}
+	return int32(len(value)), nil
+}
+
+func defineSecretsWasmtime(linker *wasmtime.Linker, host Host) error {
+	return linker.FuncWrap(HostModule, "get_secret", func(caller *wasmtime.Caller, namePtr, nameLen, bufPtr, bufLen int32) (int32, *wasmtime.Trap) {
+		memory, err := wasmtimeView(caller)
+		if err != nil {
+			return 0, wasmtime.NewTrap(fmt.Sprintf("get_secret: %v", err))
+		}
+
+		length, err := getSecret(memory, host.Secrets, namePtr, nameLen, bufPtr, bufLen)
+		if err != nil {
+			return 0, wasmtime.NewTrap(fmt.Sprintf("get_secret: %v", err))
+		}
+		return length, nil
+	})
+}
+
+func registerSecretsWasmedge(vm *wasmedge.VM, host Host) (*wasmedge.Module, error) {
+	i32 := wasmedge.ValType_I32
+	funcType := wasmedge.NewFunctionType([]wasmedge.ValType{i32, i32, i32, i32}, []wasmedge.ValType{i32})
+	defer funcType.Release()
+
+	module := wasmedge.NewModule(HostModule)
+	module.AddFunction("get_secret", wasmedge.NewFunction(funcType, func(_ interface{}, frame *wasmedge.CallingFrame, params []interface{}) ([]interface{}, wasmedge.Result) {
+		memory, err := wasmedgeView(frame)
+		if err != nil {
+			return nil, wasmedge.Result_Fail
+		}
+
+		length, err := getSecret(memory, host.Secrets, params[0].(int32), params[1].(int32), params[2].(int32), params[3].(int32))
+		if err != nil {
+			return nil, wasmedge.Result_Fail
+		}
+		return []interface{}{length}, wasmedge.Result_Success
+	}, nil, 0))
+
+	return module, vm.RegisterModule(module)
+}
@@ -0,0 +1,132 @@
+package capabilities
+
+import (
+	"encoding/binary"
+	"webserver/internal/determinism"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+	"github.com/second-state/WasmEdge-go/wasmedge"
+)
+
+// wasiModule is the WASI module whose clocks and randomness deterministic invocations
+// replace, along with the ones of wasiUnstableModule on Wasmtime. WasmEdge does not
+// provide wasiUnstableModule at all.
+const (
+	wasiModule         = "wasi_snapshot_preview1"
+	wasiUnstableModule = "wasi_unstable"
+)
+
+// WASI errnos
+const (
+	errnoSuccess = 0
+	errnoFault   = 21
+	errnoInval   = 28
+)
+
+// clockTimeGet implements clock_time_get(id i32, precision i64, time_ptr i32) errno on source.
+func clockTimeGet(memory view, source *determinism.Source, clockID int32, timePtr int32) int32 {
+	now, ok := source.Now(uint32(clockID))
+	if !ok {
+		return errnoInval
+	}
+	buf, err := memory(timePtr, 8)
+	if err != nil {
+		return errnoFault
+	}
+	binary.LittleEndian.PutUint64(buf, now)
+	return errnoSuccess
+}
+
+// randomGet implements random_get(buf i32, buf_len i32) errno on source.
+func randomGet(memory view, source *determinism.Source, bufPtr, bufLen int32) int32 {
+	buf, err := memory(bufPtr, bufLen)
+	if err != nil {
+		return errnoFault
+	}
+	source.Read(buf)
+	return errnoSuccess
+}
+
+func defineWasiWasmtime(linker *wasmtime.Linker, host Host) error {
+	if err := linker.DefineWasi(); err != nil {
+		return err
+	}
+	source := host.Deterministic
+	if source == nil {
+		return nil
+	}
+
+	linker.AllowShadowing(true)
+	defer linker.AllowShadowing(false)
+
+	// Both functions have the same signature in both modules
+	for _, module := range []string{wasiModule, wasiUnstableModule} {
+		err := linker.FuncWrap(module, "clock_time_get", func(caller *wasmtime.Caller, clockID int32, _ int64, timePtr int32) int32 {
+			memory, err := wasmtimeView(caller)
+			if err != nil {
+				return errnoFault
+			}
+			return clockTimeGet(memory, source, clockID, timePtr)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = linker.FuncWrap(module, "random_get", func(caller *wasmtime.Caller, bufPtr, bufLen int32) int32 {
+			memory, err := wasmtimeView(caller)
+			if err != nil {
+				return errnoFault
+			}
+			return randomGet(memory, source, bufPtr, bufLen)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// wasiWasmedgeHosts registers the WASI host module, unless it has to be replaced.
+func wasiWasmedgeHosts(host Host) []wasmedge.HostRegistration {
+	if host.Deterministic != nil {
+		return nil
+	}
+	return []wasmedge.HostRegistration{wasmedge.WASI}
+}
+
+func registerWasiWasmedge(vm *wasmedge.VM, host Host) (*wasmedge.Module, error) {
+	source := host.Deterministic
+	if source == nil {
+		vm.GetImportModule(wasmedge.WASI).InitWasi(host.WASI.Args, host.WASI.Env, host.WASI.Preopens)
+		return nil, nil
+	}
+
+	// Functions added to a module replace the ones of the same name, which can only be
+	// done on a WASI module of our own instead of the host registration
+	module := wasmedge.NewWasiModule(host.WASI.Args, host.WASI.Env, host.WASI.Preopens)
+
+	i32, i64 := wasmedge.ValType_I32, wasmedge.ValType_I64
+	clockType := wasmedge.NewFunctionType([]wasmedge.ValType{i32, i64, i32}, []wasmedge.ValType{i32})
+	defer clockType.Release()
+	randomType := wasmedge.NewFunctionType([]wasmedge.ValType{i32, i32}, []wasmedge.ValType{i32})
+	defer randomType.Release()
+
+	module.AddFunction("clock_time_get", wasmedge.NewFunction(clockType, func(_ interface{}, frame *wasmedge.CallingFrame, params []interface{}) ([]interface{}, wasmedge.Result) {
+		memory, err := wasmedgeView(frame)
+		if err != nil {
+			return []interface{}{int32(errnoFault)}, wasmedge.Result_Success
+		}
+		return []interface{}{clockTimeGet(memory, source, params[0].(int32), params[2].(int32))}, wasmedge.Result_Success
+	}, nil, 0))
+
+	module.AddFunction("random_get", wasmedge.NewFunction(randomType, func(_ interface{}, frame *wasmedge.CallingFrame, params []interface{}) ([]interface{}, wasmedge.Result) {
+		memory, err := wasmedgeView(frame)
+		if err != nil {
+			return []interface{}{int32(errnoFault)}, wasmedge.Result_Success
+		}
+		return []interface{}{randomGet(memory, source, params[0].(int32), params[1].(int32))}, wasmedge.Result_Success
+	}, nil, 0))
+
+	return module, vm.RegisterModule(module)
+}
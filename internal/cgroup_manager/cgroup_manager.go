@@ -71,6 +71,32 @@ func (cm *CgroupManager) GetContainerCgroupPath() string {
 	return filepath.Join("/data/kubepods.slice/kubepods-burstable.slice", formatedPodCgroup, cm.Config.ContainerID)
 }
 
+// ContainerLimits returns the CPU (in millicores) and memory (in MiB) limits of the
+// container's cgroup. Limits that are not set or can not be read are zero.
+func (cm *CgroupManager) ContainerLimits() (int, int) {
+	millicores := 0
+	if data, err := os.ReadFile(filepath.Join(cm.GetContainerCgroupPath(), "cpu.max")); err == nil {
+		// "<quota> <period>" in microseconds, or "max <period>"
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 {
+			quota, quotaErr := strconv.Atoi(fields[0])
+			period, periodErr := strconv.Atoi(fields[1])
+			if quotaErr == nil && periodErr == nil && period > 0 {
+				millicores = quota * 1000 / period
+			}
+		}
+	}
+
+	mebibytes := 0
+	if data, err := os.ReadFile(filepath.Join(cm.GetContainerCgroupPath(), "memory.max")); err == nil {
+		if bytes, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			mebibytes = bytes / (1 << 20)
+		}
+	}
+
+	return millicores, mebibytes
+}
+
 func (cm *CgroupManager) SetCgroupLimits(cgroupName, cfsQuotaUs string) {
 	start := time.Now()
 	formatedPodCgroup := "kubepods-burstable-pod" + strings.ReplaceAll(cm.Config.PodUID, "-", "_") + ".slice"
@@ -91,6 +117,19 @@ func (cm *CgroupManager) SetCgroupLimits(cgroupName, cfsQuotaUs string) {
 	slog.Debug("Applied resource limits", "cgroupCpuFilePath", cgroupCpuFilePath, "time", time.Since(start), "cpu_limit", cfsQuotaUs)
 }
 
+// SetCgroupWeight sets the cgroup's share of CPU time under contention (1-10000, default 100).
+func (cm *CgroupManager) SetCgroupWeight(cgroupName string, weight int) {
+	start := time.Now()
+	cgroupWeightFilePath := filepath.Join(cm.GetThreadCgroupPath(cgroupName), "cpu.weight")
+
+	err := os.WriteFile(cgroupWeightFilePath, []byte(strconv.Itoa(weight)), 0644)
+	if err != nil {
+		slog.Error("Failed to write text to file", "reason", err.Error())
+	}
+
+	slog.Debug("Applied cpu weight", "cgroupWeightFilePath", cgroupWeightFilePath, "time", time.Since(start), "cpu_weight", weight)
+}
+
 func (cm *CgroupManager) DeleteCgroup(cgroupName string) {
 	start := time.Now()
 	cgroupNameFormatted := "memory,cpu:" + cgroupName
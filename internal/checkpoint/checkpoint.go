@@ -0,0 +1,384 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/snapshot"
+
+	"github.com/google/uuid"
+)
+
+const (
+	metadataFile = "checkpoint.json"
+	stateFile    = "state" + snapshot.FileSuffix
+	stdinFile    = "stdin"
+	stdoutFile   = "stdout"
+)
+
+var (
+	ErrNotFound          = errors.New("invocation not found")
+	ErrNoCheckpoint      = errors.New("checkpoint not found")
+	ErrNotCheckpointable = errors.New("invocation cannot be checkpointed, its module does not export the resume function or can not be interrupted")
+	ErrNotResumable      = errors.New("module does not export the resume function")
+	ErrAlreadyRequested  = errors.New("checkpoint already requested")
+	ErrFinished          = errors.New("invocation finished before reaching a safe point")
+	ErrTimeout           = errors.New("timed out waiting for the checkpoint")
+)
+
+// Interrupter is implemented by engines that can interrupt running guests at a
+// safe point, e.g. a Wasmtime engine with epoch interruption enabled.
+type Interrupter interface {
+	IncrementEpoch()
+}
+
+type Metadata struct {
+	ID          string    `json:"checkpoint_id"`
+	RequestID   string    `json:"request_id"`
+	WasmFile    string    `json:"wasm_file"`
+	ModuleHash  string    `json:"module_hash"`
+	MemoryLimit string    `json:"memory_limit"`
+	Pod         string    `json:"pod"`
+	StartedAt   time.Time `json:"started_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Checkpoint is everything needed to restart an invocation on a fresh instance from the
+// resume export. It is guest-cooperative rather than a capture of the running instance:
+// interrupting the guest unwinds its call stack, and WASI state such as open file
+// descriptors or the stdin read position is not captured, so resuming relies on the guest
+// keeping its progress in linear memory or globals.
+type Checkpoint struct {
+	Metadata Metadata
+	State    *snapshot.Snapshot
+	Stdin    []byte
+	Stdout   []byte
+}
+
+type Invocation struct {
+	RequestID      string    `json:"request_id"`
+	WasmFile       string    `json:"wasm_file"`
+	StartedAt      time.Time `json:"started_at"`
+	Checkpointable bool      `json:"checkpointable"`
+
+	interrupter Interrupter
+	requested   bool
+	result      chan result
+}
+
+type result struct {
+	metadata Metadata
+	err      error
+}
+
+type CheckpointManager struct {
+	Config   *config.CheckpointConfig
+	inflight map[string]*Invocation
+	mu       sync.Mutex
+}
+
+func (cm *CheckpointManager) Init() error {
+	cm.inflight = make(map[string]*Invocation)
+
+	if !cm.Config.EnableCheckpoints {
+		return nil
+	}
+
+	return os.MkdirAll(cm.Config.CheckpointDir, os.ModePerm)
+}
+
+func (cm *CheckpointManager) Enabled() bool {
+	return cm.Config.EnableCheckpoints
+}
+
+// Register tracks a running invocation. A nil interrupter marks it as not checkpointable,
+// which callers pass for modules without the resume export.
+func (cm *CheckpointManager) Register(requestID, wasmFile string, interrupter Interrupter) *Invocation {
+	invocation := &Invocation{
+		RequestID:      requestID,
+		WasmFile:       wasmFile,
+		StartedAt:      time.Now(),
+		Checkpointable: interrupter != nil,
+		interrupter:    interrupter,
+		result:         make(chan result, 1),
+	}
+
+	cm.mu.Lock()
+	cm.inflight[requestID] = invocation
+	cm.mu.Unlock()
+
+	return invocation
+}
+
+// Unregister stops tracking an invocation. If a checkpoint was requested but the
+// invocation completed without producing one, the requester is told so.
+func (cm *CheckpointManager) Unregister(invocation *Invocation) {
+	cm.mu.Lock()
+	delete(cm.inflight, invocation.RequestID)
+	cm.mu.Unlock()
+
+	select {
+	case invocation.result <- result{err: ErrFinished}:
+	default:
+	}
+}
+
+// Requested reports whether the invocation was interrupted to be checkpointed.
+func (cm *CheckpointManager) Requested(invocation *Invocation) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	return invocation.requested
+}
+
+// Complete hands the outcome of a requested checkpoint back to the requester.
+func (cm *CheckpointManager) Complete(invocation *Invocation, metadata Metadata, err error) {
+	select {
+	case invocation.result <- result{metadata: metadata, err: err}:
+	default:
+	}
+}
+
+func (cm *CheckpointManager) List() []Invocation {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	invocations := make([]Invocation, 0, len(cm.inflight))
+	for _, invocation := range cm.inflight {
+		invocations = append(invocations, *invocation)
+	}
+
+	sort.Slice(invocations, func(i, j int) bool {
+		return invocations[i].StartedAt.Before(invocations[j].StartedAt)
+	})
+
+	return invocations
+}
+
+// Checkpoint interrupts a running invocation at its next safe point and waits
+// until its state is written to disk.
+func (cm *CheckpointManager) Checkpoint(requestID string) (Metadata, error) {
+	cm.mu.Lock()
+	invocation, ok := cm.inflight[requestID]
+	if !ok {
+		cm.mu.Unlock()
+		return Metadata{}, ErrNotFound
+	}
+	if !invocation.Checkpointable {
+		cm.mu.Unlock()
+		return Metadata{}, ErrNotCheckpointable
+	}
+	if invocation.requested {
+		cm.mu.Unlock()
+		return Metadata{}, ErrAlreadyRequested
+	}
+	invocation.requested = true
+	cm.mu.Unlock()
+
+	invocation.interrupter.IncrementEpoch()
+
+	select {
+	case res := <-invocation.result:
+		return res.metadata, res.err
+	case <-time.After(time.Duration(cm.Config.CheckpointTimeoutMS) * time.Millisecond):
+		return Metadata{}, ErrTimeout
+	}
+}
+
+// CheckpointAll checkpoints every checkpointable in-flight invocation, e.g. before the pod is drained.
+func (cm *CheckpointManager) CheckpointAll() []Metadata {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var checkpoints []Metadata
+
+	for _, invocation := range cm.List() {
+		if !invocation.Checkpointable {
+			continue
+		}
+
+		wg.Add(1)
+		go func(requestID string) {
+			defer wg.Done()
+
+			metadata, err := cm.Checkpoint(requestID)
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			checkpoints = append(checkpoints, metadata)
+			mu.Unlock()
+		}(invocation.RequestID)
+	}
+
+	wg.Wait()
+	return checkpoints
+}
+
+func (cm *CheckpointManager) dir(id string) string {
+	return filepath.Join(cm.Config.CheckpointDir, id)
+}
+
+// Save writes a checkpoint into a temporary directory and renames it into place,
+// so other WasmBox instances sharing the directory never observe partial checkpoints.
+func (cm *CheckpointManager) Save(checkpoint *Checkpoint) (Metadata, error) {
+	checkpoint.Metadata.ID = uuid.New().String()
+	checkpoint.Metadata.CreatedAt = time.Now()
+
+	tmpDir, err := os.MkdirTemp(cm.Config.CheckpointDir, ".tmp-")
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := snapshot.Save(filepath.Join(tmpDir, stateFile), checkpoint.State); err != nil {
+		return Metadata{}, err
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, stdinFile), checkpoint.Stdin, 0644); err != nil {
+		return Metadata{}, err
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, stdoutFile), checkpoint.Stdout, 0644); err != nil {
+		return Metadata{}, err
+	}
+
+	metadata, err := json.MarshalIndent(checkpoint.Metadata, "", "  ")
+	if err != nil {
+		return Metadata{}, err
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, metadataFile), metadata, 0644); err != nil {
+		return Metadata{}, err
+	}
+
+	if err := os.Rename(tmpDir, cm.dir(checkpoint.Metadata.ID)); err != nil {
+		return Metadata{}, err
+	}
+
+	return checkpoint.Metadata, nil
+}
+
+func readMetadata(dir string) (Metadata, error) {
+	var metadata Metadata
+
+	data, err := os.ReadFile(filepath.Join(dir, metadataFile))
+	if err != nil {
+		return metadata, err
+	}
+
+	err = json.Unmarshal(data, &metadata)
+	return metadata, err
+}
+
+func loadDir(dir string) (*Checkpoint, error) {
+	metadata, err := readMetadata(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := snapshot.Load(filepath.Join(dir, stateFile), metadata.ModuleHash, "")
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := os.ReadFile(filepath.Join(dir, stdinFile))
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := os.ReadFile(filepath.Join(dir, stdoutFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checkpoint{Metadata: metadata, State: state, Stdin: stdin, Stdout: stdout}, nil
+}
+
+func validID(id string) error {
+	if id == "" || id != filepath.Base(id) || id[0] == '.' {
+		return fmt.Errorf("invalid checkpoint id %q", id)
+	}
+	return nil
+}
+
+// Claim atomically takes ownership of a checkpoint, so only one WasmBox instance
+// resumes it, and loads it. The claim must be ended with Release or Unclaim.
+func (cm *CheckpointManager) Claim(id string) (*Checkpoint, error) {
+	if err := validID(id); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(cm.dir(id), cm.claimedDir(id)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNoCheckpoint
+		}
+		return nil, err
+	}
+
+	checkpoint, err := loadDir(cm.claimedDir(id))
+	if err != nil {
+		cm.Unclaim(id)
+		return nil, err
+	}
+
+	return checkpoint, nil
+}
+
+// Release deletes a claimed checkpoint once it was resumed.
+func (cm *CheckpointManager) Release(id string) error {
+	return os.RemoveAll(cm.claimedDir(id))
+}
+
+// Unclaim puts a claimed checkpoint back, e.g. when resuming it failed.
+func (cm *CheckpointManager) Unclaim(id string) error {
+	return os.Rename(cm.claimedDir(id), cm.dir(id))
+}
+
+func (cm *CheckpointManager) claimedDir(id string) string {
+	return filepath.Join(cm.Config.CheckpointDir, ".claimed-"+id)
+}
+
+func (cm *CheckpointManager) ListCheckpoints() ([]Metadata, error) {
+	entries, err := os.ReadDir(cm.Config.CheckpointDir)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoints := []Metadata{}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name()[0] == '.' {
+			continue
+		}
+
+		metadata, err := readMetadata(cm.dir(entry.Name()))
+		if err != nil {
+			continue
+		}
+		checkpoints = append(checkpoints, metadata)
+	}
+
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].CreatedAt.Before(checkpoints[j].CreatedAt)
+	})
+
+	return checkpoints, nil
+}
+
+func (cm *CheckpointManager) Delete(id string) error {
+	if err := validID(id); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(cm.dir(id)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrNoCheckpoint
+		}
+		return err
+	}
+
+	return os.RemoveAll(cm.dir(id))
+}
@@ -0,0 +1,209 @@
+package checkpoint
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"webserver/internal/config"
+	"webserver/internal/snapshot"
+)
+
+func newTestManager(t *testing.T, timeoutMS int) *CheckpointManager {
+	t.Helper()
+	cm := &CheckpointManager{Config: &config.CheckpointConfig{
+		EnableCheckpoints:   true,
+		CheckpointDir:       t.TempDir(),
+		CheckpointTimeoutMS: timeoutMS,
+	}}
+	if err := cm.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return cm
+}
+
+func testCheckpoint() *Checkpoint {
+	return &Checkpoint{
+		Metadata: Metadata{RequestID: "request", WasmFile: "function@v1", ModuleHash: "module"},
+		State: &snapshot.Snapshot{
+			ModuleHash:  "module",
+			MemoryPages: 2,
+			Pages:       []snapshot.Page{{Index: 1, Data: bytes.Repeat([]byte{7}, snapshot.WasmPageSize)}},
+			Globals:     []snapshot.Global{{Name: "progress", Type: "i64", Bits: 3}},
+		},
+		Stdin:  []byte("input"),
+		Stdout: []byte("partial output"),
+	}
+}
+
+func TestSaveClaimRelease(t *testing.T) {
+	cm := newTestManager(t, 1000)
+
+	metadata, err := cm.Save(testCheckpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed, err := cm.ListCheckpoints()
+	if err != nil || len(listed) != 1 || listed[0].ID != metadata.ID {
+		t.Fatalf("ListCheckpoints() = %v, %v, want only %s", listed, err, metadata.ID)
+	}
+
+	claimed, err := cm.Claim(metadata.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testCheckpoint()
+	if claimed.Metadata.RequestID != want.Metadata.RequestID || claimed.State.MemoryPages != want.State.MemoryPages ||
+		!bytes.Equal(claimed.State.Pages[0].Data, want.State.Pages[0].Data) || claimed.State.Globals[0] != want.State.Globals[0] ||
+		!bytes.Equal(claimed.Stdin, want.Stdin) || !bytes.Equal(claimed.Stdout, want.Stdout) {
+		t.Errorf("claimed checkpoint %+v differs from the saved one", claimed)
+	}
+
+	// The rename makes the claim exclusive, and hides the checkpoint while it is resumed
+	if _, err := cm.Claim(metadata.ID); !errors.Is(err, ErrNoCheckpoint) {
+		t.Errorf("second claim got %v, want ErrNoCheckpoint", err)
+	}
+	if listed, _ := cm.ListCheckpoints(); len(listed) != 0 {
+		t.Errorf("claimed checkpoint is still listed: %v", listed)
+	}
+	if err := cm.Delete(metadata.ID); !errors.Is(err, ErrNoCheckpoint) {
+		t.Errorf("deleting a claimed checkpoint got %v, want ErrNoCheckpoint", err)
+	}
+
+	if err := cm.Unclaim(metadata.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cm.Claim(metadata.ID); err != nil {
+		t.Fatalf("claim after unclaim: %v", err)
+	}
+	if err := cm.Release(metadata.ID); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(cm.Config.CheckpointDir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("checkpoint directory holds %v after release, %v", entries, err)
+	}
+}
+
+func TestClaimUnclaimsUnreadableCheckpoints(t *testing.T) {
+	cm := newTestManager(t, 1000)
+	metadata, err := cm.Save(testCheckpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(cm.dir(metadata.ID), stdinFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cm.Claim(metadata.ID); err == nil {
+		t.Fatal("claimed a checkpoint without stdin")
+	}
+	if _, err := os.Stat(cm.dir(metadata.ID)); err != nil {
+		t.Errorf("checkpoint was not put back: %v", err)
+	}
+}
+
+func TestInvalidIDs(t *testing.T) {
+	cm := newTestManager(t, 1000)
+	metadata, err := cm.Save(testCheckpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cm.Claim(metadata.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"", "..", "../" + metadata.ID, ".claimed-" + metadata.ID, ".tmp-1"} {
+		if _, err := cm.Claim(id); err == nil || errors.Is(err, ErrNoCheckpoint) {
+			t.Errorf("Claim(%q) = %v, want an invalid id error", id, err)
+		}
+		if err := cm.Delete(id); err == nil || errors.Is(err, ErrNoCheckpoint) {
+			t.Errorf("Delete(%q) = %v, want an invalid id error", id, err)
+		}
+	}
+}
+
+// interrupter completes a checkpoint of invocation when the guest is interrupted, like
+// the server does once the interrupted call returns.
+type interrupter struct {
+	cm         *CheckpointManager
+	invocation *Invocation
+	metadata   Metadata
+}
+
+func (i *interrupter) IncrementEpoch() {
+	go func() {
+		if i.cm.Requested(i.invocation) {
+			i.cm.Complete(i.invocation, i.metadata, nil)
+		}
+	}()
+}
+
+func TestCheckpoint(t *testing.T) {
+	cm := newTestManager(t, 1000)
+	interrupter := &interrupter{cm: cm, metadata: Metadata{ID: "checkpoint"}}
+	interrupter.invocation = cm.Register("request", "function@v1", interrupter)
+	defer cm.Unregister(interrupter.invocation)
+
+	metadata, err := cm.Checkpoint("request")
+	if err != nil || metadata.ID != "checkpoint" {
+		t.Fatalf("Checkpoint() = %+v, %v", metadata, err)
+	}
+	if _, err := cm.Checkpoint("request"); !errors.Is(err, ErrAlreadyRequested) {
+		t.Errorf("second checkpoint got %v, want ErrAlreadyRequested", err)
+	}
+	if _, err := cm.Checkpoint("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestCheckpointRefusesInvocationsWithoutResumeExport(t *testing.T) {
+	cm := newTestManager(t, 1000)
+	invocation := cm.Register("request", "function@v1", nil)
+	defer cm.Unregister(invocation)
+
+	if _, err := cm.Checkpoint("request"); !errors.Is(err, ErrNotCheckpointable) {
+		t.Errorf("got %v, want ErrNotCheckpointable", err)
+	}
+	if listed := cm.List(); len(listed) != 1 || listed[0].Checkpointable {
+		t.Errorf("List() = %+v, want one invocation that is not checkpointable", listed)
+	}
+	if checkpoints := cm.CheckpointAll(); len(checkpoints) != 0 {
+		t.Errorf("CheckpointAll() = %v, want none", checkpoints)
+	}
+}
+
+// finisher lets the invocation finish instead of reaching a safe point.
+type finisher struct {
+	cm         *CheckpointManager
+	invocation *Invocation
+}
+
+func (f *finisher) IncrementEpoch() {
+	go f.cm.Unregister(f.invocation)
+}
+
+func TestCheckpointOfFinishedInvocation(t *testing.T) {
+	cm := newTestManager(t, 1000)
+	finisher := &finisher{cm: cm}
+	finisher.invocation = cm.Register("request", "function@v1", finisher)
+
+	if _, err := cm.Checkpoint("request"); !errors.Is(err, ErrFinished) {
+		t.Errorf("got %v, want ErrFinished", err)
+	}
+}
+
+type ignorer struct{}
+
+func (ignorer) IncrementEpoch() {}
+
+func TestCheckpointTimeout(t *testing.T) {
+	cm := newTestManager(t, 10)
+	invocation := cm.Register("request", "function@v1", ignorer{})
+	defer cm.Unregister(invocation)
+
+	if _, err := cm.Checkpoint("request"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want ErrTimeout", err)
+	}
+}
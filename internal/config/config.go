@@ -16,6 +16,12 @@ type WebServerConfig struct {
 	MemoryLimit                  float64 `env-required:"true" env:"MEMORY_LIMIT"`
 	EnableMemPreAllocation       bool    `env-required:"false" env:"ENABLE_MEM_PRE_ALLOCATION"`
 	MemPreAllocationRatio        float64 `env-required:"false" env:"MEM_PRE_ALLOCATION_RATIO"`
+	EnableSnapshots              bool    `env-required:"false" env:"ENABLE_SNAPSHOTS"`
+	SnapshotInitExport           string  `env-required:"false" env:"SNAPSHOT_INIT_EXPORT" env-default:"wizer.initialize"`
+	AdminToken                   string  `env-required:"false" env:"ADMIN_TOKEN"`
+	// Kubernetes quantities capping every invocation, the container's limits if unset
+	MaxCPULimit    string `env-required:"false" env:"MAX_CPU_LIMIT"`
+	MaxMemoryLimit string `env-required:"false" env:"MAX_MEMORY_LIMIT"`
 }
 
 type HealthCheckConfig struct {
@@ -35,9 +41,210 @@ type MetricsCollector struct {
 	MetricsCollectionWindow int `env-required:"true" env:"METRICS_COLLECTION_WINDOW"`
 }
 
+type JobManagerConfig struct {
+	JobRetentionSec        int    `env-required:"false" env:"JOB_RETENTION_SEC" env-default:"3600"`
+	JobWorkers             int    `env-required:"false" env:"JOB_WORKERS" env-default:"8"`
+	JobQueueSize           int    `env-required:"false" env:"JOB_QUEUE_SIZE" env-default:"256"`
+	WebhookSecret          string `env-required:"false" env:"WEBHOOK_SECRET"`
+	WebhookMaxRetries      int    `env-required:"false" env:"WEBHOOK_MAX_RETRIES" env-default:"5"`
+	WebhookRetryDelayMS    int    `env-required:"false" env:"WEBHOOK_RETRY_DELAY_MS" env-default:"500"`
+	WebhookMaxRetryDelayMS int    `env-required:"false" env:"WEBHOOK_MAX_RETRY_DELAY_MS" env-default:"30000"`
+	WebhookTimeoutMS       int    `env-required:"false" env:"WEBHOOK_TIMEOUT_MS" env-default:"5000"`
+	// Callback hosts that may resolve to private addresses, such as in-cluster receivers
+	WebhookAllowedHosts []string `env-required:"false" env:"WEBHOOK_ALLOWED_HOSTS"`
+}
+
+type FunctionRegistryConfig struct {
+	FunctionsDir    string `env-required:"false" env:"FUNCTIONS_DIR" env-default:"functions"`
+	MaxModuleSizeMB int    `env-required:"false" env:"MAX_MODULE_SIZE_MB" env-default:"256"`
+}
+
+type HotReloadConfig struct {
+	HotReload               bool `env-required:"false" env:"HOT_RELOAD" env-default:"true"`
+	HotReloadDrainTimeoutMS int  `env-required:"false" env:"HOT_RELOAD_DRAIN_TIMEOUT_MS" env-default:"30000"`
+}
+
+type ModuleCompilerConfig struct {
+	PrecompileFunctions bool   `env-required:"false" env:"PRECOMPILE_FUNCTIONS" env-default:"true"`
+	ArtifactCacheDir    string `env-required:"false" env:"ARTIFACT_CACHE_DIR" env-default:"functions/.wasmbox-cache"`
+}
+
+// FunctionManifest configures a function. CPU and memory are Kubernetes quantities such
+// as "500m" and "256Mi", timeouts durations such as "30s". Empty values keep the server defaults.
+type FunctionManifest struct {
+	CPU          ResourceManifest     `yaml:"cpu" json:"cpu"`
+	Memory       ResourceManifest     `yaml:"memory" json:"memory"`
+	Timeout      ResourceManifest     `yaml:"timeout" json:"timeout"`
+	Runtime      string               `yaml:"runtime" json:"runtime,omitempty"`
+	Entrypoint   string               `yaml:"entrypoint" json:"entrypoint,omitempty"`
+	WASI         WASIManifest         `yaml:"wasi" json:"wasi"`
+	ContentTypes ContentTypesManifest `yaml:"content_types" json:"content_types"`
+	// Capabilities is nil when none are declared, which is not the same as declaring an
+	// empty list, so it is stored even when empty
+	Capabilities []string `yaml:"capabilities" json:"capabilities"`
+	// Secrets only hold the names of the secrets, never their values
+	Secrets []SecretManifest `yaml:"secrets" json:"secrets,omitempty"`
+}
+
+type ResourceManifest struct {
+	Default string `yaml:"default" json:"default,omitempty"`
+	Max     string `yaml:"max" json:"max,omitempty"`
+}
+
+type WASIManifest struct {
+	Args    []string          `yaml:"args" json:"args,omitempty"`
+	Env     map[string]string `yaml:"env" json:"env,omitempty"`
+	Scratch ScratchManifest   `yaml:"scratch" json:"scratch"`
+	// Data are read-only directories of the data volume
+	Data []DataMountManifest `yaml:"data" json:"data,omitempty"`
+	// Preopens of host paths make the manifest invalid, they are only parsed to say so
+	Preopens []PreopenManifest `yaml:"preopens" json:"preopens,omitempty"`
+}
+
+type PreopenManifest struct {
+	HostPath  string `yaml:"host_path" json:"host_path"`
+	GuestPath string `yaml:"guest_path" json:"guest_path"`
+}
+
+// DataMountManifest maps Source, a path relative to DATA_DIR, to GuestPath.
+type DataMountManifest struct {
+	Source    string `yaml:"source" json:"source"`
+	GuestPath string `yaml:"guest_path" json:"guest_path"`
+}
+
+// ScratchManifest gives each invocation an empty directory preopened as /tmp. Quota is a
+// Kubernetes quantity such as "64Mi", empty keeps SCRATCH_QUOTA_MB.
+type ScratchManifest struct {
+	Enabled bool   `yaml:"enabled" json:"enabled,omitempty"`
+	Quota   string `yaml:"quota" json:"quota,omitempty"`
+}
+
+// SecretManifest gives a function the secret in the file Name of SECRETS_DIR, through
+// the get_secret host import and, when Env is set, as that WASI environment variable.
+type SecretManifest struct {
+	Name string `yaml:"name" json:"name"`
+	Env  string `yaml:"env" json:"env,omitempty"`
+}
+
+type ContentTypesManifest struct {
+	Request  []string `yaml:"request" json:"request,omitempty"`
+	Response string   `yaml:"response" json:"response,omitempty"`
+}
+
+type ShadowConfig struct {
+	ShadowSampleRate    float64 `env-required:"false" env:"SHADOW_SAMPLE_RATE" env-default:"0"`
+	ShadowCPUWeight     int     `env-required:"false" env:"SHADOW_CPU_WEIGHT" env-default:"1"`
+	ShadowMaxConcurrent int     `env-required:"false" env:"SHADOW_MAX_CONCURRENT" env-default:"1"`
+}
+
+// SignatureConfig points to a directory of PEM encoded Ed25519 or ECDSA P-256 public keys.
+type SignatureConfig struct {
+	TrustedKeysDir    string `env-required:"false" env:"TRUSTED_KEYS_DIR"`
+	RequireSignatures bool   `env-required:"false" env:"REQUIRE_SIGNATURES" env-default:"false"`
+}
+
+// AdmissionConfig is the policy uploaded modules are checked against.
+type AdmissionConfig struct {
+	AdmissionChecks      bool     `env-required:"false" env:"ADMISSION_CHECKS" env-default:"true"`
+	AllowedImportModules []string `env-required:"false" env:"ALLOWED_IMPORT_MODULES" env-default:"wasi_snapshot_preview1,wasi_unstable,wasmbox"`
+	AllowThreads         bool     `env-required:"false" env:"ALLOW_THREADS" env-default:"false"`
+	AllowSIMD            bool     `env-required:"false" env:"ALLOW_SIMD" env-default:"true"`
+}
+
+// ScratchConfig places the scratch directories of invocations. With ScratchTmpfs each one
+// is a tmpfs sized to its quota, otherwise their usage is polled every ScratchPollIntervalMS.
+type ScratchConfig struct {
+	ScratchDir            string `env-required:"false" env:"SCRATCH_DIR" env-default:"/dev/shm/wasmbox-scratch"`
+	ScratchTmpfs          bool   `env-required:"false" env:"SCRATCH_TMPFS" env-default:"true"`
+	ScratchQuotaMB        int    `env-required:"false" env:"SCRATCH_QUOTA_MB" env-default:"64"`
+	ScratchPollIntervalMS int    `env-required:"false" env:"SCRATCH_POLL_INTERVAL_MS" env-default:"100"`
+}
+
+// DataConfig is the volume functions' data mounts are read from.
+type DataConfig struct {
+	DataDir string `env-required:"false" env:"DATA_DIR"`
+	// DataRemountReadOnly bind mounts a writable DATA_DIR read-only over itself, which
+	// needs CAP_SYS_ADMIN and outlives the server in its mount namespace
+	DataRemountReadOnly bool `env-required:"false" env:"DATA_REMOUNT_READ_ONLY"`
+}
+
+// SecretsConfig is the directory secrets are read from, such as a mounted Kubernetes secret.
+type SecretsConfig struct {
+	SecretsDir string `env-required:"false" env:"SECRETS_DIR"`
+}
+
+type SchedulerConfig struct {
+	SchedulesFile string `env-required:"false" env:"SCHEDULES_FILE"`
+}
+
+type ScheduleConfig struct {
+	Name        string `yaml:"name" json:"name"`
+	Cron        string `yaml:"cron" json:"cron"`
+	Function    string `yaml:"function" json:"function"`
+	Input       string `yaml:"input" json:"input"`
+	CPULimit    string `yaml:"cpu_limit" json:"cpu_limit"`
+	MemoryLimit string `yaml:"memory_limit" json:"memory_limit"`
+	Overlap     string `yaml:"overlap" json:"overlap"`
+	JitterMS    int    `yaml:"jitter_ms" json:"jitter_ms"`
+}
+
+type SchedulesFile struct {
+	Schedules []ScheduleConfig `yaml:"schedules" json:"schedules"`
+}
+
+type TriggersConfig struct {
+	TriggersFile string `env-required:"false" env:"TRIGGERS_FILE"`
+}
+
+type TriggerConfig struct {
+	Name           string `yaml:"name" json:"name"`
+	FIFO           string `yaml:"fifo" json:"fifo"`
+	SpoolDir       string `yaml:"spool_dir" json:"spool_dir"`
+	PollIntervalMS int    `yaml:"poll_interval_ms" json:"poll_interval_ms"`
+	Function       string `yaml:"function" json:"function"`
+	CPULimit       string `yaml:"cpu_limit" json:"cpu_limit"`
+	MemoryLimit    string `yaml:"memory_limit" json:"memory_limit"`
+	Output         string `yaml:"output" json:"output"`
+	OutputType     string `yaml:"output_type" json:"output_type"`
+	Concurrency    int    `yaml:"concurrency" json:"concurrency"`
+}
+
+type TriggersFile struct {
+	Triggers []TriggerConfig `yaml:"triggers" json:"triggers"`
+}
+
+type CheckpointConfig struct {
+	EnableCheckpoints    bool   `env-required:"false" env:"ENABLE_CHECKPOINTS"`
+	CheckpointDir        string `env-required:"false" env:"CHECKPOINT_DIR" env-default:"checkpoints"`
+	ResumeExport         string `env-required:"false" env:"CHECKPOINT_RESUME_EXPORT" env-default:"wasmbox.resume"`
+	CheckpointTimeoutMS  int    `env-required:"false" env:"CHECKPOINT_TIMEOUT_MS" env-default:"10000"`
+	CheckpointOnShutdown bool   `env-required:"false" env:"CHECKPOINT_ON_SHUTDOWN"`
+}
+
+// MinioConfig locates the S3 compatible bucket functions are downloaded from. Modules are
+// stored as objects named Prefix followed by the function name.
 type MinioConfig struct {
-	Endpoint   string
-	AccessKey  string
-	SecretKey  string
-	BucketName string
+	Endpoint   string `env-required:"false" env:"MINIO_ENDPOINT"`
+	AccessKey  string `env-required:"false" env:"MINIO_ACCESS_KEY"`
+	SecretKey  string `env-required:"false" env:"MINIO_SECRET_KEY"`
+	BucketName string `env-required:"false" env:"MINIO_BUCKET_NAME" env-default:"functions"`
+	Prefix     string `env-required:"false" env:"MINIO_PREFIX"`
+	UseSSL     bool   `env-required:"false" env:"MINIO_USE_SSL" env-default:"false"`
+}
+
+// OCIConfig locates the repository functions are pulled from as Wasm OCI artifacts.
+// The module of a function is pulled from Repository followed by its name.
+type OCIConfig struct {
+	Repository string `env-required:"false" env:"OCI_REPOSITORY"`
+	DefaultTag string `env-required:"false" env:"OCI_DEFAULT_TAG" env-default:"latest"`
+	Username   string `env-required:"false" env:"OCI_USERNAME"`
+	Password   string `env-required:"false" env:"OCI_PASSWORD"`
+	// PlainHTTP is for local registries without TLS
+	PlainHTTP bool `env-required:"false" env:"OCI_PLAIN_HTTP" env-default:"false"`
+}
+
+type ModuleSourceConfig struct {
+	ModuleCacheDir             string `env-required:"false" env:"MODULE_CACHE_DIR" env-default:"/tmp/wasmbox-modules"`
+	ModuleCacheMaxMB           int    `env-required:"false" env:"MODULE_CACHE_MAX_MB" env-default:"1024"`
+	ModuleRevalidateIntervalMS int    `env-required:"false" env:"MODULE_REVALIDATE_INTERVAL_MS" env-default:"30000"`
 }
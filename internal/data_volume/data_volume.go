@@ -0,0 +1,149 @@
+package data_volume
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"webserver/internal/config"
+)
+
+// stRdonly is the ST_RDONLY flag of statfs, set on read-only mounts.
+const stRdonly = 0x1
+
+var (
+	ErrDisabled = errors.New("no data volume is configured")
+	ErrEscape   = errors.New("data mount escapes the data volume")
+	ErrWritable = errors.New("data volume is writable, mount it read-only")
+)
+
+// DataVolume gives functions read-only access to directories of DATA_DIR, such as fonts
+// or models, which their manifest maps into the guest. The volume is used through a
+// read-only mount, so that guests can not change what other invocations read, whatever
+// the runtime allows on preopened directories.
+type DataVolume struct {
+	Config *config.DataConfig
+	root   string
+}
+
+func (dv *DataVolume) Init() error {
+	if dv.Config.DataDir == "" {
+		return nil
+	}
+
+	root, err := filepath.Abs(dv.Config.DataDir)
+	if err != nil {
+		return err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	readOnly, err := isReadOnly(root)
+	if err != nil {
+		return err
+	}
+	if !readOnly && !dv.Config.DataRemountReadOnly {
+		return fmt.Errorf("%w: %s", ErrWritable, root)
+	} else if !readOnly {
+		if err := remountReadOnly(root); err != nil {
+			return fmt.Errorf("%w: %s can not be remounted read-only: %v", ErrWritable, root, err)
+		}
+		slog.Info("Remounted the data volume read-only", "dir", root)
+	}
+
+	dv.root = root
+	slog.Info("Using data volume", "dir", root)
+	return nil
+}
+
+func (dv *DataVolume) Enabled() bool {
+	return dv.root != ""
+}
+
+func isReadOnly(path string) (bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return false, err
+	}
+	return stat.Flags&stRdonly != 0, nil
+}
+
+// remountReadOnly bind mounts path onto itself and makes that mount read-only. Bind
+// mounts only become read-only when remounted.
+func remountReadOnly(path string) error {
+	if err := syscall.Mount(path, path, "", syscall.MS_BIND, ""); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		syscall.Unmount(path, syscall.MNT_DETACH)
+		return err
+	}
+	return nil
+}
+
+// Resolve returns the host directory of source, a path relative to the data volume.
+// Symlinks are resolved, and the result must still be inside the volume.
+func (dv *DataVolume) Resolve(source string) (string, error) {
+	if !dv.Enabled() {
+		return "", ErrDisabled
+	}
+	if !filepath.IsLocal(source) {
+		return "", fmt.Errorf("%w: %q is not a relative path inside it", ErrEscape, source)
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Join(dv.root, source))
+	if err != nil {
+		return "", err
+	}
+	if !within(dv.root, path) {
+		return "", fmt.Errorf("%w: %s resolves to %s", ErrEscape, source, path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", source)
+	}
+
+	return path, nil
+}
+
+// Check resolves source and looks for symlinks under it that point outside of it, which
+// the guest could otherwise follow out of the mount.
+func (dv *DataVolume) Check(source string) error {
+	path, err := dv.Resolve(source)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(path, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dv.root, current)
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			return fmt.Errorf("%w: broken symlink %s", ErrEscape, rel)
+		}
+		if !within(path, target) {
+			return fmt.Errorf("%w: symlink %s points outside of %s", ErrEscape, rel, source)
+		}
+		return nil
+	})
+}
+
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && filepath.IsLocal(rel)
+}
@@ -0,0 +1,98 @@
+package data_volume
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"webserver/internal/config"
+)
+
+// newTestVolume returns a data volume over a temporary directory holding fonts/ and
+// models/, without the read-only mount Init requires.
+func newTestVolume(t *testing.T) *DataVolume {
+	t.Helper()
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"fonts", "models"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &DataVolume{Config: &config.DataConfig{DataDir: root}, root: root}
+}
+
+func TestInitRefusesWritableVolume(t *testing.T) {
+	dv := &DataVolume{Config: &config.DataConfig{DataDir: t.TempDir()}}
+	if err := dv.Init(); !errors.Is(err, ErrWritable) {
+		t.Fatalf("got %v, want ErrWritable", err)
+	}
+	if dv.Enabled() {
+		t.Fatal("writable volume was enabled")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dv := newTestVolume(t)
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dv.root, "outside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("fonts", filepath.Join(dv.root, "typefaces")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, source := range []string{"fonts", "fonts/", "models/../fonts", "typefaces"} {
+		if path, err := dv.Resolve(source); err != nil || path != filepath.Join(dv.root, "fonts") {
+			t.Errorf("Resolve(%q) = %q, %v", source, path, err)
+		}
+	}
+
+	for _, source := range []string{"..", "../etc", "fonts/../../etc", "/etc", filepath.Join(dv.root, "fonts"), "outside"} {
+		if _, err := dv.Resolve(source); !errors.Is(err, ErrEscape) {
+			t.Errorf("Resolve(%q) = %v, want ErrEscape", source, err)
+		}
+	}
+
+	if _, err := (&DataVolume{}).Resolve("fonts"); !errors.Is(err, ErrDisabled) {
+		t.Errorf("got %v, want ErrDisabled", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dv := newTestVolume(t)
+	if err := os.Symlink("../models", filepath.Join(dv.root, "fonts", "models")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(dv.root, "models", "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dv.root, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing", filepath.Join(dv.root, "docs", "broken")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dv.root, "docs", "v1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("v1", filepath.Join(dv.root, "docs", "current")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Symlinks may only point inside the mounted directory, even if they stay in the volume
+	for _, source := range []string{"fonts", "models", "docs"} {
+		if err := dv.Check(source); !errors.Is(err, ErrEscape) {
+			t.Errorf("Check(%q) = %v, want ErrEscape", source, err)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(dv.root, "docs", "broken")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dv.Check("docs"); err != nil {
+		t.Errorf("Check(docs) = %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package determinism
+
+import (
+	"crypto/sha256"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	// Epoch is the realtime clock of deterministic invocations when they start,
+	// 2020-01-01T00:00:00Z in nanoseconds.
+	Epoch = uint64(1577836800 * time.Second)
+	// Tick is how much the clocks advance every time one is read, so that guests waiting
+	// for time to pass still make progress.
+	Tick = uint64(time.Millisecond)
+)
+
+// WASI clock ids
+const (
+	ClockRealtime uint32 = iota
+	ClockMonotonic
+	ClockProcessCPUTime
+	ClockThreadCPUTime
+)
+
+// Source replaces the clocks and randomness of an invocation, so that invocations with
+// the same seed and input see the same times and random bytes on every runtime. The
+// clocks start at Epoch (realtime) and zero (the others), and advance by Tick on every
+// read. Random bytes come from ChaCha8 keyed by the SHA-256 of the seed.
+type Source struct {
+	mu      sync.Mutex
+	elapsed uint64
+	random  *rand.ChaCha8
+}
+
+func New(seed string) *Source {
+	return &Source{random: rand.NewChaCha8(sha256.Sum256([]byte(seed)))}
+}
+
+// Now reads clock in nanoseconds. It returns false for unknown clocks.
+func (s *Source) Now(clock uint32) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var now uint64
+	switch clock {
+	case ClockRealtime:
+		now = Epoch + s.elapsed
+	case ClockMonotonic, ClockProcessCPUTime, ClockThreadCPUTime:
+		now = s.elapsed
+	default:
+		return 0, false
+	}
+
+	s.elapsed += Tick
+	return now, true
+}
+
+// Read fills p with the next random bytes.
+func (s *Source) Read(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.random.Read(p)
+}
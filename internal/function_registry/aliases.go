@@ -0,0 +1,301 @@
+package function_registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"webserver/internal/utils"
+)
+
+// maxHistory bounds how many times an alias can be rolled back in a row.
+const maxHistory = 20
+
+var aliasPattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+// Alias points to a version of a function. History holds the versions it pointed to
+// before, most recent last, so it can be rolled back.
+//
+// While Split is set, traffic through the alias is spread across its versions in
+// proportion to their weights, e.g. to canary a new version next to Version. Requests
+// carrying StickyHeader always get the same version for the same header value.
+type Alias struct {
+	Version      int               `json:"version"`
+	Split        []WeightedVersion `json:"split,omitempty"`
+	StickyHeader string            `json:"sticky_header,omitempty"`
+	History      []int             `json:"history,omitempty"`
+}
+
+type WeightedVersion struct {
+	Version int `json:"version"`
+	Weight  int `json:"weight"`
+}
+
+// pick chooses the version serving a request. The key is hashed so that equal keys
+// get the same version; requests without a key are spread randomly.
+func (a *Alias) pick(key string) int {
+	total := 0
+	for _, split := range a.Split {
+		total += split.Weight
+	}
+	if total == 0 {
+		return a.Version
+	}
+
+	var point int
+	if key == "" {
+		point = rand.Intn(total)
+	} else {
+		hasher := fnv.New64a()
+		hasher.Write([]byte(key))
+		point = int(hasher.Sum64() % uint64(total))
+	}
+
+	for _, split := range a.Split {
+		if point < split.Weight {
+			return split.Version
+		}
+		point -= split.Weight
+	}
+
+	return a.Version
+}
+
+// references reports whether the alias can route traffic to version.
+func (a *Alias) references(version int) bool {
+	if a.Version == version {
+		return true
+	}
+	for _, split := range a.Split {
+		if split.Version == version && split.Weight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func validAlias(alias string) error {
+	if !aliasPattern.MatchString(alias) {
+		return fmt.Errorf("%w %q", ErrInvalidAlias, alias)
+	}
+	return nil
+}
+
+func (fr *FunctionRegistry) aliasesPath(name string) string {
+	return filepath.Join(fr.versionsDir(name), aliasesFile)
+}
+
+func (fr *FunctionRegistry) readAliases(name string) (map[string]*Alias, error) {
+	aliases := make(map[string]*Alias)
+
+	data, err := os.ReadFile(fr.aliasesPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return aliases, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &aliases)
+	return aliases, err
+}
+
+// writeAliases replaces the aliases file atomically, so Resolve never reads a partial file.
+func (fr *FunctionRegistry) writeAliases(name string, aliases map[string]*Alias) error {
+	data, err := json.MarshalIndent(aliases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(fr.versionsDir(name), ".tmp-"+aliasesFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), fr.aliasesPath(name))
+}
+
+func setAlias(aliases map[string]*Alias, aliasName string, version int) {
+	alias, ok := aliases[aliasName]
+	if !ok {
+		aliases[aliasName] = &Alias{Version: version}
+		return
+	}
+
+	// Moving an alias ends any traffic split it had
+	alias.Split, alias.StickyHeader = nil, ""
+	if alias.Version == version {
+		return
+	}
+
+	alias.History = append(alias.History, alias.Version)
+	if len(alias.History) > maxHistory {
+		alias.History = alias.History[len(alias.History)-maxHistory:]
+	}
+	alias.Version = version
+}
+
+func without(versions []int, version int) []int {
+	kept := versions[:0]
+	for _, v := range versions {
+		if v != version {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// SetAlias points an alias of a function to an existing version.
+func (fr *FunctionRegistry) SetAlias(name, aliasName string, version int) (*Alias, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	if err := validAlias(aliasName); err != nil {
+		return nil, err
+	}
+
+	lock, err := fr.lock(name)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.UnlockFile(lock)
+
+	if !isRegularFile(fr.versionPath(name, version)) {
+		return nil, fmt.Errorf("%w: %s@%d", ErrNotFound, name, version)
+	}
+
+	aliases, err := fr.readAliases(name)
+	if err != nil {
+		return nil, err
+	}
+
+	setAlias(aliases, aliasName, version)
+	if err := fr.writeAliases(name, aliases); err != nil {
+		return nil, err
+	}
+
+	return aliases[aliasName], nil
+}
+
+// DeleteAlias removes an alias. The latest alias is managed by uploads and can not be removed.
+func (fr *FunctionRegistry) DeleteAlias(name, aliasName string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	if aliasName == LatestAlias {
+		return fmt.Errorf("%w: %s can not be deleted", ErrInvalidAlias, LatestAlias)
+	}
+
+	lock, err := fr.lock(name)
+	if err != nil {
+		return err
+	}
+	defer utils.UnlockFile(lock)
+
+	aliases, err := fr.readAliases(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := aliases[aliasName]; !ok {
+		return fmt.Errorf("%w: %s@%s", ErrNotFound, name, aliasName)
+	}
+
+	delete(aliases, aliasName)
+	return fr.writeAliases(name, aliases)
+}
+
+// SetSplit spreads the traffic of an existing alias across versions by weight. The
+// alias keeps its version, which serves all traffic again once the split is removed.
+func (fr *FunctionRegistry) SetSplit(name, aliasName string, split []WeightedVersion, stickyHeader string) (*Alias, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	total := 0
+	for _, weighted := range split {
+		if weighted.Weight < 0 {
+			return nil, fmt.Errorf("%w: negative weight for version %d", ErrInvalidSplit, weighted.Version)
+		}
+		total += weighted.Weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%w: weights must add up to more than 0", ErrInvalidSplit)
+	}
+
+	lock, err := fr.lock(name)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.UnlockFile(lock)
+
+	for _, weighted := range split {
+		if !isRegularFile(fr.versionPath(name, weighted.Version)) {
+			return nil, fmt.Errorf("%w: %s@%d", ErrNotFound, name, weighted.Version)
+		}
+	}
+
+	aliases, err := fr.readAliases(name)
+	if err != nil {
+		return nil, err
+	}
+
+	alias, ok := aliases[aliasName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s@%s", ErrNotFound, name, aliasName)
+	}
+
+	alias.Split, alias.StickyHeader = split, stickyHeader
+	if err := fr.writeAliases(name, aliases); err != nil {
+		return nil, err
+	}
+
+	return alias, nil
+}
+
+// Rollback undoes the last change of an alias: an active traffic split is removed,
+// otherwise the alias is pointed back to the version it pointed to before.
+func (fr *FunctionRegistry) Rollback(name, aliasName string) (*Alias, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	lock, err := fr.lock(name)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.UnlockFile(lock)
+
+	aliases, err := fr.readAliases(name)
+	if err != nil {
+		return nil, err
+	}
+
+	alias, ok := aliases[aliasName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s@%s", ErrNotFound, name, aliasName)
+	}
+
+	if len(alias.Split) > 0 {
+		alias.Split, alias.StickyHeader = nil, ""
+	} else if len(alias.History) > 0 {
+		alias.Version = alias.History[len(alias.History)-1]
+		alias.History = alias.History[:len(alias.History)-1]
+	} else {
+		return nil, ErrNoHistory
+	}
+	if err := fr.writeAliases(name, aliases); err != nil {
+		return nil, err
+	}
+
+	return alias, nil
+}
@@ -0,0 +1,804 @@
+package function_registry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"webserver/internal/admission"
+	"webserver/internal/config"
+	"webserver/internal/data_volume"
+	"webserver/internal/module_compiler"
+	"webserver/internal/module_source"
+	"webserver/internal/signature"
+	"webserver/internal/snapshot"
+	"webserver/internal/utils"
+	"webserver/internal/wasm_binary"
+)
+
+const (
+	// LatestAlias always points to the most recently uploaded version.
+	LatestAlias = "latest"
+
+	versionsDir = ".versions"
+	aliasesFile = "aliases.json"
+	lockFile    = ".lock"
+)
+
+var (
+	ErrNotFound        = errors.New("function not found")
+	ErrInvalidName     = errors.New("invalid function name")
+	ErrInvalidAlias    = errors.New("invalid alias")
+	ErrTooLarge        = errors.New("module is too large")
+	ErrNoHistory       = errors.New("alias has no previous version to roll back to")
+	ErrVersionInUse    = errors.New("version is referenced by an alias")
+	ErrInvalidSplit    = errors.New("invalid traffic split")
+	ErrInvalidRuntime  = errors.New("invalid runtime")
+	ErrInvalidManifest = errors.New("invalid manifest")
+	ErrInvalidLimit    = errors.New("invalid resource limit")
+)
+
+// InvalidModuleError is returned when an uploaded module is rejected.
+type InvalidModuleError struct {
+	Reason error
+}
+
+func (e *InvalidModuleError) Error() string {
+	return fmt.Sprintf("invalid module: %v", e.Reason)
+}
+
+func (e *InvalidModuleError) Unwrap() error {
+	return e.Reason
+}
+
+// Metadata describes one version of a function. Version is 0 for modules that were
+// copied into the functions directory by hand and never uploaded through the registry.
+type Metadata struct {
+	Name      string                       `json:"name"`
+	Version   int                          `json:"version"`
+	Size      int64                        `json:"size"`
+	SHA256    string                       `json:"sha256"`
+	Kind      module_compiler.ArtifactKind `json:"kind"`
+	Imports   []wasm_binary.Import         `json:"imports"`
+	Exports   []wasm_binary.Export         `json:"exports"`
+	CreatedAt time.Time                    `json:"created_at"`
+	// Runtime is empty when the module runs on the pod's default runtime
+	Runtime       string `json:"runtime,omitempty"`
+	RuntimeSource string `json:"runtime_source,omitempty"`
+	// Signature is only reported when signatures are verified
+	Signature *signature.Result `json:"signature,omitempty"`
+	// Admission is only reported by uploads
+	Admission *admission.Report `json:"admission,omitempty"`
+}
+
+type Function struct {
+	Name          string                   `json:"name"`
+	Aliases       map[string]*Alias        `json:"aliases"`
+	Versions      []Metadata               `json:"versions"`
+	Manifest      *config.FunctionManifest `json:"manifest,omitempty"`
+	ManifestError string                   `json:"manifest_error,omitempty"`
+}
+
+// Resolved is the module a function reference points to at the time it was resolved.
+type Resolved struct {
+	Name    string
+	Version int
+	Path    string
+}
+
+// Ref returns a reference that keeps pointing to this exact version.
+func (r Resolved) Ref() string {
+	if r.Version == 0 {
+		return r.Name
+	}
+	return r.Name + "@" + strconv.Itoa(r.Version)
+}
+
+// FunctionRegistry owns the functions directory. Uploaded modules are stored as immutable,
+// numbered versions in .versions/<name>/, next to an aliases file. Modules copied into the
+// functions directory by hand keep working until a new version of them is uploaded, and
+// so do modules downloaded from the module source.
+type FunctionRegistry struct {
+	Config         *config.FunctionRegistryConfig
+	ModuleCompiler *module_compiler.ModuleCompiler
+	// SignatureVerifier is optional, without it signatures are neither checked nor stored
+	SignatureVerifier *signature.SignatureVerifier
+	// ModuleSource is optional, it serves functions that were neither uploaded nor copied by hand
+	ModuleSource *module_source.ModuleSource
+	// Admission is optional, without it uploads are only validated
+	Admission *admission.Checker
+	// DataVolume is optional, without it manifests declaring data mounts are invalid
+	DataVolume  *data_volume.DataVolume
+	stats       statsRecorder
+	runtimes    map[string]detectedRuntime
+	runtimesMu  sync.Mutex
+	manifests   map[string]loadedManifest
+	manifestsMu sync.Mutex
+	gates       map[string]*invocationGate
+	gatesMu     sync.Mutex
+}
+
+func (fr *FunctionRegistry) Init() error {
+	fr.runtimes = make(map[string]detectedRuntime)
+	fr.manifests = make(map[string]loadedManifest)
+	fr.gates = make(map[string]*invocationGate)
+	return os.MkdirAll(filepath.Join(fr.Config.FunctionsDir, versionsDir), os.ModePerm)
+}
+
+func validName(name string) error {
+	if name == "" || name != filepath.Base(name) || name[0] == '.' || strings.Contains(name, "@") || strings.HasSuffix(name, snapshot.FileSuffix) || strings.HasSuffix(name, signature.FileSuffix) {
+		return fmt.Errorf("%w %q", ErrInvalidName, name)
+	}
+	for _, suffix := range manifestSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return fmt.Errorf("%w %q", ErrInvalidName, name)
+		}
+	}
+	return nil
+}
+
+// legacyPath is where hand-copied modules live.
+func (fr *FunctionRegistry) legacyPath(name string) string {
+	return filepath.Join(fr.Config.FunctionsDir, name)
+}
+
+func (fr *FunctionRegistry) versionsDir(name string) string {
+	return filepath.Join(fr.Config.FunctionsDir, versionsDir, name)
+}
+
+func (fr *FunctionRegistry) versionPath(name string, version int) string {
+	return filepath.Join(fr.versionsDir(name), strconv.Itoa(version))
+}
+
+func isRegularFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// versions returns the stored versions of a function in ascending order.
+func (fr *FunctionRegistry) versions(name string) ([]int, error) {
+	entries, err := os.ReadDir(fr.versionsDir(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var versions []int
+	for _, entry := range entries {
+		if version, err := strconv.Atoi(entry.Name()); err == nil && entry.Type().IsRegular() {
+			versions = append(versions, version)
+		}
+	}
+
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// lock serializes changes to a function across all pods sharing the functions directory.
+func (fr *FunctionRegistry) lock(name string) (*os.File, error) {
+	if err := os.MkdirAll(fr.versionsDir(name), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return utils.LockFile(filepath.Join(fr.versionsDir(name), lockFile))
+}
+
+// Resolve finds the module a reference points to. A reference is a function name,
+// optionally followed by "@" and a version number or an alias. A bare name resolves
+// through the latest alias, or to the hand-copied module if there is no uploaded version,
+// and so does "name@latest".
+func (fr *FunctionRegistry) Resolve(ref string) (Resolved, error) {
+	return fr.ResolveRequest(ref, nil)
+}
+
+// ResolveRequest is Resolve for a request whose headers can be looked up with header, so
+// that aliases splitting their traffic pick versions consistently for a sticky header.
+func (fr *FunctionRegistry) ResolveRequest(ref string, header func(name string) string) (Resolved, error) {
+	name, selector, hasSelector := strings.Cut(ref, "@")
+	if err := validName(name); err != nil {
+		return Resolved{}, err
+	}
+
+	if version, err := strconv.Atoi(selector); hasSelector && err == nil {
+		if !isRegularFile(fr.versionPath(name, version)) {
+			return Resolved{}, fmt.Errorf("%w: %s", ErrNotFound, ref)
+		}
+		return Resolved{Name: name, Version: version, Path: fr.versionPath(name, version)}, nil
+	}
+
+	if !hasSelector {
+		selector = LatestAlias
+	}
+	latest := selector == LatestAlias
+
+	aliases, err := fr.readAliases(name)
+	if err != nil {
+		return Resolved{}, err
+	}
+	if alias, ok := aliases[selector]; ok {
+		key := ""
+		if alias.StickyHeader != "" && header != nil {
+			key = header(alias.StickyHeader)
+		}
+
+		version := alias.pick(key)
+		return Resolved{Name: name, Version: version, Path: fr.versionPath(name, version)}, nil
+	}
+
+	// Hand-copied and downloaded modules have no aliases, latest is the module itself
+	if latest && isRegularFile(fr.legacyPath(name)) {
+		return Resolved{Name: name, Path: fr.legacyPath(name)}, nil
+	}
+
+	if latest {
+		return fr.fetch(name)
+	}
+
+	return Resolved{}, fmt.Errorf("%w: %s", ErrNotFound, ref)
+}
+
+// fetch resolves a function that only exists in the module source, downloading it if needed.
+func (fr *FunctionRegistry) fetch(name string) (Resolved, error) {
+	if fr.ModuleSource == nil {
+		return Resolved{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+
+	path, err := fr.ModuleSource.Fetch(name)
+	if errors.Is(err, module_source.ErrNotFound) {
+		return Resolved{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	} else if err != nil {
+		return Resolved{}, err
+	}
+
+	return Resolved{Name: name, Path: path}, nil
+}
+
+func (fr *FunctionRegistry) describe(resolved Resolved) (Metadata, error) {
+	info, err := os.Stat(resolved.Path)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	hash, err := snapshot.ModuleHash(resolved.Path)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	kind, err := module_compiler.DetectKind(resolved.Path)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	imports, exports, err := fr.ModuleCompiler.Interface(resolved.Path)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	runtime, source, err := fr.Runtime(resolved)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if runtime == "" {
+		source = ""
+	}
+
+	var verified *signature.Result
+	if fr.SignatureVerifier != nil {
+		result := fr.SignatureVerifier.Verify(resolved.Path)
+		verified = &result
+	}
+
+	return Metadata{
+		Name:          resolved.Name,
+		Version:       resolved.Version,
+		Size:          info.Size(),
+		SHA256:        hash,
+		Kind:          kind,
+		Imports:       imports,
+		Exports:       exports,
+		CreatedAt:     info.ModTime(),
+		Runtime:       runtime,
+		RuntimeSource: source,
+		Signature:     verified,
+	}, nil
+}
+
+// GetVersion describes the version a reference currently points to.
+func (fr *FunctionRegistry) GetVersion(ref string) (Metadata, error) {
+	resolved, err := fr.Resolve(ref)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return fr.describe(resolved)
+}
+
+// Inspect decodes the module a reference currently points to.
+func (fr *FunctionRegistry) Inspect(ref string) (module_compiler.Inspection, error) {
+	resolved, err := fr.Resolve(ref)
+	if err != nil {
+		return module_compiler.Inspection{}, err
+	}
+
+	return fr.ModuleCompiler.Inspect(resolved.Path)
+}
+
+// Get describes a function with all its versions and aliases.
+func (fr *FunctionRegistry) Get(name string) (Function, error) {
+	if err := validName(name); err != nil {
+		return Function{}, err
+	}
+
+	versions, err := fr.versions(name)
+	if err != nil {
+		return Function{}, err
+	}
+
+	aliases, err := fr.readAliases(name)
+	if err != nil {
+		return Function{}, err
+	}
+
+	function := Function{Name: name, Aliases: aliases, Versions: []Metadata{}}
+	resolved := make([]Resolved, 0, len(versions))
+	for _, version := range versions {
+		resolved = append(resolved, Resolved{Name: name, Version: version, Path: fr.versionPath(name, version)})
+	}
+	if len(versions) == 0 && isRegularFile(fr.legacyPath(name)) {
+		resolved = append(resolved, Resolved{Name: name, Path: fr.legacyPath(name)})
+	}
+	if len(resolved) == 0 {
+		r, err := fr.fetch(name)
+		if err != nil {
+			return Function{}, err
+		}
+		resolved = append(resolved, r)
+	}
+
+	for _, r := range resolved {
+		metadata, err := fr.describe(r)
+		if err != nil {
+			return Function{}, err
+		}
+		function.Versions = append(function.Versions, metadata)
+	}
+
+	if fr.manifestPath(name) != "" {
+		if manifest, err := fr.Manifest(name); err != nil {
+			function.ManifestError = err.Error()
+		} else {
+			function.Manifest = &manifest
+		}
+	}
+
+	return function, nil
+}
+
+// names returns the names of all uploaded and hand-copied functions.
+func (fr *FunctionRegistry) names() ([]string, error) {
+	unique := make(map[string]bool)
+
+	for _, dir := range []string{fr.Config.FunctionsDir, filepath.Join(fr.Config.FunctionsDir, versionsDir)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		versioned := dir != fr.Config.FunctionsDir
+		for _, entry := range entries {
+			if validName(entry.Name()) == nil && entry.IsDir() == versioned && (versioned || entry.Type().IsRegular()) {
+				unique[entry.Name()] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (fr *FunctionRegistry) List() ([]Function, error) {
+	names, err := fr.names()
+	if err != nil {
+		return nil, err
+	}
+
+	functions := []Function{}
+	for _, name := range names {
+		function, err := fr.Get(name)
+		if err != nil {
+			slog.Debug("Skipping unreadable function", "name", name, "reason", err)
+			continue
+		}
+		functions = append(functions, function)
+	}
+
+	return functions, nil
+}
+
+// Put validates a module and stores it as the next version of the function called name,
+// then points the latest alias to it. The version runs on runtime when it is not empty,
+// and on the runtime detected from the module otherwise. moduleSignature is the base64
+// encoded signature of the module, or "" if it is unsigned.
+func (fr *FunctionRegistry) Put(name string, module io.Reader, runtime, moduleSignature string) (Metadata, error) {
+	if err := validName(name); err != nil {
+		return Metadata{}, err
+	}
+
+	tmpFile, err := os.CreateTemp(fr.Config.FunctionsDir, ".upload-*")
+	if err != nil {
+		return Metadata{}, err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	maxSize := int64(fr.Config.MaxModuleSizeMB) * 1024 * 1024
+	written, err := io.Copy(tmpFile, io.LimitReader(module, maxSize+1))
+	tmpFile.Close()
+	if err != nil {
+		return Metadata{}, err
+	}
+	if written > maxSize {
+		return Metadata{}, ErrTooLarge
+	}
+
+	if _, err := fr.ModuleCompiler.Validate(tmpPath); err != nil {
+		return Metadata{}, &InvalidModuleError{Reason: err}
+	}
+	if err := declareRuntime(tmpPath, runtime); err != nil {
+		return Metadata{}, err
+	}
+	report, err := fr.admit(name, tmpPath, runtime)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if fr.SignatureVerifier != nil {
+		if _, err := fr.SignatureVerifier.Admit(tmpPath, []byte(moduleSignature)); err != nil {
+			return Metadata{}, err
+		}
+	}
+
+	lock, err := fr.lock(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer utils.UnlockFile(lock)
+
+	versions, err := fr.versions(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	aliases, err := fr.readAliases(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	// A hand-copied module becomes version 1, so it can still be rolled back to
+	migrated := len(versions) == 0 && isRegularFile(fr.legacyPath(name))
+	if migrated {
+		if isRegularFile(signature.Path(fr.legacyPath(name))) {
+			if err := os.Link(signature.Path(fr.legacyPath(name)), signature.Path(fr.versionPath(name, 1))); err != nil {
+				return Metadata{}, err
+			}
+		}
+		if err := os.Link(fr.legacyPath(name), fr.versionPath(name, 1)); err != nil {
+			return Metadata{}, err
+		}
+		versions = append(versions, 1)
+		setAlias(aliases, LatestAlias, 1)
+	}
+
+	version := 1
+	if len(versions) > 0 {
+		version = versions[len(versions)-1] + 1
+	}
+
+	// Declared before the version exists, so it never runs on a detected runtime
+	if runtime != "" {
+		if err := os.WriteFile(runtimePath(fr.versionPath(name, version)), []byte(runtime+"\n"), 0644); err != nil {
+			return Metadata{}, err
+		}
+	}
+	// Stored before the version exists too, so that it is never seen unsigned
+	if moduleSignature != "" && fr.SignatureVerifier != nil {
+		if err := os.WriteFile(signature.Path(fr.versionPath(name, version)), []byte(strings.TrimSpace(moduleSignature)+"\n"), 0644); err != nil {
+			return Metadata{}, err
+		}
+	}
+
+	// Linking never replaces an existing file, which keeps versions immutable
+	if err := os.Link(tmpPath, fr.versionPath(name, version)); err != nil {
+		return Metadata{}, err
+	}
+
+	setAlias(aliases, LatestAlias, version)
+	if err := fr.writeAliases(name, aliases); err != nil {
+		return Metadata{}, err
+	}
+
+	// Version 1 shares the module and its compiled artifacts, only the path changes
+	if migrated {
+		if err := os.Remove(fr.legacyPath(name)); err != nil {
+			slog.Error("Failed to remove migrated module", "name", name, "reason", err)
+		}
+		fr.removeSnapshot(fr.legacyPath(name))
+		fr.removeSignature(fr.legacyPath(name))
+	}
+
+	resolved := Resolved{Name: name, Version: version, Path: fr.versionPath(name, version)}
+	metadata, err := fr.describe(resolved)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	metadata.Admission = report
+	slog.Info("Stored function", "name", name, "version", version, "sha256", metadata.SHA256, "size", metadata.Size)
+
+	if fr.ModuleCompiler.Config.PrecompileFunctions {
+		go fr.compile(resolved)
+	}
+
+	return metadata, nil
+}
+
+// admit runs the admission checks against an uploaded module, with the function's manifest
+// and the runtime the module will run on.
+func (fr *FunctionRegistry) admit(name, modulePath, runtime string) (*admission.Report, error) {
+	if fr.Admission == nil || !fr.Admission.Enabled() {
+		return nil, nil
+	}
+
+	// An invalid manifest fails invocations whatever the module, so it is checked without one
+	manifest, err := fr.Manifest(name)
+	if err != nil {
+		manifest = config.FunctionManifest{}
+	}
+
+	if runtime == "" {
+		runtime = manifest.Runtime
+	}
+	if runtime == "" {
+		if runtime, err = module_compiler.DetectRuntime(modulePath); err != nil {
+			return nil, &InvalidModuleError{Reason: err}
+		}
+	}
+
+	report, err := fr.Admission.Check(modulePath, runtime, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Delete removes a single version when ref names one, or the whole function otherwise.
+// Versions still referenced by an alias can not be deleted.
+func (fr *FunctionRegistry) Delete(ref string) error {
+	name, selector, hasSelector := strings.Cut(ref, "@")
+	if err := validName(name); err != nil {
+		return err
+	}
+
+	lock, err := fr.lock(name)
+	if err != nil {
+		return err
+	}
+	defer utils.UnlockFile(lock)
+
+	if hasSelector {
+		return fr.deleteVersion(name, selector)
+	}
+
+	versions, err := fr.versions(name)
+	if err != nil {
+		return err
+	}
+
+	paths := []string{fr.legacyPath(name)}
+	for _, version := range versions {
+		paths = append(paths, fr.versionPath(name, version))
+	}
+
+	found := false
+	for _, path := range paths {
+		if isRegularFile(path) {
+			found = true
+			fr.remove(path)
+		}
+	}
+	if !found {
+		fr.clearVersionsDir(name)
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+
+	slog.Info("Deleted function", "name", name)
+	return fr.clearVersionsDir(name)
+}
+
+// clearVersionsDir removes everything stored for a function but its lock file, which
+// other pods may be waiting on. Removing it would let the next pod lock a new file while
+// the old one is still held.
+func (fr *FunctionRegistry) clearVersionsDir(name string) error {
+	entries, err := os.ReadDir(fr.versionsDir(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == lockFile {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(fr.versionsDir(name), entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fr *FunctionRegistry) deleteVersion(name, selector string) error {
+	version, err := strconv.Atoi(selector)
+	if err != nil {
+		return fmt.Errorf("%w: only versions can be deleted, not aliases", ErrInvalidAlias)
+	}
+
+	path := fr.versionPath(name, version)
+	if !isRegularFile(path) {
+		return fmt.Errorf("%w: %s@%d", ErrNotFound, name, version)
+	}
+
+	aliases, err := fr.readAliases(name)
+	if err != nil {
+		return err
+	}
+	for aliasName, alias := range aliases {
+		if alias.references(version) {
+			return fmt.Errorf("%w %s", ErrVersionInUse, aliasName)
+		}
+	}
+
+	// Rolling back must not land on a deleted version
+	for _, alias := range aliases {
+		alias.History = without(alias.History, version)
+	}
+	if err := fr.writeAliases(name, aliases); err != nil {
+		return err
+	}
+
+	fr.remove(path)
+	slog.Info("Deleted function version", "name", name, "version", version)
+	return nil
+}
+
+// remove deletes a module along with everything derived from it.
+func (fr *FunctionRegistry) remove(path string) {
+	hash, hashErr := snapshot.ModuleHash(path)
+
+	if err := os.Remove(path); err != nil {
+		slog.Error("Failed to remove module", "module", path, "reason", err)
+	}
+	fr.removeSnapshot(path)
+
+	if err := os.Remove(runtimePath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to remove declared runtime", "module", path, "reason", err)
+	}
+	fr.runtimesMu.Lock()
+	delete(fr.runtimes, path)
+	fr.runtimesMu.Unlock()
+
+	fr.removeSignature(path)
+
+	if hashErr == nil {
+		fr.evict(hash)
+	}
+}
+
+// evict removes the compiled artifacts of a module that was removed or replaced, unless
+// another module with the same content still uses them.
+func (fr *FunctionRegistry) evict(hash string) {
+	paths, err := fr.modulePaths()
+	if err != nil {
+		slog.Error("Failed to list modules, keeping compiled artifacts", "sha256", hash, "reason", err)
+		return
+	}
+
+	for _, path := range paths {
+		if other, err := snapshot.ModuleHash(path); err == nil && other == hash {
+			slog.Debug("Keeping compiled artifacts of a module with the same content", "module", path)
+			return
+		}
+	}
+
+	fr.ModuleCompiler.Evict(hash)
+}
+
+// modulePaths returns the paths of every module the registry serves: the hand-copied
+// ones, every uploaded version and the modules cached from the module source.
+func (fr *FunctionRegistry) modulePaths() ([]string, error) {
+	names, err := fr.names()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, name := range names {
+		if path := fr.legacyPath(name); isRegularFile(path) {
+			paths = append(paths, path)
+		}
+
+		versions, err := fr.versions(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			paths = append(paths, fr.versionPath(name, version))
+		}
+	}
+
+	if fr.ModuleSource != nil {
+		paths = append(paths, fr.ModuleSource.Paths()...)
+	}
+
+	return paths, nil
+}
+
+func (fr *FunctionRegistry) removeSnapshot(path string) {
+	if err := os.Remove(snapshot.Path(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to remove snapshot", "module", path, "reason", err)
+	}
+}
+
+func (fr *FunctionRegistry) removeSignature(path string) {
+	if err := os.Remove(signature.Path(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to remove signature", "module", path, "reason", err)
+	}
+	if fr.SignatureVerifier != nil {
+		fr.SignatureVerifier.Forget(path)
+	}
+}
+
+func (fr *FunctionRegistry) compile(resolved Resolved) {
+	if err := fr.ModuleCompiler.CompileAll(resolved.Path); err != nil {
+		slog.Error("Failed to compile module", "module", resolved.Ref(), "reason", err)
+	}
+}
+
+// CompileAll compiles the versions that are currently reachable through an alias, and
+// hand-copied modules, so that their first invocations do not have to.
+func (fr *FunctionRegistry) CompileAll() {
+	names, err := fr.names()
+	if err != nil {
+		slog.Error("Failed to list functions", "reason", err)
+		return
+	}
+
+	for _, name := range names {
+		reachable := make(map[Resolved]bool)
+		if resolved, err := fr.Resolve(name); err == nil {
+			reachable[resolved] = true
+		}
+
+		aliases, _ := fr.readAliases(name)
+		for _, alias := range aliases {
+			reachable[Resolved{Name: name, Version: alias.Version, Path: fr.versionPath(name, alias.Version)}] = true
+			for _, split := range alias.Split {
+				reachable[Resolved{Name: name, Version: split.Version, Path: fr.versionPath(name, split.Version)}] = true
+			}
+		}
+
+		for resolved := range reachable {
+			fr.compile(resolved)
+		}
+	}
+}
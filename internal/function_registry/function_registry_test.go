@@ -0,0 +1,145 @@
+package function_registry
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"webserver/internal/config"
+	"webserver/internal/module_compiler"
+	"webserver/internal/wasm_binary"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+)
+
+func newTestRegistry(t *testing.T) *FunctionRegistry {
+	t.Helper()
+	fr := &FunctionRegistry{
+		Config:         &config.FunctionRegistryConfig{FunctionsDir: t.TempDir(), MaxModuleSizeMB: 1},
+		ModuleCompiler: &module_compiler.ModuleCompiler{},
+	}
+	if err := fr.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return fr
+}
+
+func TestResolveLatestFallsBackToHandCopiedModule(t *testing.T) {
+	fr := newTestRegistry(t)
+	if err := os.WriteFile(fr.legacyPath("hello.wasm"), []byte("\x00asm"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range []string{"hello.wasm", "hello.wasm@latest"} {
+		resolved, err := fr.Resolve(ref)
+		if err != nil {
+			t.Fatalf("%s: %v", ref, err)
+		}
+		if resolved.Path != fr.legacyPath("hello.wasm") || resolved.Version != 0 {
+			t.Fatalf("%s resolved to %+v", ref, resolved)
+		}
+	}
+
+	if _, err := fr.Resolve("hello.wasm@stable"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+func TestResolveLatestPrefersAlias(t *testing.T) {
+	fr := newTestRegistry(t)
+	if err := os.WriteFile(fr.legacyPath("hello.wasm"), []byte("\x00asm"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(fr.versionsDir("hello.wasm"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fr.versionPath("hello.wasm", 1), []byte("\x00asm"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fr.writeAliases("hello.wasm", map[string]*Alias{LatestAlias: {Version: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := fr.Resolve("hello.wasm@latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Version != 1 {
+		t.Fatalf("resolved to %+v", resolved)
+	}
+}
+
+func TestDeleteKeepsLockFile(t *testing.T) {
+	fr := newTestRegistry(t)
+	if err := os.MkdirAll(fr.versionsDir("hello.wasm"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fr.versionPath("hello.wasm", 1), []byte("\x00asm"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fr.Delete("hello.wasm"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(fr.versionsDir("hello.wasm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != lockFile {
+		t.Fatalf("versions directory holds %v, want only %s", entries, lockFile)
+	}
+
+	if _, err := fr.Resolve("hello.wasm"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	if err := fr.Delete("hello.wasm"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	if _, err := os.Stat(filepath.Join(fr.versionsDir("hello.wasm"), lockFile)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteKeepsArtifactsOfIdenticalModules(t *testing.T) {
+	fr := newTestRegistry(t)
+	fr.ModuleCompiler = &module_compiler.ModuleCompiler{
+		Config: &config.ModuleCompilerConfig{ArtifactCacheDir: t.TempDir()},
+		NewWasmtimeEngine: func(epochInterruption bool) *wasmtime.Engine {
+			engineConfig := wasmtime.NewConfig()
+			engineConfig.SetEpochInterruption(epochInterruption)
+			return wasmtime.NewEngineWithConfig(engineConfig)
+		},
+	}
+	if err := fr.ModuleCompiler.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	module := append(append([]byte{}, wasm_binary.Magic...), wasm_binary.Version...)
+	for _, name := range []string{"a.wasm", "b.wasm"} {
+		if err := os.WriteFile(fr.legacyPath(name), module, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	artifact, err := fr.ModuleCompiler.Artifact(fr.legacyPath("a.wasm"), module_compiler.RuntimeWasmtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fr.Delete("a.wasm"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(artifact); err != nil {
+		t.Fatalf("artifact shared with b.wasm was evicted: %v", err)
+	}
+
+	if err := fr.Delete("b.wasm"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(artifact); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("artifact was not evicted: %v", err)
+	}
+	if _, err := os.Stat(artifact + ".lock"); err != nil {
+		t.Fatalf("lock file was evicted: %v", err)
+	}
+}
@@ -0,0 +1,447 @@
+package function_registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"webserver/internal/capabilities"
+	"webserver/internal/config"
+	"webserver/internal/data_volume"
+	"webserver/internal/module_compiler"
+	"webserver/internal/scratch"
+	"webserver/internal/secrets"
+	"webserver/internal/utils"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+const (
+	manifestFile    = "manifest.json"
+	maxManifestSize = 1024 * 1024
+)
+
+// manifestSuffixes are appended to the name of a hand-copied module to find its manifest.
+var manifestSuffixes = []string{".manifest.yaml", ".manifest.yml", ".manifest.json"}
+
+// Limits are the resources of one invocation. CPU is in millicores and memory in MB,
+// a zero timeout lets the invocation run until it finishes.
+type Limits struct {
+	CPU     string
+	Memory  string
+	Timeout time.Duration
+}
+
+// loadedManifest caches a manifest, or the reason it is invalid, as long as the file is unchanged.
+type loadedManifest struct {
+	modTime  time.Time
+	size     int64
+	manifest config.FunctionManifest
+	err      error
+}
+
+func (fr *FunctionRegistry) registryManifestPath(name string) string {
+	return filepath.Join(fr.versionsDir(name), manifestFile)
+}
+
+// manifestPath returns the manifest that applies to every version of a function: the one
+// stored in the registry, or else the one next to the hand-copied module. It is "" if none exists.
+func (fr *FunctionRegistry) manifestPath(name string) string {
+	candidates := []string{fr.registryManifestPath(name)}
+	for _, suffix := range manifestSuffixes {
+		candidates = append(candidates, fr.legacyPath(name)+suffix)
+	}
+
+	for _, candidate := range candidates {
+		if isRegularFile(candidate) {
+			return candidate
+		}
+	}
+
+	return ""
+}
+
+// Manifest returns the manifest of a function, or an empty one if it has none. Manifests
+// are only read and validated again after their file changed.
+func (fr *FunctionRegistry) Manifest(name string) (config.FunctionManifest, error) {
+	if err := validName(name); err != nil {
+		return config.FunctionManifest{}, err
+	}
+
+	path := fr.manifestPath(name)
+	if path == "" {
+		return config.FunctionManifest{}, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return config.FunctionManifest{}, err
+	}
+
+	fr.manifestsMu.Lock()
+	cached, ok := fr.manifests[path]
+	fr.manifestsMu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.manifest, cached.err
+	}
+
+	manifest, err := fr.readManifest(path)
+	if err != nil {
+		slog.Error("Invalid function manifest", "manifest", path, "reason", err)
+	} else {
+		slog.Info("Loaded function manifest", "name", name, "manifest", path)
+	}
+
+	fr.manifestsMu.Lock()
+	fr.manifests[path] = loadedManifest{modTime: info.ModTime(), size: info.Size(), manifest: manifest, err: err}
+	fr.manifestsMu.Unlock()
+
+	return manifest, err
+}
+
+// SetManifest validates the YAML or JSON manifest read from reader and stores it in the
+// registry, where it takes precedence over a manifest next to the hand-copied module.
+func (fr *FunctionRegistry) SetManifest(name string, reader io.Reader) (config.FunctionManifest, error) {
+	if err := validName(name); err != nil {
+		return config.FunctionManifest{}, err
+	}
+	if _, err := fr.Resolve(name); err != nil {
+		return config.FunctionManifest{}, err
+	}
+
+	lock, err := fr.lock(name)
+	if err != nil {
+		return config.FunctionManifest{}, err
+	}
+	defer utils.UnlockFile(lock)
+
+	// YAML is a superset of JSON, so both are read by the YAML parser
+	tmpFile, err := os.CreateTemp(fr.versionsDir(name), ".upload-*.yaml")
+	if err != nil {
+		return config.FunctionManifest{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	written, err := io.Copy(tmpFile, io.LimitReader(reader, maxManifestSize+1))
+	tmpFile.Close()
+	if err != nil {
+		return config.FunctionManifest{}, err
+	}
+	if written > maxManifestSize {
+		return config.FunctionManifest{}, fmt.Errorf("%w: larger than %d bytes", ErrInvalidManifest, maxManifestSize)
+	}
+
+	manifest, err := fr.readManifest(tmpFile.Name())
+	if err != nil {
+		return config.FunctionManifest{}, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return config.FunctionManifest{}, err
+	}
+
+	tmpManifest, err := os.CreateTemp(fr.versionsDir(name), ".tmp-"+manifestFile)
+	if err != nil {
+		return config.FunctionManifest{}, err
+	}
+	defer os.Remove(tmpManifest.Name())
+
+	_, err = tmpManifest.Write(data)
+	tmpManifest.Close()
+	if err != nil {
+		return config.FunctionManifest{}, err
+	}
+
+	if err := os.Rename(tmpManifest.Name(), fr.registryManifestPath(name)); err != nil {
+		return config.FunctionManifest{}, err
+	}
+
+	slog.Info("Stored function manifest", "name", name)
+	return manifest, nil
+}
+
+// DeleteManifest removes the manifest stored in the registry. Manifests next to
+// hand-copied modules are left alone.
+func (fr *FunctionRegistry) DeleteManifest(name string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+
+	lock, err := fr.lock(name)
+	if err != nil {
+		return err
+	}
+	defer utils.UnlockFile(lock)
+
+	err = os.Remove(fr.registryManifestPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s has no manifest in the registry", ErrNotFound, name)
+	}
+	return err
+}
+
+func (fr *FunctionRegistry) readManifest(path string) (config.FunctionManifest, error) {
+	var manifest config.FunctionManifest
+	if err := cleanenv.ReadConfig(path, &manifest); err != nil {
+		return config.FunctionManifest{}, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+
+	if err := validateManifest(manifest); err != nil {
+		return config.FunctionManifest{}, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+
+	if err := fr.checkDataMounts(manifest); err != nil {
+		return config.FunctionManifest{}, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+
+	return manifest, nil
+}
+
+// checkDataMounts makes sure the data mounts of a manifest are directories of the data
+// volume without symlinks leading out of them.
+func (fr *FunctionRegistry) checkDataMounts(manifest config.FunctionManifest) error {
+	for _, mount := range manifest.WASI.Data {
+		if fr.DataVolume == nil {
+			return data_volume.ErrDisabled
+		}
+		if err := fr.DataVolume.Check(mount.Source); err != nil {
+			return fmt.Errorf("data mount %s: %v", mount.Source, err)
+		}
+	}
+	return nil
+}
+
+// DataMounts resolves the data mounts of a manifest to the directories to preopen. They
+// are resolved again for every invocation, in case the data volume changed since the
+// manifest was loaded.
+func (fr *FunctionRegistry) DataMounts(manifest config.FunctionManifest) ([]config.PreopenManifest, error) {
+	preopens := make([]config.PreopenManifest, 0, len(manifest.WASI.Data))
+	for _, mount := range manifest.WASI.Data {
+		if fr.DataVolume == nil {
+			return nil, data_volume.ErrDisabled
+		}
+		hostPath, err := fr.DataVolume.Resolve(mount.Source)
+		if err != nil {
+			return nil, fmt.Errorf("data mount %s: %w", mount.Source, err)
+		}
+		preopens = append(preopens, config.PreopenManifest{HostPath: hostPath, GuestPath: mount.GuestPath})
+	}
+	return preopens, nil
+}
+
+func validateManifest(manifest config.FunctionManifest) error {
+	for _, resource := range []struct {
+		name     string
+		manifest config.ResourceManifest
+		parse    func(string) (int, error)
+	}{{"cpu", manifest.CPU, utils.ParseCPU}, {"memory", manifest.Memory, utils.ParseMemory}} {
+		defaultValue, err := parseOptional(resource.manifest.Default, resource.parse)
+		if err != nil {
+			return fmt.Errorf("%s default: %v", resource.name, err)
+		}
+		maxValue, err := parseOptional(resource.manifest.Max, resource.parse)
+		if err != nil {
+			return fmt.Errorf("%s max: %v", resource.name, err)
+		}
+		if maxValue > 0 && defaultValue > maxValue {
+			return fmt.Errorf("%s default %s is above max %s", resource.name, resource.manifest.Default, resource.manifest.Max)
+		}
+	}
+
+	defaultTimeout, err := parseTimeout(manifest.Timeout.Default)
+	if err != nil {
+		return fmt.Errorf("timeout default: %v", err)
+	}
+	maxTimeout, err := parseTimeout(manifest.Timeout.Max)
+	if err != nil {
+		return fmt.Errorf("timeout max: %v", err)
+	}
+	if maxTimeout > 0 && defaultTimeout > maxTimeout {
+		return fmt.Errorf("timeout default %s is above max %s", defaultTimeout, maxTimeout)
+	}
+
+	if manifest.Runtime != "" && !module_compiler.ValidRuntime(manifest.Runtime) {
+		return fmt.Errorf("runtime %q, expected %s or %s", manifest.Runtime, module_compiler.RuntimeWasmtime, module_compiler.RuntimeWasmedge)
+	}
+
+	if err := capabilities.Validate(manifest.Capabilities); err != nil {
+		return err
+	}
+
+	for key := range manifest.WASI.Env {
+		if err := validEnvName(key); err != nil {
+			return err
+		}
+	}
+
+	secretNames, secretEnvs := make(map[string]bool), make(map[string]string)
+	for _, secret := range manifest.Secrets {
+		if err := secrets.ValidName(secret.Name); err != nil {
+			return err
+		}
+		if secretNames[secret.Name] {
+			return fmt.Errorf("secret %s is declared twice", secret.Name)
+		}
+		secretNames[secret.Name] = true
+
+		if secret.Env == "" {
+			continue
+		}
+		if err := validEnvName(secret.Env); err != nil {
+			return err
+		}
+		if _, ok := manifest.WASI.Env[secret.Env]; ok {
+			return fmt.Errorf("environment variable %s of secret %s is also set by wasi.env", secret.Env, secret.Name)
+		}
+		if other, ok := secretEnvs[secret.Env]; ok {
+			return fmt.Errorf("secrets %s and %s are both in environment variable %s", other, secret.Name, secret.Env)
+		}
+		secretEnvs[secret.Env] = secret.Name
+	}
+
+	// Manifests can be uploaded by anyone with access to the admin API, host paths would
+	// let them hand any directory of the server to a guest
+	if len(manifest.WASI.Preopens) > 0 {
+		return errors.New("preopens of host paths are not allowed, use data mounts or the scratch directory")
+	}
+
+	// Every preopened directory needs its own guest path
+	guestPaths := make(map[string]string)
+	if manifest.WASI.Scratch.Enabled {
+		guestPaths[scratch.GuestPath] = "the scratch directory"
+	}
+	claim := func(guestPath, owner string) error {
+		if other, ok := guestPaths[filepath.Clean(guestPath)]; ok {
+			return fmt.Errorf("%s is on %s, like %s", owner, guestPath, other)
+		}
+		guestPaths[filepath.Clean(guestPath)] = owner
+		return nil
+	}
+
+	for _, mount := range manifest.WASI.Data {
+		if !filepath.IsLocal(mount.Source) {
+			return fmt.Errorf("data mount source %q is not a relative path inside the data volume", mount.Source)
+		}
+		if mount.GuestPath == "" {
+			return fmt.Errorf("data mount of %s has no guest path", mount.Source)
+		}
+		if err := claim(mount.GuestPath, "data mount of "+mount.Source); err != nil {
+			return err
+		}
+	}
+
+	if _, err := parseOptional(manifest.WASI.Scratch.Quota, utils.ParseMemory); err != nil {
+		return fmt.Errorf("scratch quota: %v", err)
+	}
+
+	for _, contentType := range append([]string{manifest.ContentTypes.Response}, manifest.ContentTypes.Request...) {
+		if contentType == "" {
+			continue
+		}
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return fmt.Errorf("content type %q: %v", contentType, err)
+		}
+	}
+
+	return nil
+}
+
+func validEnvName(name string) error {
+	if name == "" || strings.Contains(name, "=") {
+		return fmt.Errorf("invalid environment variable name %q", name)
+	}
+	return nil
+}
+
+// parseOptional parses a manifest quantity, where "" means unset.
+func parseOptional(value string, parse func(string) (int, error)) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return parse(value)
+}
+
+// parseLimit parses a limit in millicores or MB.
+func parseLimit(value string) (int, error) {
+	quantity, err := strconv.Atoi(value)
+	if err != nil || quantity <= 0 {
+		return 0, fmt.Errorf("%q is not a positive integer", value)
+	}
+	return quantity, nil
+}
+
+func parseTimeout(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("%q is not a positive duration", value)
+	}
+	return timeout, nil
+}
+
+// EffectiveLimits completes the requested limits with the manifest defaults, then with
+// defaults, and caps them at the manifest maximums. Requests can lower the limits
+// but never raise them above what the function declares.
+func EffectiveLimits(manifest config.FunctionManifest, requested, defaults Limits) (Limits, error) {
+	cpu, err := effectiveQuantity(manifest.CPU, utils.ParseCPU, requested.CPU, defaults.CPU)
+	if err != nil {
+		return Limits{}, fmt.Errorf("%w: cpu %v", ErrInvalidLimit, err)
+	}
+
+	memory, err := effectiveQuantity(manifest.Memory, utils.ParseMemory, requested.Memory, defaults.Memory)
+	if err != nil {
+		return Limits{}, fmt.Errorf("%w: memory %v", ErrInvalidLimit, err)
+	}
+
+	// Manifests are validated when they are loaded
+	defaultTimeout, _ := parseTimeout(manifest.Timeout.Default)
+	maxTimeout, _ := parseTimeout(manifest.Timeout.Max)
+
+	timeout := requested.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if timeout == 0 {
+		timeout = defaults.Timeout
+	}
+	if maxTimeout > 0 && (timeout == 0 || timeout > maxTimeout) {
+		timeout = maxTimeout
+	}
+
+	return Limits{CPU: cpu, Memory: memory, Timeout: timeout}, nil
+}
+
+// effectiveQuantity works in millicores and MB, except for the manifest values which
+// are Kubernetes quantities read with parse.
+func effectiveQuantity(manifest config.ResourceManifest, parse func(string) (int, error), requested, fallback string) (string, error) {
+	var quantity int
+	var err error
+	switch {
+	case requested != "":
+		quantity, err = parseLimit(requested)
+	case manifest.Default != "":
+		quantity, err = parse(manifest.Default)
+	default:
+		quantity, err = parseLimit(fallback)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if maxValue, _ := parseOptional(manifest.Max, parse); maxValue > 0 && quantity > maxValue {
+		quantity = maxValue
+	}
+
+	return strconv.Itoa(quantity), nil
+}
@@ -0,0 +1,76 @@
+package function_registry
+
+import (
+	"strings"
+	"testing"
+	"webserver/internal/config"
+)
+
+func validTestManifest() config.FunctionManifest {
+	return config.FunctionManifest{
+		CPU:     config.ResourceManifest{Default: "500m", Max: "1"},
+		Memory:  config.ResourceManifest{Default: "128Mi", Max: "512Mi"},
+		Timeout: config.ResourceManifest{Default: "10s", Max: "1m"},
+		Runtime: "wasmtime",
+		WASI: config.WASIManifest{
+			Env:     map[string]string{"LOG_LEVEL": "debug"},
+			Scratch: config.ScratchManifest{Enabled: true, Quota: "16Mi"},
+			Data:    []config.DataMountManifest{{Source: "fonts", GuestPath: "/fonts"}},
+		},
+		ContentTypes: config.ContentTypesManifest{Request: []string{"text/csv"}, Response: "application/json"},
+		Capabilities: []string{"wasi", "secrets"},
+		Secrets:      []config.SecretManifest{{Name: "api-token", Env: "API_TOKEN"}},
+	}
+}
+
+func TestValidateManifest(t *testing.T) {
+	if err := validateManifest(validTestManifest()); err != nil {
+		t.Fatalf("valid manifest: %v", err)
+	}
+	if err := validateManifest(config.FunctionManifest{}); err != nil {
+		t.Fatalf("empty manifest: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(manifest *config.FunctionManifest)
+		want   string
+	}{
+		{"host preopen", func(m *config.FunctionManifest) {
+			m.WASI.Preopens = []config.PreopenManifest{{HostPath: "/", GuestPath: "/host"}}
+		}, "preopens of host paths"},
+		{"invalid cpu", func(m *config.FunctionManifest) { m.CPU.Default = "lots" }, "cpu default"},
+		{"default above max", func(m *config.FunctionManifest) { m.Memory.Default = "1Gi" }, "above max"},
+		{"invalid timeout", func(m *config.FunctionManifest) { m.Timeout.Max = "-1s" }, "timeout max"},
+		{"timeout default above max", func(m *config.FunctionManifest) { m.Timeout.Default = "2m" }, "above max"},
+		{"unknown runtime", func(m *config.FunctionManifest) { m.Runtime = "wasmer" }, "runtime"},
+		{"unknown capability", func(m *config.FunctionManifest) { m.Capabilities = []string{"sockets"} }, "sockets"},
+		{"invalid env", func(m *config.FunctionManifest) { m.WASI.Env["A=B"] = "c" }, "environment variable"},
+		{"invalid secret name", func(m *config.FunctionManifest) { m.Secrets[0].Name = "../token" }, "secret name"},
+		{"duplicate secret", func(m *config.FunctionManifest) {
+			m.Secrets = append(m.Secrets, config.SecretManifest{Name: "api-token"})
+		}, "declared twice"},
+		{"secret env clash", func(m *config.FunctionManifest) { m.Secrets[0].Env = "LOG_LEVEL" }, "also set by wasi.env"},
+		{"data source outside volume", func(m *config.FunctionManifest) { m.WASI.Data[0].Source = "../etc" }, "not a relative path"},
+		{"absolute data source", func(m *config.FunctionManifest) { m.WASI.Data[0].Source = "/etc" }, "not a relative path"},
+		{"data without guest path", func(m *config.FunctionManifest) { m.WASI.Data[0].GuestPath = "" }, "no guest path"},
+		{"data on scratch", func(m *config.FunctionManifest) { m.WASI.Data[0].GuestPath = "/tmp/" }, "scratch directory"},
+		{"duplicate guest path", func(m *config.FunctionManifest) {
+			m.WASI.Data = append(m.WASI.Data, config.DataMountManifest{Source: "models", GuestPath: "/fonts"})
+		}, "like data mount of fonts"},
+		{"invalid scratch quota", func(m *config.FunctionManifest) { m.WASI.Scratch.Quota = "big" }, "scratch quota"},
+		{"invalid content type", func(m *config.FunctionManifest) { m.ContentTypes.Response = "application/" }, "content type"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manifest := validTestManifest()
+			test.change(&manifest)
+
+			err := validateManifest(manifest)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package function_registry
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"webserver/internal/snapshot"
+)
+
+const (
+	ReloadAdded   = "added"
+	ReloadChanged = "changed"
+	ReloadRemoved = "removed"
+)
+
+// invocationGate counts the in-flight invocations of a function, by the generation of
+// its module they started on. A swap starts a new generation right away, and waits for
+// the invocations of the previous one before its module's artifacts are released.
+type invocationGate struct {
+	mu      sync.Mutex
+	current *generation
+}
+
+type generation struct {
+	active int
+	// drained is closed when the last invocation finishes after the generation was
+	// swapped out, and nil otherwise
+	drained chan struct{}
+}
+
+func (fr *FunctionRegistry) gate(name string) *invocationGate {
+	fr.gatesMu.Lock()
+	defer fr.gatesMu.Unlock()
+
+	gate, ok := fr.gates[name]
+	if !ok {
+		gate = &invocationGate{current: &generation{}}
+		fr.gates[name] = gate
+	}
+	return gate
+}
+
+// Acquire marks an invocation of the function ref points to as in flight, until the
+// returned function is called. It never waits for reloads, but keeps the artifacts of
+// the module it resolves to until it is released, and keeps a downloaded module in the
+// module source's cache. Invocations acquire their function before resolving it, so the
+// module can not be evicted in between.
+func (fr *FunctionRegistry) Acquire(ref string) (release func()) {
+	name, _, _ := strings.Cut(ref, "@")
+	gate := fr.gate(name)
+
+	unpin := func() {}
+	if fr.ModuleSource != nil {
+		unpin = fr.ModuleSource.Pin(name)
+	}
+
+	gate.mu.Lock()
+	acquired := gate.current
+	acquired.active++
+	gate.mu.Unlock()
+
+	return func() {
+		unpin()
+
+		gate.mu.Lock()
+		acquired.active--
+		if acquired.active == 0 && acquired.drained != nil {
+			close(acquired.drained)
+			acquired.drained = nil
+		}
+		gate.mu.Unlock()
+	}
+}
+
+// swap runs fn, which swaps what is cached about a function so that new invocations
+// resolve to its new module, and then runs release once the invocations that started
+// before finished, or drainTimeout passed.
+func (fr *FunctionRegistry) swap(name string, drainTimeout time.Duration, fn, release func()) {
+	gate := fr.gate(name)
+
+	// Invocations acquired before fn may still resolve to the previous module, so the
+	// generation only changes after it
+	fn()
+
+	gate.mu.Lock()
+	previous := gate.current
+	gate.current = &generation{}
+	var drained chan struct{}
+	if previous.active > 0 {
+		drained = make(chan struct{})
+		previous.drained = drained
+	}
+	gate.mu.Unlock()
+
+	if drained != nil {
+		select {
+		case <-drained:
+		case <-time.After(drainTimeout):
+			slog.Warn("Releasing module while invocations are still in flight", "name", name, "drain_timeout", drainTimeout)
+		}
+	}
+
+	release()
+}
+
+// Reload swaps what is cached about a hand-copied module after its file was added,
+// changed or removed, and returns which of these happened. previousHash is the hash of
+// the module before the change, or "" if it did not exist. The change is "" when the
+// module is unchanged.
+func (fr *FunctionRegistry) Reload(name, previousHash string, drainTimeout time.Duration) (change, hash string, err error) {
+	if err := validName(name); err != nil {
+		return "", "", err
+	}
+	path := fr.legacyPath(name)
+
+	var stale bool
+	fr.swap(name, drainTimeout, func() {
+		snapshot.ForgetHash(path)
+
+		fr.runtimesMu.Lock()
+		delete(fr.runtimes, path)
+		fr.runtimesMu.Unlock()
+
+		fr.manifestsMu.Lock()
+		for _, suffix := range manifestSuffixes {
+			delete(fr.manifests, path+suffix)
+		}
+		fr.manifestsMu.Unlock()
+
+		if fr.SignatureVerifier != nil {
+			fr.SignatureVerifier.Forget(path)
+		}
+
+		if isRegularFile(path) {
+			hash, err = snapshot.ModuleHash(path)
+			if err != nil {
+				return
+			}
+		}
+		if hash == previousHash {
+			return
+		}
+
+		// The previous module's snapshot and artifacts are stale, unless it was only moved
+		// to version 1 by an upload. Snapshots are checked against the module they are
+		// loaded for, so only the artifacts wait for the invocations still running it.
+		versions, _ := fr.versions(name)
+		stale = previousHash != "" && (hash != "" || len(versions) == 0)
+		if stale {
+			fr.removeSnapshot(path)
+		}
+
+		switch {
+		case hash == "":
+			change = ReloadRemoved
+		case previousHash == "":
+			change = ReloadAdded
+		default:
+			change = ReloadChanged
+		}
+
+		if hash != "" && fr.ModuleCompiler.Config.PrecompileFunctions {
+			go fr.compile(Resolved{Name: name, Path: path})
+		}
+	}, func() {
+		if stale {
+			fr.evict(previousHash)
+		}
+	})
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed again while it was being reloaded, the next event reports it
+			return "", previousHash, nil
+		}
+		return "", previousHash, err
+	}
+
+	return change, hash, nil
+}
+
+// LegacyModules returns the hashes of the modules copied into the functions directory by hand.
+func (fr *FunctionRegistry) LegacyModules() (map[string]string, error) {
+	entries, err := os.ReadDir(fr.Config.FunctionsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string)
+	for _, entry := range entries {
+		if validName(entry.Name()) != nil || !entry.Type().IsRegular() {
+			continue
+		}
+
+		hash, err := snapshot.ModuleHash(fr.legacyPath(entry.Name()))
+		if err != nil {
+			slog.Debug("Skipping unreadable module", "name", entry.Name(), "reason", err)
+			continue
+		}
+		hashes[entry.Name()] = hash
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,160 @@
+package function_registry
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/module_compiler"
+	"webserver/internal/snapshot"
+	"webserver/internal/wasm_binary"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+)
+
+// newReloadRegistry returns a registry with a hand-copied hello.wasm that was compiled
+// for Wasmtime, and the path of its artifact.
+func newReloadRegistry(t *testing.T) (fr *FunctionRegistry, hash, artifact string) {
+	t.Helper()
+	fr = newTestRegistry(t)
+	fr.ModuleCompiler = &module_compiler.ModuleCompiler{
+		Config: &config.ModuleCompilerConfig{ArtifactCacheDir: t.TempDir()},
+		NewWasmtimeEngine: func(epochInterruption bool) *wasmtime.Engine {
+			engineConfig := wasmtime.NewConfig()
+			engineConfig.SetEpochInterruption(epochInterruption)
+			return wasmtime.NewEngineWithConfig(engineConfig)
+		},
+	}
+	if err := fr.ModuleCompiler.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := fr.legacyPath("hello.wasm")
+	if err := os.WriteFile(path, emptyModule(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := snapshot.ModuleHash(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifact, err = fr.ModuleCompiler.Artifact(path, module_compiler.RuntimeWasmtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fr, hash, artifact
+}
+
+func emptyModule() []byte {
+	return append(append([]byte{}, wasm_binary.Magic...), wasm_binary.Version...)
+}
+
+// replaceModule replaces hello.wasm with a module that differs by an empty custom section.
+func replaceModule(t *testing.T, fr *FunctionRegistry) {
+	t.Helper()
+	snapshot.ForgetHash(fr.legacyPath("hello.wasm"))
+	if err := os.WriteFile(fr.legacyPath("hello.wasm"), append(emptyModule(), 0, 1, 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// swapped waits until the gate of name started a generation other than previous.
+func swapped(t *testing.T, fr *FunctionRegistry, name string, previous *generation) {
+	t.Helper()
+	gate := fr.gate(name)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		gate.mu.Lock()
+		current := gate.current
+		gate.mu.Unlock()
+		if current != previous {
+			return
+		}
+	}
+	t.Fatal("module was not swapped")
+}
+
+func TestReloadDoesNotHoldBackNewInvocations(t *testing.T) {
+	fr, hash, artifact := newReloadRegistry(t)
+	gate := fr.gate("hello.wasm")
+	previous := gate.current
+
+	release := fr.Acquire("hello.wasm")
+	replaceModule(t, fr)
+
+	type reloaded struct {
+		change, hash string
+		err          error
+	}
+	done := make(chan reloaded, 1)
+	go func() {
+		change, hash, err := fr.Reload("hello.wasm", hash, time.Minute)
+		done <- reloaded{change, hash, err}
+	}()
+	swapped(t, fr, "hello.wasm", previous)
+
+	acquired := make(chan func(), 1)
+	go func() { acquired <- fr.Acquire("hello.wasm@latest") }()
+	var releaseNew func()
+	select {
+	case releaseNew = <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("new invocation waited for the in-flight one")
+	}
+	defer releaseNew()
+
+	// The previous module's artifact is kept until the invocation still running it is done
+	select {
+	case <-done:
+		t.Fatal("reload did not wait for the in-flight invocation")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := os.Stat(artifact); err != nil {
+		t.Fatalf("artifact was evicted while in use: %v", err)
+	}
+
+	// Invocations that started after the swap are not waited for
+	release()
+	select {
+	case result := <-done:
+		if result.err != nil || result.change != ReloadChanged || result.hash == hash {
+			t.Errorf("Reload() = %+v", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload waits for invocations of the new module")
+	}
+	if _, err := os.Stat(artifact); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stale artifact was not evicted: %v", err)
+	}
+}
+
+func TestReloadReleasesAfterDrainTimeout(t *testing.T) {
+	fr, hash, artifact := newReloadRegistry(t)
+	release := fr.Acquire("hello.wasm")
+	defer release()
+
+	replaceModule(t, fr)
+	if change, _, err := fr.Reload("hello.wasm", hash, 10*time.Millisecond); err != nil || change != ReloadChanged {
+		t.Fatalf("Reload() = %q, %v", change, err)
+	}
+	if _, err := os.Stat(artifact); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stale artifact was not evicted after the drain timeout: %v", err)
+	}
+}
+
+func TestReloadOfUnchangedModule(t *testing.T) {
+	fr, hash, artifact := newReloadRegistry(t)
+
+	if change, reloaded, err := fr.Reload("hello.wasm", hash, time.Minute); err != nil || change != "" || reloaded != hash {
+		t.Errorf("Reload() = %q, %s, %v, want no change", change, reloaded, err)
+	}
+	if _, err := os.Stat(artifact); err != nil {
+		t.Errorf("artifact of the unchanged module was evicted: %v", err)
+	}
+
+	if err := os.Remove(fr.legacyPath("hello.wasm")); err != nil {
+		t.Fatal(err)
+	}
+	if change, reloaded, err := fr.Reload("hello.wasm", hash, time.Minute); err != nil || change != ReloadRemoved || reloaded != "" {
+		t.Errorf("Reload() = %q, %s, %v, want it removed", change, reloaded, err)
+	}
+}
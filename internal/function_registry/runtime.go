@@ -0,0 +1,90 @@
+package function_registry
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"webserver/internal/module_compiler"
+)
+
+const (
+	runtimeSuffix = ".runtime"
+
+	RuntimeDeclared = "declared"
+	RuntimeDetected = "detected"
+)
+
+// detectedRuntime caches the runtime detected for a module, as long as the file is unchanged.
+type detectedRuntime struct {
+	modTime time.Time
+	size    int64
+	runtime string
+}
+
+// runtimePath is where the runtime declared when a version was uploaded is stored.
+func runtimePath(modulePath string) string {
+	return modulePath + runtimeSuffix
+}
+
+// declareRuntime checks that runtime can execute the module at modulePath. An empty
+// runtime leaves the choice to detection.
+func declareRuntime(modulePath, runtime string) error {
+	if runtime == "" {
+		return nil
+	}
+	if !module_compiler.ValidRuntime(runtime) {
+		return fmt.Errorf("%w %q, expected %s or %s", ErrInvalidRuntime, runtime, module_compiler.RuntimeWasmtime, module_compiler.RuntimeWasmedge)
+	}
+
+	kind, err := module_compiler.DetectKind(modulePath)
+	if err != nil {
+		return err
+	}
+	if !module_compiler.CanRun(kind, runtime) {
+		return &InvalidModuleError{Reason: fmt.Errorf("a %s artifact can not run on %s", kind, runtime)}
+	}
+
+	return nil
+}
+
+// Runtime returns the runtime a resolved function runs on and whether it was declared,
+// when the version was uploaded or in the function's manifest, or detected. The runtime
+// is "" when the module does not depend on one.
+func (fr *FunctionRegistry) Runtime(resolved Resolved) (string, string, error) {
+	declared, err := os.ReadFile(runtimePath(resolved.Path))
+	if err == nil {
+		return strings.TrimSpace(string(declared)), RuntimeDeclared, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", "", err
+	}
+
+	// Invalid manifests are reported by Get and fail invocations, not descriptions
+	if manifest, err := fr.Manifest(resolved.Name); err == nil && manifest.Runtime != "" {
+		return manifest.Runtime, RuntimeDeclared, nil
+	}
+
+	info, err := os.Stat(resolved.Path)
+	if err != nil {
+		return "", "", err
+	}
+
+	fr.runtimesMu.Lock()
+	cached, ok := fr.runtimes[resolved.Path]
+	fr.runtimesMu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.runtime, RuntimeDetected, nil
+	}
+
+	runtime, err := module_compiler.DetectRuntime(resolved.Path)
+	if err != nil {
+		return "", "", err
+	}
+
+	fr.runtimesMu.Lock()
+	fr.runtimes[resolved.Path] = detectedRuntime{modTime: info.ModTime(), size: info.Size(), runtime: runtime}
+	fr.runtimesMu.Unlock()
+
+	return runtime, RuntimeDetected, nil
+}
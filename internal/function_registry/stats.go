@@ -0,0 +1,115 @@
+package function_registry
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyWindow is how many recent invocations latency percentiles are computed from.
+const latencyWindow = 1000
+
+// VersionStats summarizes the invocations of one version served by this instance.
+type VersionStats struct {
+	Version     int     `json:"version"`
+	Invocations int64   `json:"invocations"`
+	Errors      int64   `json:"errors"`
+	ErrorRate   float64 `json:"error_rate"`
+	LatencyP50  float64 `json:"latency_p50_ms"`
+	LatencyP95  float64 `json:"latency_p95_ms"`
+	LatencyP99  float64 `json:"latency_p99_ms"`
+	LatencyMean float64 `json:"latency_mean_ms"`
+}
+
+type versionStats struct {
+	invocations int64
+	errors      int64
+	latencies   []time.Duration
+	next        int
+}
+
+type statsKey struct {
+	name    string
+	version int
+}
+
+type statsRecorder struct {
+	versions map[statsKey]*versionStats
+	mu       sync.Mutex
+}
+
+// Record accounts an invocation of a resolved function.
+func (fr *FunctionRegistry) Record(resolved Resolved, latency time.Duration, failed bool) {
+	fr.stats.mu.Lock()
+	defer fr.stats.mu.Unlock()
+
+	if fr.stats.versions == nil {
+		fr.stats.versions = make(map[statsKey]*versionStats)
+	}
+
+	key := statsKey{name: resolved.Name, version: resolved.Version}
+	stats, ok := fr.stats.versions[key]
+	if !ok {
+		stats = &versionStats{}
+		fr.stats.versions[key] = stats
+	}
+
+	stats.invocations++
+	if failed {
+		stats.errors++
+	}
+
+	if len(stats.latencies) < latencyWindow {
+		stats.latencies = append(stats.latencies, latency)
+	} else {
+		stats.latencies[stats.next] = latency
+		stats.next = (stats.next + 1) % latencyWindow
+	}
+}
+
+// Stats returns the per-version invocation statistics of a function since this instance started.
+func (fr *FunctionRegistry) Stats(name string) []VersionStats {
+	fr.stats.mu.Lock()
+	defer fr.stats.mu.Unlock()
+
+	result := []VersionStats{}
+	for key, stats := range fr.stats.versions {
+		if key.name != name {
+			continue
+		}
+
+		summary := VersionStats{
+			Version:     key.version,
+			Invocations: stats.invocations,
+			Errors:      stats.errors,
+			ErrorRate:   float64(stats.errors) / float64(stats.invocations),
+		}
+
+		latencies := append([]time.Duration(nil), stats.latencies...)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+		var total time.Duration
+		for _, latency := range latencies {
+			total += latency
+		}
+		summary.LatencyMean = milliseconds(total / time.Duration(len(latencies)))
+		summary.LatencyP50 = milliseconds(percentile(latencies, 0.50))
+		summary.LatencyP95 = milliseconds(percentile(latencies, 0.95))
+		summary.LatencyP99 = milliseconds(percentile(latencies, 0.99))
+
+		result = append(result, summary)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result
+}
+
+// percentile uses the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,210 @@
+package hot_reload
+
+import (
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/function_registry"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// debounce groups the events of one copy, which writes a file in several steps.
+const debounce = 250 * time.Millisecond
+
+type Stats struct {
+	Added      int64      `json:"added"`
+	Changed    int64      `json:"changed"`
+	Removed    int64      `json:"removed"`
+	Failed     int64      `json:"failed"`
+	LastReload *time.Time `json:"last_reload,omitempty"`
+}
+
+// Reloader watches the functions directory, and reloads hand-copied modules when they
+// are added, replaced or removed. Uploaded versions are immutable and never reloaded.
+type Reloader struct {
+	Config   *config.HotReloadConfig
+	Registry *function_registry.FunctionRegistry
+	watcher  *fsnotify.Watcher
+	// hashes are those of the modules as they were last loaded
+	hashes    map[string]string
+	reloading map[string]bool
+	again     map[string]bool
+	stats     Stats
+	mu        sync.Mutex
+	done      chan struct{}
+}
+
+func (r *Reloader) Init() error {
+	r.hashes = make(map[string]string)
+	r.reloading = make(map[string]bool)
+	r.again = make(map[string]bool)
+	r.done = make(chan struct{})
+
+	if !r.Enabled() {
+		close(r.done)
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(r.Registry.Config.FunctionsDir); err != nil {
+		watcher.Close()
+		return err
+	}
+	r.watcher = watcher
+
+	hashes, err := r.Registry.LegacyModules()
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	r.hashes = hashes
+
+	return nil
+}
+
+func (r *Reloader) Enabled() bool {
+	return r.Config.HotReload
+}
+
+func (r *Reloader) Start() {
+	if !r.Enabled() {
+		return
+	}
+
+	go r.run()
+	slog.Info("Watching functions for changes", "dir", r.Registry.Config.FunctionsDir, "modules", len(r.hashes))
+}
+
+func (r *Reloader) Stop() {
+	if r.watcher != nil {
+		r.watcher.Close()
+	}
+	<-r.done
+}
+
+func (r *Reloader) run() {
+	defer close(r.done)
+
+	pending := make(map[string]bool)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Dir(event.Name) != filepath.Clean(r.Registry.Config.FunctionsDir) {
+				continue
+			}
+
+			pending[filepath.Base(event.Name)] = true
+			timer.Reset(debounce)
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("Failed to watch functions", "reason", err)
+		case <-timer.C:
+			names := make([]string, 0, len(pending))
+			for name := range pending {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			clear(pending)
+
+			for _, name := range names {
+				r.schedule(name)
+			}
+		}
+	}
+}
+
+// schedule reloads a module in the background, since reloads wait for in-flight
+// invocations. Changes during a reload of the same module trigger one more reload.
+func (r *Reloader) schedule(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.reloading[name] {
+		r.again[name] = true
+		return
+	}
+	r.reloading[name] = true
+
+	go func() {
+		for {
+			r.reload(name)
+
+			r.mu.Lock()
+			if !r.again[name] {
+				delete(r.reloading, name)
+				r.mu.Unlock()
+				return
+			}
+			delete(r.again, name)
+			r.mu.Unlock()
+		}
+	}()
+}
+
+func (r *Reloader) reload(name string) {
+	r.mu.Lock()
+	previousHash := r.hashes[name]
+	r.mu.Unlock()
+
+	start := time.Now()
+	drainTimeout := time.Duration(r.Config.HotReloadDrainTimeoutMS) * time.Millisecond
+	change, hash, err := r.Registry.Reload(name, previousHash, drainTimeout)
+	if errors.Is(err, function_registry.ErrInvalidName) {
+		// Manifests, signatures, snapshots and temporary files
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.stats.Failed++
+		slog.Error("Failed to reload module", "name", name, "reason", err)
+		return
+	}
+
+	if hash == "" {
+		delete(r.hashes, name)
+	} else {
+		r.hashes[name] = hash
+	}
+
+	switch change {
+	case function_registry.ReloadAdded:
+		r.stats.Added++
+	case function_registry.ReloadChanged:
+		r.stats.Changed++
+	case function_registry.ReloadRemoved:
+		r.stats.Removed++
+	default:
+		return
+	}
+
+	now := time.Now()
+	r.stats.LastReload = &now
+	slog.Info("Reloaded module", "name", name, "change", change, "sha256", hash, "time", time.Since(start))
+}
+
+func (r *Reloader) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.stats
+	return stats
+}
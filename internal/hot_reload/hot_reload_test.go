@@ -0,0 +1,93 @@
+package hot_reload
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/function_registry"
+	"webserver/internal/module_compiler"
+	"webserver/internal/wasm_binary"
+)
+
+func newTestReloader(t *testing.T) *Reloader {
+	t.Helper()
+	registry := &function_registry.FunctionRegistry{
+		Config:         &config.FunctionRegistryConfig{FunctionsDir: t.TempDir(), MaxModuleSizeMB: 1},
+		ModuleCompiler: &module_compiler.ModuleCompiler{Config: &config.ModuleCompilerConfig{}},
+	}
+	if err := registry.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Reloader{
+		Config:   &config.HotReloadConfig{HotReload: true, HotReloadDrainTimeoutMS: 1000},
+		Registry: registry,
+	}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	t.Cleanup(r.Stop)
+	return r
+}
+
+// waitForStats waits until the reloader counted the reloads in want.
+func waitForStats(t *testing.T, r *Reloader, want Stats) {
+	t.Helper()
+	var stats Stats
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stats = r.Stats()
+		if stats.Added == want.Added && stats.Changed == want.Changed && stats.Removed == want.Removed && stats.Failed == want.Failed {
+			return
+		}
+	}
+	t.Fatalf("stats are %+v, want %+v", stats, want)
+}
+
+func TestReload(t *testing.T) {
+	r := newTestReloader(t)
+	path := filepath.Join(r.Registry.Config.FunctionsDir, "hello.wasm")
+	module := append(append([]byte{}, wasm_binary.Magic...), wasm_binary.Version...)
+
+	if err := os.WriteFile(path, module, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForStats(t, r, Stats{Added: 1})
+
+	if err := os.WriteFile(path, append(module, 0, 1, 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForStats(t, r, Stats{Added: 1, Changed: 1})
+
+	// Neither manifests nor rewrites with the same content are reloads
+	if err := os.WriteFile(path+".manifest.json", []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(module, 0, 1, 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * debounce)
+	waitForStats(t, r, Stats{Added: 1, Changed: 1})
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	waitForStats(t, r, Stats{Added: 1, Changed: 1, Removed: 1})
+	if r.Stats().LastReload == nil {
+		t.Error("last reload was not recorded")
+	}
+}
+
+func TestReloadDoesNotWaitForInvocationsOfOtherFunctions(t *testing.T) {
+	r := newTestReloader(t)
+	release := r.Registry.Acquire("other.wasm")
+	defer release()
+
+	path := filepath.Join(r.Registry.Config.FunctionsDir, "hello.wasm")
+	if err := os.WriteFile(path, append(append([]byte{}, wasm_binary.Magic...), wasm_binary.Version...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForStats(t, r, Stats{Added: 1})
+}
@@ -0,0 +1,45 @@
+package http_server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// requireAdminToken guards the /admin API, which can replace modules and manifests. Requests
+// must carry "Authorization: Bearer <ADMIN_TOKEN>", and without ADMIN_TOKEN the API is
+// disabled rather than open.
+func (ws *WebServer) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ws.Config.AdminToken == "" {
+			http.Error(w, "Admin API is disabled, ADMIN_TOKEN is not set", http.StatusForbidden)
+			return
+		}
+
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		// Hashing first makes the comparison constant time whatever the token's length
+		want, got := sha256.Sum256([]byte(ws.Config.AdminToken)), sha256.Sum256([]byte(token))
+		if !ok || subtle.ConstantTimeCompare(want[:], got[:]) != 1 {
+			slog.Info("Refused admin request", "method", req.Method, "path", req.URL.Path, "remote_addr", req.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="wasmbox-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (ws *WebServer) HandleListSchedules(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, ws.Scheduler.Status())
+}
+
+func (ws *WebServer) HandleShadowStats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, ws.Shadow.Stats())
+}
+
+func (ws *WebServer) HandleReloadStats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, ws.Reloader.Stats())
+}
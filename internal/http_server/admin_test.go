@@ -0,0 +1,65 @@
+package http_server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"webserver/internal/config"
+)
+
+func TestRequireAdminToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          int
+	}{
+		{"no token configured", "", "Bearer ", http.StatusForbidden},
+		{"no token configured, no header", "", "", http.StatusForbidden},
+		{"missing header", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer s3cre", http.StatusUnauthorized},
+		{"wrong scheme", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+		{"valid token", "s3cret", "Bearer s3cret", http.StatusTeapot},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ws := &WebServer{Config: &config.WebServerConfig{AdminToken: test.token}}
+			handler := ws.requireAdminToken(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			}))
+
+			req := httptest.NewRequest(http.MethodPut, "/admin/functions/hello.wasm", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			if recorder.Code != test.want {
+				t.Fatalf("got status %d, want %d", recorder.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestAdminRoutesRequireToken(t *testing.T) {
+	router := (&WebServer{Config: &config.WebServerConfig{AdminToken: "s3cret"}}).router()
+
+	routes := []struct{ method, path string }{
+		{http.MethodGet, "/admin/functions"},
+		{http.MethodPut, "/admin/functions/hello.wasm"},
+		{http.MethodDelete, "/admin/functions/hello.wasm"},
+		{http.MethodPut, "/admin/functions/hello.wasm/manifest"},
+		{http.MethodPost, "/admin/functions/hello.wasm/aliases/stable/rollback"},
+		{http.MethodGet, "/admin/reloads"},
+		{http.MethodPost, "/admin/checkpoints/id/resume"},
+	}
+	for _, route := range routes {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(route.method, route.path, nil))
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: got status %d, want %d", route.method, route.path, recorder.Code, http.StatusUnauthorized)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package http_server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const CallbackURLHeader = "Callback-URL"
+
+// HandleAsync queues an invocation and immediately returns the job ID.
+// The result can be polled from /jobs/{job_id} or pushed to the optional Callback-URL.
+func (ws *WebServer) HandleAsync(w http.ResponseWriter, req *http.Request) {
+	wasmFile := mux.Vars(req)["wasm_file"]
+	callbackURL := req.Header.Get(CallbackURLHeader)
+
+	if err := ws.JobManager.ValidateCallbackURL(callbackURL); err != nil {
+		slog.Info("Invalid callback URL", "wasm_file", wasmFile, "reason", err)
+		http.Error(w, "Invalid "+CallbackURLHeader+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Limits are completed and capped by the function's manifest when the job runs
+	requested, err := requestedLimits(req.Header)
+	if err != nil {
+		slog.Info("Invalid resource request", "wasm_file", wasmFile, "reason", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Declared request content types are enforced like for synchronous invocations
+	var wasmParam string
+	if req.Method == http.MethodPost {
+		var ok bool
+		if wasmParam, ok = ws.readParameter(w, req); !ok {
+			return
+		}
+	}
+
+	name, _, _ := strings.Cut(wasmFile, "@")
+	seed := req.Header.Get(DeterministicSeedHeader)
+	job, err := ws.JobManager.Submit(wasmFile, requested.CPU, requested.Memory, wasmParam, requested.Timeout, seed, callbackURL, ws.responseContentType(name))
+	if err != nil {
+		slog.Warn("Refused async job", "wasm_file", wasmFile, "reason", err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func (ws *WebServer) HandleJobStatus(w http.ResponseWriter, req *http.Request) {
+	jobID := mux.Vars(req)["job_id"]
+
+	job, ok := ws.JobManager.Get(jobID)
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode response", "reason", err)
+	}
+}
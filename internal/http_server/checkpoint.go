@@ -0,0 +1,255 @@
+package http_server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"webserver/internal/checkpoint"
+	"webserver/internal/function_registry"
+	"webserver/internal/snapshot"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const CheckpointIDHeader = "Checkpoint-ID"
+
+// CheckpointedError is returned instead of an output when an invocation was
+// interrupted and saved to disk so it can be resumed later.
+type CheckpointedError struct {
+	Metadata checkpoint.Metadata
+}
+
+func (e *CheckpointedError) Error() string {
+	return "invocation was checkpointed as " + e.Metadata.ID
+}
+
+// NewWasmtimeEngine creates a Wasmtime engine. Epoch interruption is how invocations are
+// interrupted for checkpoints and timeouts. Modules serialized by an engine without it can
+// not be deserialized by one with it, and vice versa.
+func (ws *WebServer) NewWasmtimeEngine(epochInterruption bool) *wasmtime.Engine {
+	engineConfig := wasmtime.NewConfig()
+	engineConfig.SetEpochInterruption(epochInterruption)
+	return wasmtime.NewEngineWithConfig(engineConfig)
+}
+
+func (ws *WebServer) restoreCheckpoint(modulePath string, instance snapshot.Instance, resume *checkpoint.Checkpoint) error {
+	moduleHash, err := snapshot.ModuleHash(modulePath)
+	if err != nil {
+		return err
+	}
+
+	if moduleHash != resume.Metadata.ModuleHash {
+		return fmt.Errorf("module %s changed since checkpoint %s was taken", resume.Metadata.WasmFile, resume.Metadata.ID)
+	}
+
+	return resume.State.Restore(instance)
+}
+
+// saveCheckpoint captures an interrupted instance and reports the outcome to the checkpoint requester.
+func (ws *WebServer) saveCheckpoint(invocation *checkpoint.Invocation, modulePath, maxMemory string, instance snapshot.Instance, stdinPath, stdoutPath string, resume *checkpoint.Checkpoint) WasmThreadResult {
+	metadata, err := ws.writeCheckpoint(invocation, modulePath, maxMemory, instance, stdinPath, stdoutPath, resume)
+	ws.CheckpointManager.Complete(invocation, metadata, err)
+	if err != nil {
+		slog.Error("Failed to checkpoint invocation", "request_id", invocation.RequestID, "reason", err)
+		return WasmThreadResult{Output: "", Err: err}
+	}
+
+	slog.Info("Checkpointed invocation", "request_id", invocation.RequestID, "checkpoint_id", metadata.ID)
+	return WasmThreadResult{Output: "", Err: &CheckpointedError{Metadata: metadata}}
+}
+
+func (ws *WebServer) writeCheckpoint(invocation *checkpoint.Invocation, modulePath, maxMemory string, instance snapshot.Instance, stdinPath, stdoutPath string, resume *checkpoint.Checkpoint) (checkpoint.Metadata, error) {
+	moduleHash, err := snapshot.ModuleHash(modulePath)
+	if err != nil {
+		return checkpoint.Metadata{}, err
+	}
+
+	state, err := snapshot.Capture(instance, moduleHash, "", "")
+	if err != nil {
+		return checkpoint.Metadata{}, err
+	}
+
+	stdin, err := os.ReadFile(stdinPath)
+	if err != nil {
+		return checkpoint.Metadata{}, err
+	}
+
+	stdout, err := os.ReadFile(stdoutPath)
+	if err != nil {
+		return checkpoint.Metadata{}, err
+	}
+
+	startedAt := invocation.StartedAt
+	if resume != nil {
+		stdout = append(resume.Stdout, stdout...)
+		startedAt = resume.Metadata.StartedAt
+	}
+
+	return ws.CheckpointManager.Save(&checkpoint.Checkpoint{
+		Metadata: checkpoint.Metadata{
+			RequestID:   invocation.RequestID,
+			WasmFile:    invocation.WasmFile,
+			ModuleHash:  moduleHash,
+			MemoryLimit: maxMemory,
+			Pod:         ws.CgroupManager.Config.PodUID,
+			StartedAt:   startedAt,
+		},
+		State:  state,
+		Stdin:  stdin,
+		Stdout: stdout,
+	})
+}
+
+func (ws *WebServer) checkpointsEnabled(w http.ResponseWriter) bool {
+	if !ws.CheckpointManager.Enabled() {
+		http.Error(w, "Checkpoints are disabled", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func (ws *WebServer) HandleListInvocations(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, ws.CheckpointManager.List())
+}
+
+func (ws *WebServer) HandleCheckpointInvocation(w http.ResponseWriter, req *http.Request) {
+	if !ws.checkpointsEnabled(w) {
+		return
+	}
+
+	requestID := mux.Vars(req)["request_id"]
+	metadata, err := ws.CheckpointManager.Checkpoint(requestID)
+
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, metadata)
+	case errors.Is(err, checkpoint.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, checkpoint.ErrNotCheckpointable), errors.Is(err, checkpoint.ErrAlreadyRequested), errors.Is(err, checkpoint.ErrFinished):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, checkpoint.ErrTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		slog.Error("Failed to checkpoint invocation", "request_id", requestID, "reason", err)
+		http.Error(w, "Failed to checkpoint invocation", http.StatusInternalServerError)
+	}
+}
+
+func (ws *WebServer) HandleListCheckpoints(w http.ResponseWriter, req *http.Request) {
+	if !ws.checkpointsEnabled(w) {
+		return
+	}
+
+	checkpoints, err := ws.CheckpointManager.ListCheckpoints()
+	if err != nil {
+		slog.Error("Failed to list checkpoints", "reason", err)
+		http.Error(w, "Failed to list checkpoints", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, checkpoints)
+}
+
+func (ws *WebServer) HandleDeleteCheckpoint(w http.ResponseWriter, req *http.Request) {
+	if !ws.checkpointsEnabled(w) {
+		return
+	}
+
+	err := ws.CheckpointManager.Delete(mux.Vars(req)["checkpoint_id"])
+	if errors.Is(err, checkpoint.ErrNoCheckpoint) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleResumeCheckpoint restarts a checkpointed invocation on this instance from the
+// resume export and responds like the original invocation would have.
+func (ws *WebServer) HandleResumeCheckpoint(w http.ResponseWriter, req *http.Request) {
+	if !ws.checkpointsEnabled(w) {
+		return
+	}
+
+	checkpointID := mux.Vars(req)["checkpoint_id"]
+	resume, err := ws.CheckpointManager.Claim(checkpointID)
+	if errors.Is(err, checkpoint.ErrNoCheckpoint) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.Error("Failed to load checkpoint", "checkpoint_id", checkpointID, "reason", err)
+		http.Error(w, "Failed to load checkpoint", http.StatusInternalServerError)
+		return
+	}
+
+	atomic.AddInt32(&ws.CurrentRequests, 1)
+	defer atomic.AddInt32(&ws.CurrentRequests, -1)
+
+	runtime.LockOSThread()
+	handlerID := strconv.Itoa(syscall.Gettid())
+	requestID := uuid.New().String()
+	// The restored memory needs the limit it was taken with, the rest comes from the manifest.
+	// The timeout applies to the resumed part of the invocation.
+	limits := function_registry.Limits{CPU: DefaultCPULimit, Memory: resume.Metadata.MemoryLimit}
+	release := ws.FunctionRegistry.Acquire(resume.Metadata.WasmFile)
+	if function, err := ws.FunctionRegistry.Resolve(resume.Metadata.WasmFile); err == nil {
+		if effective, err := ws.functionLimits(function, function_registry.Limits{Memory: limits.Memory}); err == nil {
+			limits.CPU, limits.Timeout = effective.CPU, effective.Timeout
+		}
+	}
+
+	var enforcedTimeout time.Duration
+	output, timesData, err := ws.executeInCgroup(handlerID, requestID, limits.Memory, limits.CPU, func() WasmThreadResult {
+		result := ws.runWasmtime(handlerID, requestID, resume.Metadata.WasmFile, "", limits.Memory, limits.Timeout, "", resume)
+		enforcedTimeout = result.Timeout
+		return result
+	})
+	release()
+	limits.Timeout = enforcedTimeout
+	setEffectiveLimits(timesData, limits)
+	runtime.UnlockOSThread()
+
+	for key, value := range timesData {
+		w.Header().Set(key, value)
+	}
+
+	var checkpointed *CheckpointedError
+	if err == nil || errors.As(err, &checkpointed) {
+		// The state now lives in the output or in a newer checkpoint
+		if releaseErr := ws.CheckpointManager.Release(checkpointID); releaseErr != nil {
+			slog.Error("Failed to remove resumed checkpoint", "checkpoint_id", checkpointID, "reason", releaseErr)
+		}
+	} else if unclaimErr := ws.CheckpointManager.Unclaim(checkpointID); unclaimErr != nil {
+		slog.Error("Failed to return checkpoint", "checkpoint_id", checkpointID, "reason", unclaimErr)
+	}
+
+	if checkpointed != nil {
+		w.Header().Set(CheckpointIDHeader, checkpointed.Metadata.ID)
+		http.Error(w, "Invocation was checkpointed", http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, checkpoint.ErrNotResumable) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		slog.Error("Failed to resume checkpoint", "checkpoint_id", checkpointID, "reason", err)
+		http.Error(w, "Failed to resume checkpoint", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("WASM output: %s", strings.TrimRight(output, "\x00"))))
+}
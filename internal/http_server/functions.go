@@ -0,0 +1,199 @@
+package http_server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"webserver/internal/admission"
+	"webserver/internal/function_registry"
+	"webserver/internal/signature"
+
+	"github.com/gorilla/mux"
+)
+
+// ModuleSignatureHeader carries the signature of an uploaded module.
+const ModuleSignatureHeader = "Module-Signature"
+
+// SetAliasRequestBody either moves an alias to Version, or splits its traffic when Split is set.
+type SetAliasRequestBody struct {
+	Version      int                                 `json:"version"`
+	Split        []function_registry.WeightedVersion `json:"split"`
+	StickyHeader string                              `json:"sticky_header"`
+}
+
+func (ws *WebServer) HandleListFunctions(w http.ResponseWriter, req *http.Request) {
+	functions, err := ws.FunctionRegistry.List()
+	if err != nil {
+		slog.Error("Failed to list functions", "reason", err)
+		http.Error(w, "Failed to list functions", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, functions)
+}
+
+// HandleGetFunction describes a whole function, or a single version when the
+// name is followed by "@" and a version or an alias.
+func (ws *WebServer) HandleGetFunction(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+
+	var result any
+	var err error
+	if strings.Contains(name, "@") {
+		result, err = ws.FunctionRegistry.GetVersion(name)
+	} else {
+		result, err = ws.FunctionRegistry.Get(name)
+	}
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// HandlePutFunction stores the module sent as the request body as a new version. The
+// "runtime" query parameter pins it to a runtime instead of detecting one, and the
+// Module-Signature header carries the base64 encoded signature of the module.
+func (ws *WebServer) HandlePutFunction(w http.ResponseWriter, req *http.Request) {
+	metadata, err := ws.FunctionRegistry.Put(mux.Vars(req)["name"], req.Body, req.URL.Query().Get("runtime"), req.Header.Get(ModuleSignatureHeader))
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, metadata)
+}
+
+func (ws *WebServer) HandleDeleteFunction(w http.ResponseWriter, req *http.Request) {
+	if err := ws.FunctionRegistry.Delete(mux.Vars(req)["name"]); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ws *WebServer) HandleGetManifest(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+	if _, err := ws.FunctionRegistry.Resolve(name); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	manifest, err := ws.FunctionRegistry.Manifest(name)
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, manifest)
+}
+
+// HandlePutManifest stores the YAML or JSON manifest sent as the request body.
+func (ws *WebServer) HandlePutManifest(w http.ResponseWriter, req *http.Request) {
+	manifest, err := ws.FunctionRegistry.SetManifest(mux.Vars(req)["name"], req.Body)
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, manifest)
+}
+
+func (ws *WebServer) HandleDeleteManifest(w http.ResponseWriter, req *http.Request) {
+	if err := ws.FunctionRegistry.DeleteManifest(mux.Vars(req)["name"]); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ws *WebServer) HandleSetAlias(w http.ResponseWriter, req *http.Request) {
+	var requestBody SetAliasRequestBody
+	if err := json.NewDecoder(req.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vars := mux.Vars(req)
+	var alias *function_registry.Alias
+	var err error
+	if len(requestBody.Split) > 0 {
+		alias, err = ws.FunctionRegistry.SetSplit(vars["name"], vars["alias"], requestBody.Split, requestBody.StickyHeader)
+	} else {
+		alias, err = ws.FunctionRegistry.SetAlias(vars["name"], vars["alias"], requestBody.Version)
+	}
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	slog.Info("Updated alias", "name", vars["name"], "alias", vars["alias"], "version", alias.Version, "split", alias.Split)
+	writeJSON(w, http.StatusOK, alias)
+}
+
+func (ws *WebServer) HandleDeleteAlias(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if err := ws.FunctionRegistry.DeleteAlias(vars["name"], vars["alias"]); err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ws *WebServer) HandleRollbackAlias(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	alias, err := ws.FunctionRegistry.Rollback(vars["name"], vars["alias"])
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	slog.Info("Rolled back alias", "name", vars["name"], "alias", vars["alias"], "version", alias.Version)
+	writeJSON(w, http.StatusOK, alias)
+}
+
+// HandleFunctionStats reports the error rate and latency of each version served by this instance.
+func (ws *WebServer) HandleFunctionStats(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, ws.FunctionRegistry.Stats(mux.Vars(req)["name"]))
+}
+
+// HandleInspectFunction decodes the module of a function, or of a single version when
+// the name is followed by "@" and a version or an alias.
+func (ws *WebServer) HandleInspectFunction(w http.ResponseWriter, req *http.Request) {
+	inspection, err := ws.FunctionRegistry.Inspect(mux.Vars(req)["name"])
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, inspection)
+}
+
+func writeRegistryError(w http.ResponseWriter, err error) {
+	var invalidModule *function_registry.InvalidModuleError
+	var rejected *admission.RejectedError
+
+	switch {
+	case errors.As(err, &rejected):
+		writeJSON(w, http.StatusUnprocessableEntity, rejected.Report)
+	case errors.Is(err, function_registry.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, function_registry.ErrInvalidName), errors.Is(err, function_registry.ErrInvalidAlias), errors.Is(err, function_registry.ErrInvalidSplit), errors.Is(err, function_registry.ErrInvalidRuntime), errors.Is(err, function_registry.ErrInvalidManifest), errors.As(err, &invalidModule):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, function_registry.ErrNoHistory), errors.Is(err, function_registry.ErrVersionInUse):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, signature.ErrUnsigned), errors.Is(err, signature.ErrInvalidSignature):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, function_registry.ErrTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		slog.Error("Function registry failed", "reason", err)
+		http.Error(w, "Function registry failed", http.StatusInternalServerError)
+	}
+}
@@ -9,17 +9,34 @@ import (
 	"log"
 	"log/slog"
 	"math"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"webserver/internal/capabilities"
 	"webserver/internal/cgroup_manager"
+	"webserver/internal/checkpoint"
 	"webserver/internal/config"
+	"webserver/internal/determinism"
+	"webserver/internal/function_registry"
+	"webserver/internal/hot_reload"
+	"webserver/internal/job_manager"
+	"webserver/internal/module_compiler"
+	"webserver/internal/scheduler"
+	"webserver/internal/scratch"
+	"webserver/internal/secrets"
+	"webserver/internal/shadow"
+	"webserver/internal/signature"
+	"webserver/internal/snapshot"
+	"webserver/internal/utils"
+	"webserver/internal/wasm_binary"
 
 	"github.com/bytecodealliance/wasmtime-go/v24"
 	"github.com/google/uuid"
@@ -32,11 +49,30 @@ import (
 const (
 	DefaultMemoryLimit = "200" // MB
 	DefaultCPULimit    = "500" // Milicores
+
+	FunctionVersionHeader = "Function-Version"
+	FunctionTimeoutHeader = "Function-Timeout"
+	CPUQuotaHeader        = "cpu_quota"
+	MemoryRequestHeader   = "Memory-Request"
+
+	// DeterministicSeedHeader runs an invocation with virtual clocks and randomness
+	// derived from its value
+	DeterministicSeedHeader = "Deterministic-Seed"
+
+	EffectiveCPULimitHeader    = "Effective-CPU-Limit"
+	EffectiveMemoryLimitHeader = "Effective-Memory-Limit"
+	EffectiveTimeoutHeader     = "Effective-Timeout"
+
+	shadowRequestPrefix = "shadow-"
 )
 
+var ErrInvocationTimeout = errors.New("invocation exceeded its timeout")
+
 type WasmThreadResult struct {
 	Output string
 	Err    error
+	// Timeout is the timeout the invocation could be interrupted after, zero if none was enforced.
+	Timeout time.Duration
 }
 
 type WebServer struct {
@@ -44,26 +80,88 @@ type WebServer struct {
 	ReadyWEXs            map[string][]string
 	WEXs                 []string
 	CgroupManager        *cgroup_manager.CgroupManager
+	CheckpointManager    *checkpoint.CheckpointManager
+	FunctionRegistry     *function_registry.FunctionRegistry
+	JobManager           *job_manager.JobManager
+	ModuleCompiler       *module_compiler.ModuleCompiler
+	Scheduler            *scheduler.Scheduler
+	Shadow               *shadow.ShadowRunner
+	Reloader             *hot_reload.Reloader
+	Scratch              *scratch.ScratchManager
+	Secrets              *secrets.SecretStore
 	MemUtilizationWindow *list.List
 	CurrentRequests      int32
+	// maxCPU and maxMemory cap every invocation, in millicores and MiB, unless zero
+	maxCPU    int
+	maxMemory int
 }
 
 type PostRequestBody struct {
 	Parameter string `json:"parameter"`
 }
 
+// InitLimits sets the limits no invocation can exceed, even if its function has no
+// manifest: MAX_CPU_LIMIT and MAX_MEMORY_LIMIT, or else the container's limits.
+func (ws *WebServer) InitLimits() error {
+	ws.maxCPU, ws.maxMemory = ws.CgroupManager.ContainerLimits()
+
+	var err error
+	if ws.Config.MaxCPULimit != "" {
+		if ws.maxCPU, err = utils.ParseCPU(ws.Config.MaxCPULimit); err != nil {
+			return fmt.Errorf("invalid MAX_CPU_LIMIT: %v", err)
+		}
+	}
+	if ws.Config.MaxMemoryLimit != "" {
+		if ws.maxMemory, err = utils.ParseMemory(ws.Config.MaxMemoryLimit); err != nil {
+			return fmt.Errorf("invalid MAX_MEMORY_LIMIT: %v", err)
+		}
+	}
+
+	slog.Info("Capping invocation limits", "max_cpu", ws.maxCPU, "max_memory", ws.maxMemory)
+	return nil
+}
+
 func (ws *WebServer) Start() {
 	rand.Seed(uint64(time.Now().UnixNano()))
 	ws.MemUtilizationWindow = list.New()
+
+	http.Handle("/", ws.router())
+	if err := http.ListenAndServe(ws.Config.Host+":"+strconv.Itoa(ws.Config.Port), nil); err != nil {
+		slog.Error("Failed to start Server", "reason", err)
+	}
+}
+
+func (ws *WebServer) router() *mux.Router {
 	router := mux.NewRouter()
 
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(ws.requireAdminToken)
+	admin.HandleFunc("/functions", ws.HandleListFunctions).Methods("GET")
+	admin.HandleFunc("/functions/{name}", ws.HandleGetFunction).Methods("GET")
+	admin.HandleFunc("/functions/{name}", ws.HandlePutFunction).Methods("PUT")
+	admin.HandleFunc("/functions/{name}", ws.HandleDeleteFunction).Methods("DELETE")
+	admin.HandleFunc("/functions/{name}/stats", ws.HandleFunctionStats).Methods("GET")
+	admin.HandleFunc("/functions/{name}/inspect", ws.HandleInspectFunction).Methods("GET")
+	admin.HandleFunc("/functions/{name}/manifest", ws.HandleGetManifest).Methods("GET")
+	admin.HandleFunc("/functions/{name}/manifest", ws.HandlePutManifest).Methods("PUT")
+	admin.HandleFunc("/functions/{name}/manifest", ws.HandleDeleteManifest).Methods("DELETE")
+	admin.HandleFunc("/functions/{name}/aliases/{alias}", ws.HandleSetAlias).Methods("PUT")
+	admin.HandleFunc("/functions/{name}/aliases/{alias}", ws.HandleDeleteAlias).Methods("DELETE")
+	admin.HandleFunc("/functions/{name}/aliases/{alias}/rollback", ws.HandleRollbackAlias).Methods("POST")
+	admin.HandleFunc("/schedules", ws.HandleListSchedules).Methods("GET")
+	admin.HandleFunc("/shadow", ws.HandleShadowStats).Methods("GET")
+	admin.HandleFunc("/reloads", ws.HandleReloadStats).Methods("GET")
+	admin.HandleFunc("/invocations", ws.HandleListInvocations).Methods("GET")
+	admin.HandleFunc("/invocations/{request_id}/checkpoint", ws.HandleCheckpointInvocation).Methods("POST")
+	admin.HandleFunc("/checkpoints", ws.HandleListCheckpoints).Methods("GET")
+	admin.HandleFunc("/checkpoints/{checkpoint_id}", ws.HandleDeleteCheckpoint).Methods("DELETE")
+	admin.HandleFunc("/checkpoints/{checkpoint_id}/resume", ws.HandleResumeCheckpoint).Methods("POST")
+	router.HandleFunc("/jobs/{job_id}", ws.HandleJobStatus).Methods("GET")
+	router.HandleFunc("/async/{wasm_file}", ws.HandleAsync).Methods("GET", "POST")
 	router.HandleFunc("/{wasm_file}", ws.HandleGet).Methods("GET")
 	router.HandleFunc("/{wasm_file}", ws.HandlePost).Methods("POST")
 
-	http.Handle("/", router)
-	if err := http.ListenAndServe(ws.Config.Host+":"+strconv.Itoa(ws.Config.Port), nil); err != nil {
-		slog.Error("Failed to start Server", "reason", err)
-	}
+	return router
 }
 
 func (ws *WebServer) HandleGet(w http.ResponseWriter, req *http.Request) {
@@ -79,6 +177,31 @@ func (ws *WebServer) HandlePost(w http.ResponseWriter, req *http.Request) {
 	atomic.AddInt32(&ws.CurrentRequests, 1)
 	defer atomic.AddInt32(&ws.CurrentRequests, -1)
 
+	// Call HandleRequest() with provided WASM parameter
+	if wasmParam, ok := ws.readParameter(w, req); ok {
+		ws.HandleRequest(w, req, wasmParam)
+	}
+}
+
+// readParameter reads the WASM parameter of a POST request. Functions declaring request
+// content types read the raw body, which must have one of them, instead of a JSON
+// parameter. Requests with other content types are answered with 415 and false.
+func (ws *WebServer) readParameter(w http.ResponseWriter, req *http.Request) (string, bool) {
+	name, _, _ := strings.Cut(mux.Vars(req)["wasm_file"], "@")
+	if manifest, err := ws.FunctionRegistry.Manifest(name); err == nil && len(manifest.ContentTypes.Request) > 0 {
+		if !acceptsContentType(manifest.ContentTypes.Request, req.Header.Get("Content-Type")) {
+			http.Error(w, "Unsupported content type, expected one of "+strings.Join(manifest.ContentTypes.Request, ", "), http.StatusUnsupportedMediaType)
+			return "", false
+		}
+
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return "", false
+		}
+		return string(body), true
+	}
+
 	var requestBody PostRequestBody
 
 	// Decode the JSON body into the struct
@@ -86,9 +209,29 @@ func (ws *WebServer) HandlePost(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		slog.Debug("Invalid/Empty request body", "reason", err)
 	}
+	return requestBody.Parameter, true
+}
 
-	// Call HandleRequest() with provided WASM parameter
-	ws.HandleRequest(w, req, requestBody.Parameter)
+// responseContentType is the content type declared for the output of a function.
+func (ws *WebServer) responseContentType(name string) string {
+	if manifest, err := ws.FunctionRegistry.Manifest(name); err == nil && manifest.ContentTypes.Response != "" {
+		return manifest.ContentTypes.Response
+	}
+	return "text/plain"
+}
+
+func acceptsContentType(accepted []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, acceptedType := range accepted {
+		if acceptedMediaType, _, err := mime.ParseMediaType(acceptedType); err == nil && acceptedMediaType == mediaType {
+			return true
+		}
+	}
+	return false
 }
 
 func (ws *WebServer) HandleRequest(w http.ResponseWriter, req *http.Request, wasmParam string) {
@@ -100,27 +243,52 @@ func (ws *WebServer) HandleRequest(w http.ResponseWriter, req *http.Request, was
 	requestID := uuid.New().String()
 	wasmFile := mux.Vars(req)["wasm_file"]
 
-	cpuLimit := "1000"
-	memLimit := "1000"
-
-	// Check validity of the request
-	if !ws.IsValidRequest(req.Header) {
-		// w.WriteHeader(http.StatusBadRequest)
-		slog.Info("Invalid request, not specified resources", "handler_id", handlerID, "wasm_file", wasmFile)
-		// w.Write([]byte("Invalid request\n"))
-
-		// beforeLock := time.Now()
-		// runtime.UnlockOSThread()
-		// slog.Debug("Unlocked OS thread", "time", time.Since(beforeLock))
-		// return
+	// Unrequested resources come from the function's manifest or the defaults
+	requested, err := requestedLimits(req.Header)
+	if err != nil {
+		runtime.UnlockOSThread()
+		slog.Info("Invalid resource request", "handler_id", handlerID, "wasm_file", wasmFile, "reason", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	var finalWasmOutput string
 	var finalStatus int
 
-	wasmOutput, timesData, err := ws.HandleThreadExecution(handlerID, requestID, wasmFile, cpuLimit, memLimit, wasmParam)
+	// Route sticky requests before execution, and tell the client which version served it
+	responseContentType := "text/plain"
+	if function, err := ws.FunctionRegistry.ResolveRequest(wasmFile, req.Header.Get); err == nil {
+		wasmFile = function.Ref()
+		w.Header().Set(FunctionVersionHeader, wasmFile)
+		responseContentType = ws.responseContentType(function.Name)
+	}
 
-	if err != nil {
+	seed := req.Header.Get(DeterministicSeedHeader)
+	wasmOutput, timesData, err := ws.HandleThreadExecution(handlerID, requestID, wasmFile, requested.Memory, requested.CPU, wasmParam, requested.Timeout, seed)
+
+	var checkpointed *CheckpointedError
+	if errors.As(err, &checkpointed) {
+		slog.Info("Invocation was checkpointed", "request_id", requestID, "checkpoint_id", checkpointed.Metadata.ID)
+		w.Header().Set(CheckpointIDHeader, checkpointed.Metadata.ID)
+		finalStatus, finalWasmOutput = http.StatusServiceUnavailable, "Invocation was checkpointed\n"
+	} else if errors.Is(err, function_registry.ErrNotFound) || errors.Is(err, function_registry.ErrInvalidName) {
+		slog.Info("Unknown function", "wasm_file", wasmFile)
+		finalStatus, finalWasmOutput = http.StatusNotFound, "Function not found\n"
+	} else if errors.Is(err, function_registry.ErrInvalidLimit) {
+		finalStatus, finalWasmOutput = http.StatusBadRequest, err.Error()+"\n"
+	} else if errors.Is(err, signature.ErrUnsigned) || errors.Is(err, signature.ErrInvalidSignature) {
+		slog.Warn("Refused to run unverified module", "wasm_file", wasmFile, "reason", err)
+		finalStatus, finalWasmOutput = http.StatusForbidden, err.Error()+"\n"
+	} else if errors.Is(err, capabilities.ErrUndeclared) {
+		slog.Warn("Refused to run module importing an undeclared capability", "wasm_file", wasmFile, "reason", err)
+		finalStatus, finalWasmOutput = http.StatusForbidden, err.Error()+"\n"
+	} else if errors.Is(err, scratch.ErrQuotaExceeded) {
+		slog.Info("Invocation exceeded its scratch quota", "request_id", requestID, "wasm_file", wasmFile)
+		finalStatus, finalWasmOutput = http.StatusInsufficientStorage, err.Error()+"\n"
+	} else if errors.Is(err, ErrInvocationTimeout) {
+		slog.Info("Invocation timed out", "request_id", requestID, "wasm_file", wasmFile)
+		finalStatus, finalWasmOutput = http.StatusGatewayTimeout, "Invocation timed out\n"
+	} else if err != nil {
 		slog.Error("Failed to run WASM thread", "reason", err)
 		finalStatus, finalWasmOutput = http.StatusInternalServerError, "Failed to run WASM module\n"
 	} else {
@@ -131,20 +299,168 @@ func (ws *WebServer) HandleRequest(w http.ResponseWriter, req *http.Request, was
 	runtime.UnlockOSThread()
 	slog.Debug("Unlocked OS thread", "time", time.Since(beforeLock))
 	slog.Debug("Done with a request", "handler_id", handlerID, "request_id", requestID, "time", time.Since(start))
-	w.Header().Set("Content-Type", "text/plain")
 	for key, value := range timesData {
 		w.Header().Set(key, value)
 	}
 
+	// Declared response content types get the output as it is
+	if finalStatus == http.StatusOK && responseContentType != "text/plain" {
+		w.Header().Set("Content-Type", responseContentType)
+		w.WriteHeader(finalStatus)
+		w.Write([]byte(strings.TrimRight(finalWasmOutput, "\x00")))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(finalStatus)
 	w.Write([]byte(fmt.Sprintf("WASM output: %s", strings.TrimRight(finalWasmOutput, "\x00"))))
 }
 
-func (ws *WebServer) IsValidRequest(headers http.Header) bool {
-	return headers.Get("cpu_quota") != "" && headers.Get("Memory-Request") != ""
+// requestedLimits reads the resources requested with Kubernetes quantities such as
+// "500m" or "2" CPUs and "256Mi" or "1Gi" of memory, and the requested timeout.
+func requestedLimits(header http.Header) (function_registry.Limits, error) {
+	var limits function_registry.Limits
+
+	if value := header.Get(CPUQuotaHeader); value != "" {
+		millicores, err := utils.ParseCPU(value)
+		if err != nil {
+			return limits, fmt.Errorf("%w: %s header: %v", function_registry.ErrInvalidLimit, CPUQuotaHeader, err)
+		}
+		limits.CPU = strconv.Itoa(millicores)
+	}
+
+	if value := header.Get(MemoryRequestHeader); value != "" {
+		mebibytes, err := utils.ParseMemory(value)
+		if err != nil {
+			return limits, fmt.Errorf("%w: %s header: %v", function_registry.ErrInvalidLimit, MemoryRequestHeader, err)
+		}
+		limits.Memory = strconv.Itoa(mebibytes)
+	}
+
+	if value := header.Get(FunctionTimeoutHeader); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return limits, fmt.Errorf("%w: %s header: %q is not a positive duration such as 10s", function_registry.ErrInvalidLimit, FunctionTimeoutHeader, value)
+		}
+		limits.Timeout = timeout
+	}
+
+	return limits, nil
+}
+
+// Execute runs a WASM module outside of an HTTP handler (e.g. for scheduled runs),
+// locking the calling goroutine to its OS thread so it can be moved into a cgroup.
+func (ws *WebServer) Execute(wasmFile, cpuLimit, memLimit, wasmParam string) (string, map[string]string, error) {
+	return ws.ExecuteJob(wasmFile, cpuLimit, memLimit, wasmParam, 0, "")
+}
+
+// ExecuteJob runs an async job like Execute, with the timeout and seed it was requested with.
+func (ws *WebServer) ExecuteJob(wasmFile, cpuLimit, memLimit, wasmParam string, timeout time.Duration, seed string) (string, map[string]string, error) {
+	atomic.AddInt32(&ws.CurrentRequests, 1)
+	defer atomic.AddInt32(&ws.CurrentRequests, -1)
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	handlerID := strconv.Itoa(syscall.Gettid())
+	requestID := uuid.New().String()
+
+	return ws.HandleThreadExecution(handlerID, requestID, wasmFile, memLimit, cpuLimit, wasmParam, timeout, seed)
+}
+
+// HandleThreadExecution runs a function with the requested limits, completed and capped
+// by its manifest. Empty limits and a zero timeout are not requested. A seed makes the
+// invocation deterministic.
+func (ws *WebServer) HandleThreadExecution(handlerID, requestID, wasmFile, memLimit, cpuLimit, wasmModuleParam string, timeout time.Duration, seed string) (string, map[string]string, error) {
+	defer ws.FunctionRegistry.Acquire(wasmFile)()
+
+	// Pin the version once, so traffic splits are only applied here
+	function, err := ws.FunctionRegistry.Resolve(wasmFile)
+	if err != nil {
+		return "", nil, err
+	}
+
+	runtimeName, err := ws.functionRuntime(function)
+	if err != nil {
+		return "", nil, err
+	}
+
+	limits, err := ws.functionLimits(function, function_registry.Limits{CPU: cpuLimit, Memory: memLimit, Timeout: timeout})
+	if err != nil {
+		return "", nil, err
+	}
+	cpuLimit, memLimit = limits.CPU, limits.Memory
+
+	start := time.Now()
+	var enforcedTimeout time.Duration
+	output, timesData, err := ws.executeInCgroup(handlerID, requestID, memLimit, cpuLimit, func() WasmThreadResult {
+		result := ws.RunWasmThread(runtimeName, handlerID, requestID, function.Ref(), wasmModuleParam, memLimit, limits.Timeout, seed)
+		enforcedTimeout = result.Timeout
+		return result
+	})
+	duration := time.Since(start)
+
+	// Only report the timeout if the runtime could enforce it
+	limits.Timeout = enforcedTimeout
+	setEffectiveLimits(timesData, limits)
+
+	var checkpointed *CheckpointedError
+	if !errors.As(err, &checkpointed) {
+		ws.FunctionRegistry.Record(function, duration, err != nil)
+
+		if ws.Shadow.Sample() {
+			shadowRuntime := otherRuntime(runtimeName)
+			if kind, kindErr := module_compiler.DetectKind(function.Path); kindErr != nil || !module_compiler.CanRun(kind, shadowRuntime) {
+				// Native artifacts only run on the runtime they were compiled for
+				ws.Shadow.Unsupported(function.Ref())
+			} else {
+				primary := shadow.Result{Runtime: runtimeName, Output: output, Err: err, Duration: duration}
+				ws.Shadow.Submit(primary, shadowRuntime, function.Ref(), cpuLimit, memLimit, wasmModuleParam, seed)
+			}
+		}
+	}
+
+	return output, timesData, err
+}
+
+// ExecuteShadow runs a shadow invocation on the given runtime. It gets its own cgroup
+// with a low CPU weight, so it only uses CPU time primary invocations leave idle, and
+// it is neither counted as a current request nor checkpointable. It is deterministic
+// when the shadowed invocation was.
+func (ws *WebServer) ExecuteShadow(runtimeName, wasmFile, cpuLimit, memLimit, wasmParam, seed string) (string, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	handlerID := strconv.Itoa(syscall.Gettid())
+	requestID := shadowRequestPrefix + uuid.New().String()
+
+	defer ws.FunctionRegistry.Acquire(wasmFile)()
+
+	function, err := ws.FunctionRegistry.Resolve(wasmFile)
+	if err != nil {
+		return "", err
+	}
+
+	// The module may have been replaced since it was sampled
+	if kind, err := module_compiler.DetectKind(function.Path); err != nil || !module_compiler.CanRun(kind, runtimeName) {
+		return "", fmt.Errorf("%w: %s", shadow.ErrUnsupported, runtimeName)
+	}
+
+	limits, err := ws.functionLimits(function, function_registry.Limits{CPU: cpuLimit, Memory: memLimit})
+	if err != nil {
+		return "", err
+	}
+
+	output, _, err := ws.executeInCgroup(handlerID, requestID, limits.Memory, limits.CPU, func() WasmThreadResult {
+		ws.CgroupManager.SetCgroupWeight(requestID, ws.Shadow.Config.ShadowCPUWeight)
+		return ws.RunWasmThread(runtimeName, handlerID, requestID, wasmFile, wasmParam, limits.Memory, limits.Timeout, seed)
+	})
+
+	return output, err
 }
 
-func (ws *WebServer) HandleThreadExecution(handlerID, requestID, wasmFile, memLimit, cpuLimit, wasmModuleParam string) (string, map[string]string, error) {
+// executeInCgroup runs "run" on the calling thread inside a dedicated cgroup.
+func (ws *WebServer) executeInCgroup(handlerID, requestID, memLimit, cpuLimit string, run func() WasmThreadResult) (string, map[string]string, error) {
 	// Acquire a cgorup with according cpu/memory resource limits
 	beforeCgroupCreateTime := time.Now()
 	ws.CgroupManager.Acquire(requestID, cpuLimit, memLimit)
@@ -157,11 +473,14 @@ func (ws *WebServer) HandleThreadExecution(handlerID, requestID, wasmFile, memLi
 
 	// Run WASM thread
 	beforeExecutionTime := time.Now()
-	wasmThreadOutput := ws.RunWasmThread(handlerID, requestID, wasmFile, wasmModuleParam, memLimit)
+	wasmThreadOutput := run()
 	executionTime := time.Since(beforeExecutionTime)
 
 	// Delete the cgroup after the execution
 	ws.CgroupManager.Release(requestID)
+	if ws.Scratch != nil {
+		ws.Scratch.Release(requestID)
+	}
 
 	timesData := map[string]string{
 		"Cgroup-Creation-Time": strconv.FormatInt(cgroupCreationTime.Milliseconds(), 10),
@@ -193,17 +512,151 @@ func (ws *WebServer) LoadModule(filePath string) ([]byte, error) {
 	return bytes, nil
 }
 
-func (ws *WebServer) RunWasmThread(handlerID, requestID, wasmFile string, wasmModuleParam string, maxMemory string) WasmThreadResult {
-	if ws.Config.WasmRuntime == "wasmtime" {
-		return ws.RunWasmtime(handlerID, requestID, wasmFile, wasmModuleParam, maxMemory)
-	} else if ws.Config.WasmRuntime == "wasmedge" {
-		return ws.RunWasmedge(handlerID, requestID, wasmFile, wasmModuleParam, maxMemory)
-	} else {
-		return ws.RunWasmtime(handlerID, requestID, wasmFile, wasmModuleParam, maxMemory)
+func (ws *WebServer) RunWasmThread(runtimeName, handlerID, requestID, wasmFile string, wasmModuleParam string, maxMemory string, timeout time.Duration, seed string) WasmThreadResult {
+	if runtimeName == module_compiler.RuntimeWasmedge {
+		// WasmEdge can not be interrupted, so the timeout is not enforced
+		return ws.RunWasmedge(handlerID, requestID, wasmFile, wasmModuleParam, maxMemory, seed)
+	}
+	return ws.RunWasmtime(handlerID, requestID, wasmFile, wasmModuleParam, maxMemory, timeout, seed)
+}
+
+// deterministicSource returns the clocks and randomness of an invocation run with seed,
+// or nil for invocations that are not deterministic.
+func deterministicSource(seed string) *determinism.Source {
+	if seed == "" {
+		return nil
+	}
+	return determinism.New(seed)
+}
+
+// setEffectiveLimits reports the limits an invocation ran with, in Kubernetes quantities.
+func setEffectiveLimits(headers map[string]string, limits function_registry.Limits) {
+	if cpu, err := strconv.Atoi(limits.CPU); err == nil {
+		headers[EffectiveCPULimitHeader] = utils.FormatCPU(cpu)
+	}
+	if memory, err := strconv.Atoi(limits.Memory); err == nil {
+		headers[EffectiveMemoryLimitHeader] = utils.FormatMemory(memory)
+	}
+	if limits.Timeout > 0 {
+		headers[EffectiveTimeoutHeader] = limits.Timeout.String()
+	}
+}
+
+// wasiEnv returns the environment variables of a manifest, including the secrets it
+// puts in the environment, sorted by name.
+func wasiEnv(manifest config.FunctionManifest, functionSecrets secrets.Secrets) ([]string, []string) {
+	env := make(map[string]string, len(manifest.WASI.Env)+len(manifest.Secrets))
+	for key, value := range manifest.WASI.Env {
+		env[key] = value
+	}
+	for _, secret := range manifest.Secrets {
+		if secret.Env != "" {
+			env[secret.Env] = string(functionSecrets[secret.Name])
+		}
+	}
+
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, env[key])
+	}
+	return keys, values
+}
+
+// readSecrets reads the secrets a manifest declares.
+func (ws *WebServer) readSecrets(manifest config.FunctionManifest) (secrets.Secrets, error) {
+	if len(manifest.Secrets) == 0 {
+		return secrets.Secrets{}, nil
+	}
+	if ws.Secrets == nil {
+		return nil, secrets.ErrDisabled
 	}
+	return ws.Secrets.Read(manifest.Secrets)
 }
 
-func (ws *WebServer) RunWasmtime(handlerID, requestID, wasmFile string, wasmModuleParam string, maxMemory string) WasmThreadResult {
+// preopens returns the directories to preopen for a manifest, which are its data mounts.
+// The scratch directory is preopened separately.
+func (ws *WebServer) preopens(manifest config.FunctionManifest) ([]config.PreopenManifest, error) {
+	return ws.FunctionRegistry.DataMounts(manifest)
+}
+
+// scratchDir creates the scratch directory of an invocation whose manifest enables one,
+// and returns nil otherwise. It is removed once the invocation's cgroup is released.
+func (ws *WebServer) scratchDir(requestID string, manifest config.FunctionManifest, onExceeded func()) (*scratch.Dir, error) {
+	if !manifest.WASI.Scratch.Enabled {
+		return nil, nil
+	}
+	if ws.Scratch == nil {
+		return nil, errors.New("scratch directories are not configured")
+	}
+
+	// Manifests are validated when they are loaded
+	quota := 0
+	if manifest.WASI.Scratch.Quota != "" {
+		quota, _ = utils.ParseMemory(manifest.WASI.Scratch.Quota)
+	}
+	return ws.Scratch.Create(requestID, quota, onExceeded)
+}
+
+// functionLimits applies a function's manifest to the limits requested for an invocation.
+func (ws *WebServer) functionLimits(function function_registry.Resolved, requested function_registry.Limits) (function_registry.Limits, error) {
+	manifest, err := ws.FunctionRegistry.Manifest(function.Name)
+	if err != nil {
+		return function_registry.Limits{}, err
+	}
+
+	limits, err := function_registry.EffectiveLimits(manifest, requested, function_registry.Limits{CPU: DefaultCPULimit, Memory: DefaultMemoryLimit})
+	if err != nil {
+		return limits, err
+	}
+	limits.CPU, limits.Memory = capLimit(limits.CPU, ws.maxCPU), capLimit(limits.Memory, ws.maxMemory)
+	return limits, nil
+}
+
+// capLimit lowers a limit in millicores or MiB to maxValue, unless maxValue is zero.
+func capLimit(value string, maxValue int) string {
+	if quantity, err := strconv.Atoi(value); err == nil && maxValue > 0 && quantity > maxValue {
+		return strconv.Itoa(maxValue)
+	}
+	return value
+}
+
+// functionRuntime returns the runtime declared for or detected from a function, and the
+// runtime configured by WASM_RUNTIME (Wasmtime if unset) for modules that run on both.
+func (ws *WebServer) functionRuntime(function function_registry.Resolved) (string, error) {
+	runtimeName, _, err := ws.FunctionRegistry.Runtime(function)
+	if err != nil || runtimeName != "" {
+		return runtimeName, err
+	}
+
+	if ws.Config.WasmRuntime == module_compiler.RuntimeWasmedge {
+		return module_compiler.RuntimeWasmedge, nil
+	}
+	return module_compiler.RuntimeWasmtime, nil
+}
+
+// otherRuntime is the runtime shadow invocations of runtimeName are compared against.
+func otherRuntime(runtimeName string) string {
+	if runtimeName == module_compiler.RuntimeWasmtime {
+		return module_compiler.RuntimeWasmedge
+	}
+	return module_compiler.RuntimeWasmtime
+}
+
+func (ws *WebServer) RunWasmtime(handlerID, requestID, wasmFile string, wasmModuleParam string, maxMemory string, timeout time.Duration, seed string) WasmThreadResult {
+	return ws.runWasmtime(handlerID, requestID, wasmFile, wasmModuleParam, maxMemory, timeout, seed, nil)
+}
+
+// runWasmtime executes "wasmFile" from its entrypoint ("_start" by default), or from the
+// resume export when continuing a checkpointed invocation. It is interrupted after timeout
+// unless timeout is zero or the artifact was compiled without epoch interruption, and
+// deterministic when seed is set.
+func (ws *WebServer) runWasmtime(handlerID, requestID, wasmFile string, wasmModuleParam string, maxMemory string, timeout time.Duration, seed string, resume *checkpoint.Checkpoint) (result WasmThreadResult) {
 	// Use Wasmtime to execute "wasmFile"
 	slog.Info("Start WASM thread", "handler_id", strconv.Itoa(syscall.Gettid()), "memory_limit", maxMemory)
 	dir, err := os.MkdirTemp("", "out")
@@ -220,27 +673,58 @@ func (ws *WebServer) RunWasmtime(handlerID, requestID, wasmFile string, wasmModu
 		return WasmThreadResult{Output: "", Err: err}
 	}
 
-	_, err = stdin.WriteString(wasmModuleParam)
+	if resume != nil {
+		_, err = stdin.Write(resume.Stdin)
+	} else {
+		_, err = stdin.WriteString(wasmModuleParam)
+	}
 	if err != nil {
 		return WasmThreadResult{Output: "", Err: err}
 	}
 
 	defer stdin.Close()
 
-	engine := wasmtime.NewEngine()
+	function, err := ws.FunctionRegistry.Resolve(wasmFile)
+	if err != nil {
+		return WasmThreadResult{Output: "", Err: err}
+	}
+	manifest, err := ws.FunctionRegistry.Manifest(function.Name)
+	if err != nil {
+		return WasmThreadResult{Output: "", Err: err}
+	}
+	modulePath := function.Path
+	artifactPath, err := ws.ModuleCompiler.Artifact(modulePath, module_compiler.RuntimeWasmtime)
+	if err != nil {
+		return WasmThreadResult{Output: "", Err: err}
+	}
+
+	// Precompiled artifacts built without epoch interruption can not be interrupted
+	epochInterruption, err := ws.ModuleCompiler.EpochInterruption(artifactPath)
+	if err != nil {
+		return WasmThreadResult{Output: "", Err: err}
+	}
+	engine := ws.NewWasmtimeEngine(epochInterruption)
 
-	slog.Debug("Loaded engine", "handler_id", strconv.Itoa(syscall.Gettid()), "memory_limit", maxMemory)
+	slog.Debug("Loaded engine", "handler_id", strconv.Itoa(syscall.Gettid()), "memory_limit", maxMemory, "epoch_interruption", epochInterruption)
 
 	beforeModuleCreation := time.Now()
-	module, err := wasmtime.NewModuleDeserializeFile(engine, filepath.Join("functions", wasmFile))
+	module, err := wasmtime.NewModuleDeserializeFile(engine, artifactPath)
 	if err != nil {
 		return WasmThreadResult{Output: "", Err: err}
 	}
 	slog.Debug("Created module", "handler_id", strconv.Itoa(syscall.Gettid()), "memory_limit", maxMemory, "time", time.Since(beforeModuleCreation))
 
-	// Create a linker with WASI functions defined within it
+	// Create a linker with only the imports of the function's capabilities
+	granted := capabilities.Granted(manifest.Capabilities)
+	if err := capabilities.Check(wasmtimeImports(module), granted); err != nil {
+		return WasmThreadResult{Output: "", Err: err}
+	}
+	functionSecrets, err := ws.readSecrets(manifest)
+	if err != nil {
+		return WasmThreadResult{Output: "", Err: err}
+	}
 	linker := wasmtime.NewLinker(engine)
-	err = linker.DefineWasi()
+	err = capabilities.DefineWasmtime(linker, granted, capabilities.Host{Secrets: functionSecrets, Deterministic: deterministicSource(seed)})
 	if err != nil {
 		return WasmThreadResult{Output: "", Err: err}
 	}
@@ -248,6 +732,28 @@ func (ws *WebServer) RunWasmtime(handlerID, requestID, wasmFile string, wasmModu
 	wasiConfig := wasmtime.NewWasiConfig()
 	wasiConfig.SetStdoutFile(stdoutPath)
 	wasiConfig.SetStdinFile(stdinPath)
+	wasiConfig.SetArgv(append([]string{function.Name}, manifest.WASI.Args...))
+	envKeys, envValues := wasiEnv(manifest, functionSecrets)
+	wasiConfig.SetEnv(envKeys, envValues)
+	preopens, err := ws.preopens(manifest)
+	if err != nil {
+		return WasmThreadResult{Output: "", Err: err}
+	}
+	for _, preopen := range preopens {
+		if err := wasiConfig.PreopenDir(preopen.HostPath, preopen.GuestPath); err != nil {
+			return WasmThreadResult{Output: "", Err: fmt.Errorf("failed to preopen %s: %v", preopen.HostPath, err)}
+		}
+	}
+	// Going over the scratch quota interrupts the invocation like a timeout
+	scratchDir, err := ws.scratchDir(requestID, manifest, engine.IncrementEpoch)
+	if err != nil {
+		return WasmThreadResult{Output: "", Err: err}
+	}
+	if scratchDir != nil {
+		if err := wasiConfig.PreopenDir(scratchDir.Path, scratch.GuestPath); err != nil {
+			return WasmThreadResult{Output: "", Err: fmt.Errorf("failed to preopen the scratch directory: %v", err)}
+		}
+	}
 	store := wasmtime.NewStore(engine)
 	store.SetWasi(wasiConfig)
 
@@ -259,10 +765,81 @@ func (ws *WebServer) RunWasmtime(handlerID, requestID, wasmFile string, wasmModu
 		return WasmThreadResult{Output: "", Err: err}
 	}
 
+	// Any epoch increment interrupts the invocation at its next epoch check
+	if epochInterruption {
+		store.SetEpochDeadline(1)
+	}
+
+	var timedOut atomic.Bool
+	if timeout > 0 && epochInterruption {
+		timer := time.AfterFunc(timeout, func() {
+			timedOut.Store(true)
+			engine.IncrementEpoch()
+		})
+		defer timer.Stop()
+		defer func() { result.Timeout = timeout }()
+	}
+
+	// Track the invocation so it can be checkpointed, unless it is deterministic: its
+	// clocks and randomness would not be restored when resuming
+	var invocation *checkpoint.Invocation
+	if ws.CheckpointManager.Enabled() && !strings.HasPrefix(requestID, shadowRequestPrefix) && seed == "" {
+
+		// Modules without the resume export could only be restarted from _start, so they
+		// are refused checkpoints from the start
+		var interrupter checkpoint.Interrupter
+		if epochInterruption && instance.GetFunc(store, ws.CheckpointManager.Config.ResumeExport) != nil {
+			interrupter = engine
+		}
+		// Pin the version, so resuming does not follow aliases that moved in the meantime
+		invocation = ws.CheckpointManager.Register(requestID, function.Ref(), interrupter)
+		defer ws.CheckpointManager.Unregister(invocation)
+	}
+
+	entrypoint := "_start"
+	if manifest.Entrypoint != "" {
+		entrypoint = manifest.Entrypoint
+	}
+	if resume != nil {
+		// Without the export, the restored memory would be run from _start again
+		if instance.GetFunc(store, ws.CheckpointManager.Config.ResumeExport) == nil {
+			return WasmThreadResult{Output: "", Err: fmt.Errorf("%w %s", checkpoint.ErrNotResumable, ws.CheckpointManager.Config.ResumeExport)}
+		}
+		err = ws.restoreCheckpoint(modulePath, &wasmtimeInstance{store: store, module: module, instance: instance}, resume)
+		if err != nil {
+			return WasmThreadResult{Output: "", Err: err}
+		}
+		entrypoint = ws.CheckpointManager.Config.ResumeExport
+	} else if initFunc := instance.GetFunc(store, ws.Config.SnapshotInitExport); ws.Config.EnableSnapshots && initFunc != nil {
+		if snapshottable(manifest, seed) {
+			// Restore the pre-initialized state instead of re-running the init export
+			err = ws.applySnapshot(modulePath, manifest, &wasmtimeInstance{store: store, module: module, instance: instance}, func() (snapshot.Instance, func(), error) {
+				return ws.initWasmtime(engine, module, function.Name, manifest, maxMemory, epochInterruption)
+			})
+		} else {
+			_, err = initFunc.Call(store)
+		}
+		if err != nil {
+			return WasmThreadResult{Output: "", Err: err}
+		}
+	}
+
 	// Run the function
 	beforeCall := time.Now()
-	nom := instance.GetFunc(store, "_start")
+	nom := instance.GetFunc(store, entrypoint)
+	if nom == nil {
+		return WasmThreadResult{Output: "", Err: fmt.Errorf("module does not export %s", entrypoint)}
+	}
 	_, err = nom.Call(store)
+	if err != nil && invocation != nil && ws.CheckpointManager.Requested(invocation) {
+		return ws.saveCheckpoint(invocation, modulePath, maxMemory, &wasmtimeInstance{store: store, module: module, instance: instance}, stdinPath, stdoutPath, resume)
+	}
+	if scratchDir != nil && scratchDir.Err() != nil {
+		return WasmThreadResult{Output: "", Err: scratchDir.Err()}
+	}
+	if err != nil && timedOut.Load() {
+		return WasmThreadResult{Output: "", Err: fmt.Errorf("%w of %s", ErrInvocationTimeout, timeout)}
+	}
 	if err != nil {
 		return WasmThreadResult{Output: "", Err: err}
 	}
@@ -277,26 +854,91 @@ func (ws *WebServer) RunWasmtime(handlerID, requestID, wasmFile string, wasmModu
 
 	slog.Debug("Executed WASM function", "handler_id", strconv.Itoa(syscall.Gettid()), "memory_limit", maxMemory)
 
+	if resume != nil {
+		out = append(resume.Stdout, out...)
+	}
+
 	return WasmThreadResult{Output: string(out) + "\n", Err: nil}
 }
 
-func (ws *WebServer) RunWasmedge(handlerID, requestID, wasmFile string, wasmModuleParam string, maxMemory string) WasmThreadResult {
+func (ws *WebServer) RunWasmedge(handlerID, requestID, wasmFile string, wasmModuleParam string, maxMemory string, seed string) WasmThreadResult {
 	wasmedge.SetLogErrorLevel()
 
-	conf := wasmedge.NewConfigure(wasmedge.WASI)
+	function, err := ws.FunctionRegistry.Resolve(wasmFile)
+	var manifest config.FunctionManifest
+	if err == nil {
+		manifest, err = ws.FunctionRegistry.Manifest(function.Name)
+	}
+
+	var functionSecrets secrets.Secrets
+	if err == nil {
+		functionSecrets, err = ws.readSecrets(manifest)
+	}
+
+	envKeys, envValues := wasiEnv(manifest, functionSecrets)
+	envs := make([]string, 0, len(envKeys))
+	for i, key := range envKeys {
+		envs = append(envs, key+"="+envValues[i])
+	}
+	var preopens []string
+	if err == nil {
+		var manifestPreopens []config.PreopenManifest
+		manifestPreopens, err = ws.preopens(manifest)
+		for _, preopen := range manifestPreopens {
+			preopens = append(preopens, preopen.GuestPath+":"+preopen.HostPath)
+		}
+	}
+
+	// WasmEdge can not be interrupted, so going over the scratch quota fails the
+	// invocation once it returns
+	var scratchDir *scratch.Dir
+	if err == nil {
+		scratchDir, err = ws.scratchDir(requestID, manifest, nil)
+	}
+	if scratchDir != nil {
+		preopens = append(preopens, scratch.GuestPath+":"+scratchDir.Path)
+	}
+
+	host := capabilities.Host{
+		WASI: capabilities.WasmedgeWASI{
+			Args:     append([]string{function.Name}, manifest.WASI.Args...),
+			Env:      envs,
+			Preopens: preopens,
+		},
+		Secrets:       functionSecrets,
+		Deterministic: deterministicSource(seed),
+	}
+
+	// Only the host modules of the function's capabilities are registered
+	granted := capabilities.Granted(manifest.Capabilities)
+	conf := capabilities.NewWasmedgeConfigure(granted, host)
 	conf.SetMaxMemoryPage(uint(getMemoryInWasmPages(maxMemory)))
 	slog.Debug("Max memory is configured", "max value (Wasm pages)", getMemoryInWasmPages(maxMemory))
 
 	vm := wasmedge.NewVMWithConfig(conf)
 
-	var wasi = vm.GetImportModule(wasmedge.WASI)
-	wasi.InitWasi(
-		nil,
-		nil,
-		nil,
-	)
+	// Host modules are released after the VM, which is released before returning
+	if err == nil {
+		var releaseHostModules func()
+		releaseHostModules, err = capabilities.RegisterWasmedge(vm, granted, host)
+		defer releaseHostModules()
+	}
+
+	modulePath, artifactPath := function.Path, ""
+	if err == nil {
+		artifactPath, err = ws.ModuleCompiler.Artifact(modulePath, module_compiler.RuntimeWasmedge)
+	}
+	if err == nil {
+		err = ws.checkCapabilities(modulePath, granted)
+	}
+	if err != nil {
+		slog.Error("Failed to prepare WASM artifact", "reason", err.Error())
+		vm.Release()
+		conf.Release()
+		return WasmThreadResult{Output: "", Err: err}
+	}
 
-	err := vm.LoadWasmFile(filepath.Join("functions", wasmFile))
+	err = vm.LoadWasmFile(artifactPath)
 	if err != nil {
 		slog.Error("Load WASM from file failed.", "reason", err.Error())
 		vm.Release()
@@ -315,7 +957,33 @@ func (ws *WebServer) RunWasmedge(handlerID, requestID, wasmFile string, wasmModu
 	bg := bindgen.New(vm)
 	bg.Instantiate()
 
-	res, _, err := bg.Execute("_main")
+	if activeModule := vm.GetActiveModule(); ws.Config.EnableSnapshots && activeModule.FindFunction(ws.Config.SnapshotInitExport) != nil {
+		if snapshottable(manifest, seed) {
+			// Restore the pre-initialized state instead of re-running the init export
+			err = ws.applySnapshot(modulePath, manifest, &wasmedgeInstance{module: activeModule}, func() (snapshot.Instance, func(), error) {
+				return ws.initWasmedge(artifactPath, function.Name, manifest, maxMemory)
+			})
+		} else {
+			_, err = vm.Execute(ws.Config.SnapshotInitExport)
+		}
+		if err != nil {
+			slog.Error("Snapshot failed", "reason", err.Error())
+			bg.Release()
+			vm.Release()
+			conf.Release()
+			return WasmThreadResult{Output: "", Err: err}
+		}
+	}
+
+	entrypoint := "_main"
+	if manifest.Entrypoint != "" {
+		entrypoint = manifest.Entrypoint
+	}
+
+	res, _, err := bg.Execute(entrypoint)
+	if err == nil && scratchDir != nil {
+		err = scratchDir.Err()
+	}
 	if err != nil {
 		slog.Error("Run failed", "reason", err.Error())
 		bg.Release()
@@ -337,7 +1005,19 @@ func (ws *WebServer) RunWasmedgePreAlloc(handlerID, requestID, wasmFile string,
 	maxMemoryInt, _ := strconv.Atoi(maxMemory)
 	preallocatedSize := int32(float64(maxMemoryInt) * ws.Config.MemPreAllocationRatio)
 
-	conf := wasmedge.NewConfigure(wasmedge.WASI)
+	function, err := ws.FunctionRegistry.Resolve(wasmFile)
+	var manifest config.FunctionManifest
+	if err == nil {
+		manifest, err = ws.FunctionRegistry.Manifest(function.Name)
+	}
+	var functionSecrets secrets.Secrets
+	if err == nil {
+		functionSecrets, err = ws.readSecrets(manifest)
+	}
+	host := capabilities.Host{Secrets: functionSecrets}
+
+	granted := capabilities.Granted(manifest.Capabilities)
+	conf := capabilities.NewWasmedgeConfigure(granted, host)
 	conf.SetMaxMemoryPage(uint(getMemoryInWasmPages(maxMemory)))
 	slog.Debug("Memory is configured", "max_value (Wasm pages)", getMemoryInWasmPages(maxMemory), "preallocated_size (mb)", preallocatedSize)
 	// defer conf.Release()
@@ -345,14 +1025,28 @@ func (ws *WebServer) RunWasmedgePreAlloc(handlerID, requestID, wasmFile string,
 	vm := wasmedge.NewVMWithConfig(conf)
 	// defer vm.Release()
 
-	var wasi = vm.GetImportModule(wasmedge.WASI)
-	wasi.InitWasi(
-		nil,
-		nil,
-		nil,
-	)
+	// Host modules are released after the VM, which is released before returning
+	if err == nil {
+		var releaseHostModules func()
+		releaseHostModules, err = capabilities.RegisterWasmedge(vm, granted, host)
+		defer releaseHostModules()
+	}
+
+	// The module is loaded from the content that was verified, not its file
+	var module []byte
+	if err == nil {
+		module, err = ws.ModuleCompiler.Read(function.Path)
+	}
+	if err == nil {
+		err = ws.checkCapabilities(function.Path, granted)
+	}
+	if err != nil {
+		vm.Release()
+		conf.Release()
+		return WasmThreadResult{Output: "", Err: err}
+	}
 
-	err := vm.LoadWasmFile(filepath.Join("functions", wasmFile))
+	err = vm.LoadWasmBuffer(module)
 	if err != nil {
 		slog.Error("Load WASM from file failed.", "reason", err.Error())
 		vm.Release()
@@ -426,6 +1120,27 @@ func (ws *WebServer) RunWasmedgePreAlloc(handlerID, requestID, wasmFile string,
 	return WasmThreadResult{Output: output.String(), Err: err}
 }
 
+// checkCapabilities refuses modules importing from capabilities that were not granted.
+func (ws *WebServer) checkCapabilities(modulePath string, granted []string) error {
+	imports, _, err := ws.ModuleCompiler.Interface(modulePath)
+	if err != nil {
+		return err
+	}
+	return capabilities.Check(imports, granted)
+}
+
+func wasmtimeImports(module *wasmtime.Module) []wasm_binary.Import {
+	imports := make([]wasm_binary.Import, 0, len(module.Imports()))
+	for _, imp := range module.Imports() {
+		name := ""
+		if imp.Name() != nil {
+			name = *imp.Name()
+		}
+		imports = append(imports, wasm_binary.Import{Module: imp.Module(), Name: name})
+	}
+	return imports
+}
+
 func getMemoryInBytes(memory string) int64 {
 	maxMemoryInt, err := strconv.Atoi(memory)
 	if err != nil {
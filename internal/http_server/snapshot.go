@@ -0,0 +1,344 @@
+package http_server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"time"
+	"webserver/internal/capabilities"
+	"webserver/internal/config"
+	"webserver/internal/snapshot"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+	"github.com/second-state/WasmEdge-go/wasmedge"
+)
+
+// snapshottable reports whether an invocation of a function restores and captures
+// snapshots, or runs the init export on its own instance instead. Functions declaring
+// secrets are not snapshotted, as init could copy them into the memory written to the
+// functions volume. Deterministic invocations are not either, since the snapshot was
+// initialized with real clocks and randomness.
+func snapshottable(manifest config.FunctionManifest, seed string) bool {
+	return len(manifest.Secrets) == 0 && seed == ""
+}
+
+// snapshotManifestHash hashes the manifest settings the init export runs with, so that
+// changing them takes the snapshot again.
+func snapshotManifestHash(manifest config.FunctionManifest) string {
+	data, _ := json.Marshal(struct {
+		Args         []string
+		Env          map[string]string
+		Capabilities []string
+	}{manifest.WASI.Args, manifest.WASI.Env, capabilities.Granted(manifest.Capabilities)})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// applySnapshot restores the module's snapshot into a fresh instance. If there is no
+// valid snapshot yet, initInstance runs the init export in an instance of its own, which
+// only has the manifest's arguments, environment and capabilities, so the snapshot of it
+// holds no state of the invocation that happened to take it.
+func (ws *WebServer) applySnapshot(modulePath string, manifest config.FunctionManifest, instance snapshot.Instance, initInstance func() (snapshot.Instance, func(), error)) error {
+	moduleHash, err := snapshot.ModuleHash(modulePath)
+	if err != nil {
+		return err
+	}
+	manifestHash := snapshotManifestHash(manifest)
+
+	snapPath := snapshot.Path(modulePath)
+	snap, err := snapshot.Load(snapPath, moduleHash, manifestHash)
+	if err == nil {
+		beforeRestore := time.Now()
+		err = snap.Restore(instance)
+		slog.Debug("Restored snapshot", "module", modulePath, "time", time.Since(beforeRestore))
+		return err
+	}
+
+	if errors.Is(err, snapshot.ErrStale) {
+		slog.Info("Snapshot is stale, re-initializing", "module", modulePath)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to load snapshot, re-initializing", "module", modulePath, "reason", err)
+	}
+
+	beforeInit := time.Now()
+	initialized, release, err := initInstance()
+	if err != nil {
+		return fmt.Errorf("init export %s failed: %v", ws.Config.SnapshotInitExport, err)
+	}
+	defer release()
+	initTime := time.Since(beforeInit)
+
+	snap, err = snapshot.Capture(initialized, moduleHash, manifestHash, ws.Config.SnapshotInitExport)
+	if err != nil {
+		return err
+	}
+	if err := snap.Restore(instance); err != nil {
+		return err
+	}
+
+	// The instance is already initialized, so failing to persist only costs future invocations.
+	if err := snapshot.Save(snapPath, snap); err != nil {
+		slog.Error("Failed to save snapshot", "module", modulePath, "reason", err)
+	} else {
+		slog.Info("Created snapshot", "module", modulePath, "pages", len(snap.Pages), "globals", len(snap.Globals), "init_time", initTime)
+	}
+
+	return nil
+}
+
+// initWasmtime instantiates module with only the arguments, environment and capabilities
+// of its manifest, and runs its init export. The instance has no stdio, preopens, secrets
+// or deterministic clocks.
+func (ws *WebServer) initWasmtime(engine *wasmtime.Engine, module *wasmtime.Module, functionName string, manifest config.FunctionManifest, maxMemory string, epochInterruption bool) (snapshot.Instance, func(), error) {
+	linker := wasmtime.NewLinker(engine)
+	if err := capabilities.DefineWasmtime(linker, capabilities.Granted(manifest.Capabilities), capabilities.Host{}); err != nil {
+		return nil, nil, err
+	}
+
+	wasiConfig := wasmtime.NewWasiConfig()
+	wasiConfig.SetArgv(append([]string{functionName}, manifest.WASI.Args...))
+	envKeys, envValues := wasiEnv(manifest, nil)
+	wasiConfig.SetEnv(envKeys, envValues)
+	store := wasmtime.NewStore(engine)
+	store.SetWasi(wasiConfig)
+	store.Limiter(getMemoryInBytes(maxMemory), -1, 1, -1, 1)
+
+	instance, err := linker.Instantiate(store, module)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The engine is the invocation's, so its timeout also interrupts init
+	if epochInterruption {
+		store.SetEpochDeadline(1)
+	}
+
+	initFunc := instance.GetFunc(store, ws.Config.SnapshotInitExport)
+	if initFunc == nil {
+		return nil, nil, fmt.Errorf("module does not export %s", ws.Config.SnapshotInitExport)
+	}
+	if _, err := initFunc.Call(store); err != nil {
+		return nil, nil, err
+	}
+
+	return &wasmtimeInstance{store: store, module: module, instance: instance}, func() {}, nil
+}
+
+// initWasmedge is initWasmtime on WasmEdge. The returned function releases the VM once
+// the instance was captured.
+func (ws *WebServer) initWasmedge(artifactPath, functionName string, manifest config.FunctionManifest, maxMemory string) (snapshot.Instance, func(), error) {
+	envKeys, envValues := wasiEnv(manifest, nil)
+	envs := make([]string, 0, len(envKeys))
+	for i, key := range envKeys {
+		envs = append(envs, key+"="+envValues[i])
+	}
+	host := capabilities.Host{
+		WASI: capabilities.WasmedgeWASI{
+			Args: append([]string{functionName}, manifest.WASI.Args...),
+			Env:  envs,
+		},
+	}
+
+	granted := capabilities.Granted(manifest.Capabilities)
+	conf := capabilities.NewWasmedgeConfigure(granted, host)
+	conf.SetMaxMemoryPage(uint(getMemoryInWasmPages(maxMemory)))
+	vm := wasmedge.NewVMWithConfig(conf)
+
+	releaseHostModules, err := capabilities.RegisterWasmedge(vm, granted, host)
+	release := func() {
+		vm.Release()
+		conf.Release()
+		releaseHostModules()
+	}
+	if err == nil {
+		err = vm.LoadWasmFile(artifactPath)
+	}
+	if err == nil {
+		err = vm.Validate()
+	}
+	if err == nil {
+		err = vm.Instantiate()
+	}
+	if err == nil {
+		_, err = vm.Execute(ws.Config.SnapshotInitExport)
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	return &wasmedgeInstance{module: vm.GetActiveModule()}, release, nil
+}
+
+type wasmtimeInstance struct {
+	store    *wasmtime.Store
+	module   *wasmtime.Module
+	instance *wasmtime.Instance
+}
+
+func (wi *wasmtimeInstance) memory() (*wasmtime.Memory, error) {
+	export := wi.instance.GetExport(wi.store, "memory")
+	if export == nil || export.Memory() == nil {
+		return nil, errors.New("module does not export its memory")
+	}
+	return export.Memory(), nil
+}
+
+func (wi *wasmtimeInstance) Memory() ([]byte, error) {
+	mem, err := wi.memory()
+	if err != nil {
+		return nil, err
+	}
+	return mem.UnsafeData(wi.store), nil
+}
+
+func (wi *wasmtimeInstance) GrowMemory(pages uint64) error {
+	mem, err := wi.memory()
+	if err != nil {
+		return err
+	}
+
+	current := mem.Size(wi.store)
+	if pages > current {
+		_, err = mem.Grow(wi.store, pages-current)
+	}
+	return err
+}
+
+func (wi *wasmtimeInstance) Globals() ([]snapshot.Global, error) {
+	var globals []snapshot.Global
+	for _, export := range wi.module.Exports() {
+		globalType := export.Type().GlobalType()
+		if globalType == nil || !globalType.Mutable() {
+			continue
+		}
+
+		val := wi.instance.GetExport(wi.store, export.Name()).Global().Get(wi.store)
+		global := snapshot.Global{Name: export.Name()}
+		switch val.Kind() {
+		case wasmtime.KindI32:
+			global.Type, global.Bits = "i32", uint64(uint32(val.I32()))
+		case wasmtime.KindI64:
+			global.Type, global.Bits = "i64", uint64(val.I64())
+		case wasmtime.KindF32:
+			global.Type, global.Bits = "f32", uint64(math.Float32bits(val.F32()))
+		case wasmtime.KindF64:
+			global.Type, global.Bits = "f64", math.Float64bits(val.F64())
+		default:
+			return nil, fmt.Errorf("unsupported type of global %s", export.Name())
+		}
+		globals = append(globals, global)
+	}
+
+	return globals, nil
+}
+
+func (wi *wasmtimeInstance) SetGlobal(global snapshot.Global) error {
+	export := wi.instance.GetExport(wi.store, global.Name)
+	if export == nil || export.Global() == nil {
+		return errors.New("global is not exported")
+	}
+
+	var val wasmtime.Val
+	switch global.Type {
+	case "i32":
+		val = wasmtime.ValI32(int32(uint32(global.Bits)))
+	case "i64":
+		val = wasmtime.ValI64(int64(global.Bits))
+	case "f32":
+		val = wasmtime.ValF32(math.Float32frombits(uint32(global.Bits)))
+	case "f64":
+		val = wasmtime.ValF64(math.Float64frombits(global.Bits))
+	default:
+		return fmt.Errorf("unsupported global type %s", global.Type)
+	}
+
+	return export.Global().Set(wi.store, val)
+}
+
+type wasmedgeInstance struct {
+	module *wasmedge.Module
+}
+
+func (wi *wasmedgeInstance) memory() (*wasmedge.Memory, error) {
+	mem := wi.module.FindMemory("memory")
+	if mem == nil {
+		return nil, errors.New("module does not export its memory")
+	}
+	return mem, nil
+}
+
+func (wi *wasmedgeInstance) Memory() ([]byte, error) {
+	mem, err := wi.memory()
+	if err != nil {
+		return nil, err
+	}
+	return mem.GetData(0, mem.GetPageSize()*snapshot.WasmPageSize)
+}
+
+func (wi *wasmedgeInstance) GrowMemory(pages uint64) error {
+	mem, err := wi.memory()
+	if err != nil {
+		return err
+	}
+
+	current := uint64(mem.GetPageSize())
+	if pages > current {
+		return mem.GrowPage(uint(pages - current))
+	}
+	return nil
+}
+
+func (wi *wasmedgeInstance) Globals() ([]snapshot.Global, error) {
+	var globals []snapshot.Global
+	for _, name := range wi.module.ListGlobal() {
+		g := wi.module.FindGlobal(name)
+		if g.GetGlobalType().GetMutability() != wasmedge.ValMut_Var {
+			continue
+		}
+
+		global := snapshot.Global{Name: name}
+		switch val := g.GetValue().(type) {
+		case int32:
+			global.Type, global.Bits = "i32", uint64(uint32(val))
+		case int64:
+			global.Type, global.Bits = "i64", uint64(val)
+		case float32:
+			global.Type, global.Bits = "f32", uint64(math.Float32bits(val))
+		case float64:
+			global.Type, global.Bits = "f64", math.Float64bits(val)
+		default:
+			return nil, fmt.Errorf("unsupported type of global %s", name)
+		}
+		globals = append(globals, global)
+	}
+
+	return globals, nil
+}
+
+func (wi *wasmedgeInstance) SetGlobal(global snapshot.Global) error {
+	g := wi.module.FindGlobal(global.Name)
+	if g == nil {
+		return errors.New("global is not exported")
+	}
+
+	switch global.Type {
+	case "i32":
+		g.SetValue(int32(uint32(global.Bits)))
+	case "i64":
+		g.SetValue(int64(global.Bits))
+	case "f32":
+		g.SetValue(math.Float32frombits(uint32(global.Bits)))
+	case "f64":
+		g.SetValue(math.Float64frombits(global.Bits))
+	default:
+		return fmt.Errorf("unsupported global type %s", global.Type)
+	}
+
+	return nil
+}
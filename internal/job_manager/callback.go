@@ -0,0 +1,140 @@
+package job_manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrUnsignedCallbacks refuses callbacks while there is no secret to sign webhooks
+	// with, since receivers could not tell them from forged ones.
+	ErrUnsignedCallbacks = errors.New("callbacks are disabled, WEBHOOK_SECRET is not set")
+	// ErrForbiddenCallback is returned for callbacks to addresses that are not public,
+	// such as loopback, private networks or the cloud metadata endpoint, unless their
+	// host is in WEBHOOK_ALLOWED_HOSTS.
+	ErrForbiddenCallback = errors.New("callback URL resolves to a forbidden address")
+)
+
+const resolveTimeout = 5 * time.Second
+
+// Ranges that are not covered by the netip.Addr predicates but must not be reachable
+var forbiddenPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// publicAddress reports whether addr can be the destination of a callback.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range forbiddenPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (jm *JobManager) allowedHost(host string) bool {
+	return slices.ContainsFunc(jm.Config.WebhookAllowedHosts, func(allowed string) bool {
+		return strings.EqualFold(allowed, host)
+	})
+}
+
+func (jm *JobManager) ValidateCallbackURL(callbackURL string) error {
+	if callbackURL == "" {
+		return nil
+	}
+	if jm.Config.WebhookSecret == "" {
+		return ErrUnsignedCallbacks
+	}
+
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("callback URL must be an absolute http(s) URL")
+	}
+	if u.User != nil {
+		return errors.New("callback URL must not contain credentials")
+	}
+	if jm.allowedHost(u.Hostname()) {
+		return nil
+	}
+
+	// Rejects obviously forbidden callbacks early, the addresses are checked again when
+	// connecting since DNS answers can change
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return fmt.Errorf("failed to resolve callback host: %v", err)
+	}
+	for _, addr := range addrs {
+		if !publicAddress(addr) {
+			return fmt.Errorf("%w: %s", ErrForbiddenCallback, addr)
+		}
+	}
+
+	return nil
+}
+
+// newWebhookClient returns a client that only connects to public addresses, except for
+// the hosts of WEBHOOK_ALLOWED_HOSTS. Checking the address being dialed also covers
+// redirects and DNS answers that changed since the callback URL was validated.
+func (jm *JobManager) newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	publicDialer := &net.Dialer{
+		Timeout:   dialer.Timeout,
+		KeepAlive: dialer.KeepAlive,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddress(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", ErrForbiddenCallback, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would make the dialed address meaningless
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if jm.allowedHost(host) {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return publicDialer.DialContext(ctx, network, address)
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(jm.Config.WebhookTimeoutMS) * time.Millisecond,
+	}
+}
@@ -0,0 +1,195 @@
+package job_manager
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+	"webserver/internal/config"
+
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+type WebhookStatus string
+
+const (
+	WebhookNone      WebhookStatus = ""
+	WebhookPending   WebhookStatus = "pending"
+	WebhookDelivered WebhookStatus = "delivered"
+	WebhookFailed    WebhookStatus = "failed"
+)
+
+// Executor runs a single invocation and returns its output and timing headers. A zero
+// timeout is not requested, and a seed makes the invocation deterministic.
+type Executor func(wasmFile, cpuLimit, memLimit, wasmParam string, timeout time.Duration, seed string) (string, map[string]string, error)
+
+type DeliveryAttempt struct {
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type Job struct {
+	ID            string            `json:"job_id"`
+	WasmFile      string            `json:"wasm_file"`
+	Status        JobStatus         `json:"status"`
+	Output        string            `json:"output,omitempty"`
+	ContentType   string            `json:"content_type,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	TimesData     map[string]string `json:"times,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	StartedAt     time.Time         `json:"started_at"`
+	FinishedAt    time.Time         `json:"finished_at"`
+	CallbackURL   string            `json:"callback_url,omitempty"`
+	WebhookStatus WebhookStatus     `json:"webhook_status,omitempty"`
+	Deliveries    []DeliveryAttempt `json:"deliveries,omitempty"`
+
+	cpuLimit  string
+	memLimit  string
+	wasmParam string
+	timeout   time.Duration
+	seed      string
+}
+
+// ErrQueueFull is returned when JOB_QUEUE_SIZE jobs are already waiting for a worker.
+var ErrQueueFull = errors.New("job queue is full")
+
+// JobManager runs jobs on JOB_WORKERS workers, from a queue of at most JOB_QUEUE_SIZE
+// jobs, so that a burst of async requests can not start an unbounded number of
+// invocations.
+type JobManager struct {
+	Config   *config.JobManagerConfig
+	Executor Executor
+	client   *http.Client
+	queue    chan *Job
+	jobs     map[string]*Job
+	mu       sync.Mutex
+}
+
+func (jm *JobManager) Init() {
+	jm.jobs = make(map[string]*Job)
+	jm.client = jm.newWebhookClient()
+	jm.queue = make(chan *Job, jm.Config.JobQueueSize)
+	for range jm.Config.JobWorkers {
+		go jm.worker()
+	}
+}
+
+func (jm *JobManager) worker() {
+	for job := range jm.queue {
+		jm.run(job)
+	}
+}
+
+// Submit queues an invocation and returns a snapshot of the created job, or ErrQueueFull.
+// The job is run with the same limits, timeout and seed as a synchronous invocation, and
+// contentType is the content type of its output.
+func (jm *JobManager) Submit(wasmFile, cpuLimit, memLimit, wasmParam string, timeout time.Duration, seed, callbackURL, contentType string) (Job, error) {
+	job := &Job{
+		ID:          uuid.New().String(),
+		WasmFile:    wasmFile,
+		Status:      JobQueued,
+		CreatedAt:   time.Now(),
+		CallbackURL: callbackURL,
+		ContentType: contentType,
+		cpuLimit:    cpuLimit,
+		memLimit:    memLimit,
+		wasmParam:   wasmParam,
+		timeout:     timeout,
+		seed:        seed,
+	}
+	if callbackURL != "" {
+		job.WebhookStatus = WebhookPending
+	}
+
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	// Workers wait for the lock before running the job, so it is registered first
+	select {
+	case jm.queue <- job:
+	default:
+		return Job{}, ErrQueueFull
+	}
+
+	jm.pruneLocked()
+	jm.jobs[job.ID] = job
+	slog.Debug("Submitted async job", "job_id", job.ID, "wasm_file", wasmFile)
+
+	return job.copyLocked(), nil
+}
+
+func (jm *JobManager) Get(jobID string) (Job, bool) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	job, ok := jm.jobs[jobID]
+	if !ok {
+		return Job{}, false
+	}
+
+	return job.copyLocked(), true
+}
+
+func (jm *JobManager) run(job *Job) {
+	jm.mu.Lock()
+	job.Status = JobRunning
+	job.StartedAt = time.Now()
+	jm.mu.Unlock()
+
+	output, timesData, err := jm.Executor(job.WasmFile, job.cpuLimit, job.memLimit, job.wasmParam, job.timeout, job.seed)
+
+	jm.mu.Lock()
+	job.FinishedAt = time.Now()
+	job.TimesData = timesData
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = JobSucceeded
+		job.Output = output
+	}
+	job.wasmParam = ""
+	jm.mu.Unlock()
+
+	slog.Info("Finished async job", "job_id", job.ID, "status", job.Status, "time", job.FinishedAt.Sub(job.StartedAt))
+
+	if job.CallbackURL != "" {
+		jm.deliverWebhook(job)
+	}
+}
+
+// pruneLocked drops finished jobs older than the retention period.
+func (jm *JobManager) pruneLocked() {
+	retention := time.Duration(jm.Config.JobRetentionSec) * time.Second
+	for id, job := range jm.jobs {
+		finished := job.Status == JobSucceeded || job.Status == JobFailed
+		if finished && job.WebhookStatus != WebhookPending && time.Since(job.FinishedAt) > retention {
+			delete(jm.jobs, id)
+		}
+	}
+}
+
+func (job *Job) copyLocked() Job {
+	snapshot := *job
+	snapshot.Deliveries = append([]DeliveryAttempt(nil), job.Deliveries...)
+	if job.TimesData != nil {
+		snapshot.TimesData = make(map[string]string, len(job.TimesData))
+		for key, value := range job.TimesData {
+			snapshot.TimesData[key] = value
+		}
+	}
+
+	return snapshot
+}
@@ -0,0 +1,136 @@
+package job_manager
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-WasmBox-Signature"
+	TimestampHeader = "X-WasmBox-Timestamp"
+	JobIDHeader     = "X-WasmBox-Job-ID"
+)
+
+type WebhookPayload struct {
+	JobID       string            `json:"job_id"`
+	WasmFile    string            `json:"wasm_file"`
+	Status      JobStatus         `json:"status"`
+	Output      string            `json:"output,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	StartedAt   time.Time         `json:"started_at"`
+	FinishedAt  time.Time         `json:"finished_at"`
+	DurationMS  int64             `json:"duration_ms"`
+	TimesData   map[string]string `json:"times,omitempty"`
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of "<timestamp>.<body>".
+// Receivers should recompute it with the shared secret and compare in constant time.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (jm *JobManager) deliverWebhook(job *Job) {
+	jm.mu.Lock()
+	payload := WebhookPayload{
+		JobID:       job.ID,
+		WasmFile:    job.WasmFile,
+		Status:      job.Status,
+		Output:      job.Output,
+		ContentType: job.ContentType,
+		Error:       job.Error,
+		CreatedAt:   job.CreatedAt,
+		StartedAt:   job.StartedAt,
+		FinishedAt:  job.FinishedAt,
+		DurationMS:  job.FinishedAt.Sub(job.StartedAt).Milliseconds(),
+		TimesData:   job.TimesData,
+	}
+	jm.mu.Unlock()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to marshal webhook payload", "job_id", job.ID, "reason", err)
+		jm.setWebhookStatus(job, WebhookFailed)
+		return
+	}
+
+	delay := time.Duration(jm.Config.WebhookRetryDelayMS) * time.Millisecond
+	maxDelay := time.Duration(jm.Config.WebhookMaxRetryDelayMS) * time.Millisecond
+
+	for attempt := 1; attempt <= jm.Config.WebhookMaxRetries+1; attempt++ {
+		statusCode, err := jm.postWebhook(job, body)
+
+		record := DeliveryAttempt{Attempt: attempt, Time: time.Now(), StatusCode: statusCode}
+		if err != nil {
+			record.Error = err.Error()
+		}
+
+		jm.mu.Lock()
+		job.Deliveries = append(job.Deliveries, record)
+		jm.mu.Unlock()
+
+		if err == nil {
+			slog.Debug("Delivered webhook", "job_id", job.ID, "attempt", attempt)
+			jm.setWebhookStatus(job, WebhookDelivered)
+			return
+		}
+
+		slog.Info("Failed to deliver webhook", "job_id", job.ID, "attempt", attempt, "reason", err)
+		if attempt > jm.Config.WebhookMaxRetries {
+			break
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+
+	slog.Error("Gave up delivering webhook", "job_id", job.ID, "callback_url", job.CallbackURL)
+	jm.setWebhookStatus(job, WebhookFailed)
+}
+
+func (jm *JobManager) postWebhook(job *Job, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(JobIDHeader, job.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, "sha256="+Sign(jm.Config.WebhookSecret, timestamp, body))
+
+	resp, err := jm.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+func (jm *JobManager) setWebhookStatus(job *Job, status WebhookStatus) {
+	jm.mu.Lock()
+	job.WebhookStatus = status
+	jm.mu.Unlock()
+}
@@ -0,0 +1,245 @@
+package module_compiler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"webserver/internal/wasm_binary"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+	"github.com/second-state/WasmEdge-go/wasmedge"
+)
+
+const (
+	wasmtimeModulePath    = "github.com/bytecodealliance/wasmtime-go/v24"
+	wasmtimeEngineSection = ".wasmtime.engine"
+	engineFile            = "engine.json"
+)
+
+var ErrIncompatible = errors.New("artifact was compiled for an incompatible engine")
+
+// Engine identifies everything a compiled artifact depends on. Artifacts are only
+// shared between pods whose engines have the same fingerprint.
+type Engine struct {
+	Runtime           string   `json:"runtime"`
+	Version           string   `json:"version"`
+	Arch              string   `json:"arch"`
+	CPUFeatures       []string `json:"cpu_features"`
+	EpochInterruption bool     `json:"epoch_interruption"`
+	Fingerprint       string   `json:"fingerprint"`
+
+	// wasmtimeSection is the .wasmtime.engine section this engine writes into serialized
+	// modules. It encodes the Wasmtime version and the compiler settings.
+	wasmtimeSection []byte
+}
+
+func (mc *ModuleCompiler) wasmtimeEngine(epochInterruption bool) (*Engine, error) {
+	engine := mc.NewWasmtimeEngine(epochInterruption)
+
+	// Serializing an empty module is the only way to learn what the engine
+	// requires from the artifacts it deserializes.
+	module, err := wasmtime.NewModule(engine, append(append([]byte{}, wasm_binary.Magic...), wasm_binary.Version...))
+	if err != nil {
+		return nil, err
+	}
+
+	serialized, err := module.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	section, err := readWasmtimeSection(serialized)
+	if err != nil {
+		return nil, err
+	}
+
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == wasmtimeModulePath {
+				version = dep.Version
+			}
+		}
+	}
+
+	return newEngine(RuntimeWasmtime, version, epochInterruption, section), nil
+}
+
+func (mc *ModuleCompiler) wasmedgeEngine() *Engine {
+	return newEngine(RuntimeWasmedge, wasmedge.GetVersion(), false, nil)
+}
+
+func newEngine(runtimeName, version string, epochInterruption bool, wasmtimeSection []byte) *Engine {
+	engine := &Engine{
+		Runtime:           runtimeName,
+		Version:           version,
+		Arch:              runtime.GOARCH,
+		CPUFeatures:       cpuFeatures(),
+		EpochInterruption: epochInterruption,
+		wasmtimeSection:   wasmtimeSection,
+	}
+
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "%s\x00%s\x00%s\x00%s\x00%t\x00", engine.Runtime, engine.Version, engine.Arch, strings.Join(engine.CPUFeatures, " "), engine.EpochInterruption)
+	hasher.Write(wasmtimeSection)
+	engine.Fingerprint = hex.EncodeToString(hasher.Sum(nil))[:16]
+
+	return engine
+}
+
+// cpuFeatures returns the sorted CPU flags of the first processor in /proc/cpuinfo.
+func cpuFeatures() []string {
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		// x86 calls them flags, arm64 features
+		key = strings.TrimSpace(key)
+		if key == "flags" || key == "Features" {
+			features := strings.Fields(value)
+			sort.Strings(features)
+			return features
+		}
+	}
+
+	return nil
+}
+
+func readWasmtimeSection(data []byte) ([]byte, error) {
+	elfFile, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer elfFile.Close()
+
+	return wasmtimeSectionOf(elfFile)
+}
+
+func wasmtimeSectionOf(elfFile *elf.File) ([]byte, error) {
+	section := elfFile.Section(wasmtimeEngineSection)
+	if section == nil {
+		return nil, fmt.Errorf("missing %s section", wasmtimeEngineSection)
+	}
+	return section.Data()
+}
+
+// cacheDir is where artifacts compiled by engine are stored, one file per module hash.
+func (mc *ModuleCompiler) cacheDir(engine *Engine) string {
+	return filepath.Join(mc.Config.ArtifactCacheDir, engine.Runtime, engine.Fingerprint)
+}
+
+func (mc *ModuleCompiler) initCacheDir(engine *Engine) error {
+	dir := mc.cacheDir(engine)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// Describes the engine to operators browsing the cache
+	data, err := json.MarshalIndent(engine, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(filepath.Join(dir, engineFile), func(path string) error {
+		return os.WriteFile(path, data, 0644)
+	})
+}
+
+// writeAtomic lets write create a temporary file next to path and renames it into place,
+// so pods sharing the directory never observe partially written files.
+func writeAtomic(path string, write func(tmpPath string) error) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".tmp-*-"+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpPath)
+
+	if err := write(tmpPath); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// checkArtifact makes sure engine can load the artifact at path, so that incompatible
+// or corrupted artifacts are reported as errors instead of being handed to the runtime.
+func checkArtifact(path string, engine *Engine) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	switch engine.Runtime {
+	case RuntimeWasmtime:
+		elfFile, err := elf.Open(path)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrIncompatible, err)
+		}
+		defer elfFile.Close()
+
+		section, err := wasmtimeSectionOf(elfFile)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrIncompatible, err)
+		}
+		if !bytes.Equal(section, engine.wasmtimeSection) {
+			return fmt.Errorf("%w: Wasmtime version or settings differ", ErrIncompatible)
+		}
+
+	case RuntimeWasmedge:
+		kind, err := DetectKind(path)
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case KindWasmedgeAOT:
+			// WasmEdge checks the embedded AOT code itself and falls back to the interpreter
+		case KindWasmedgeNative:
+			return checkNativeArch(path)
+		default:
+			return fmt.Errorf("%w: not a WasmEdge AOT artifact", ErrIncompatible)
+		}
+	}
+
+	return nil
+}
+
+func checkNativeArch(path string) error {
+	elfFile, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrIncompatible, err)
+	}
+	defer elfFile.Close()
+
+	machines := map[string]elf.Machine{
+		"amd64":   elf.EM_X86_64,
+		"arm64":   elf.EM_AARCH64,
+		"riscv64": elf.EM_RISCV,
+	}
+	if machine, ok := machines[runtime.GOARCH]; ok && elfFile.Machine != machine {
+		return fmt.Errorf("%w: compiled for %s", ErrIncompatible, elfFile.Machine)
+	}
+
+	return nil
+}
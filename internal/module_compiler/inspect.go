@@ -0,0 +1,207 @@
+package module_compiler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"webserver/internal/capabilities"
+	"webserver/internal/wasm_binary"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+)
+
+// Inspection describes a module, and whether the host imports of the capabilities can
+// satisfy its imports.
+type Inspection struct {
+	Kind           ArtifactKind                `json:"kind"`
+	Imports        []InspectedImport           `json:"imports"`
+	Exports        []wasm_binary.TypedExport   `json:"exports"`
+	Memories       []wasm_binary.Memory        `json:"memories"`
+	Tables         []wasm_binary.Table         `json:"tables"`
+	CustomSections []wasm_binary.CustomSection `json:"custom_sections"`
+}
+
+type InspectedImport struct {
+	wasm_binary.TypedImport
+	Satisfiable bool `json:"satisfiable"`
+	// Reason explains why an import is not satisfiable.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Inspect decodes the module at path. Wasmtime-serialized artifacts only expose the
+// memories and tables they import or export and no custom sections, and native WasmEdge
+// artifacts can only be inspected by loading them, so only their kind is reported.
+func (mc *ModuleCompiler) Inspect(path string) (Inspection, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Inspection{}, err
+	}
+
+	kind := DetectKindBytes(data)
+	var moduleType *wasm_binary.ModuleType
+	switch kind {
+	case KindRaw, KindWasmedgeAOT:
+		moduleType, err = wasm_binary.ReadModuleType(data)
+	case KindWasmtime:
+		var module *wasmtime.Module
+		module, err = wasmtime.NewModuleDeserialize(mc.NewWasmtimeEngine(mc.epochInterruption(data)), data)
+		if err == nil {
+			moduleType = wasmtimeModuleType(module)
+		}
+	case KindWasmedgeNative:
+		moduleType = wasm_binary.NewModuleType()
+	default:
+		err = fmt.Errorf("%s is neither a WebAssembly module nor a compiled artifact", filepath.Base(path))
+	}
+	if err != nil {
+		return Inspection{}, err
+	}
+
+	inspection := Inspection{
+		Kind:           kind,
+		Imports:        []InspectedImport{},
+		Exports:        moduleType.Exports,
+		Memories:       moduleType.Memories,
+		Tables:         moduleType.Tables,
+		CustomSections: moduleType.CustomSections,
+	}
+	if len(moduleType.Imports) == 0 {
+		return inspection, nil
+	}
+
+	engine := mc.NewWasmtimeEngine(true)
+	store := wasmtime.NewStore(engine)
+	defer store.Close()
+	linker := wasmtime.NewLinker(engine)
+	defer linker.Close()
+	if err := capabilities.DefineWasmtime(linker, capabilities.Names(), capabilities.Host{}); err != nil {
+		return Inspection{}, err
+	}
+
+	for _, imp := range moduleType.Imports {
+		inspected := InspectedImport{TypedImport: imp}
+		inspected.Reason = unsatisfiedBy(linker, store, imp)
+		inspected.Satisfiable = inspected.Reason == ""
+		inspection.Imports = append(inspection.Imports, inspected)
+	}
+
+	return inspection, nil
+}
+
+// unsatisfiedBy returns why linker can not satisfy imp, or "" if it can.
+func unsatisfiedBy(linker *wasmtime.Linker, store *wasmtime.Store, imp wasm_binary.TypedImport) string {
+	extern := linker.Get(store, imp.Module, imp.Name)
+	if extern == nil {
+		return "not provided by any capability"
+	}
+
+	funcType := extern.Type(store).FuncType()
+	if imp.Func == nil || funcType == nil {
+		return fmt.Sprintf("provided as a %s", externKind(extern.Type(store)))
+	}
+
+	provided := wasmtimeFuncType(funcType)
+	if !slices.Equal(provided.Params, imp.Func.Params) || !slices.Equal(provided.Results, imp.Func.Results) {
+		return fmt.Sprintf("provided with type %s", provided)
+	}
+
+	return ""
+}
+
+func wasmtimeModuleType(module *wasmtime.Module) *wasm_binary.ModuleType {
+	moduleType := wasm_binary.NewModuleType()
+
+	for _, imp := range module.Imports() {
+		name := ""
+		if imp.Name() != nil {
+			name = *imp.Name()
+		}
+
+		externType := wasmtimeExternType(imp.Type())
+		moduleType.Imports = append(moduleType.Imports, wasm_binary.TypedImport{
+			Import:     wasm_binary.Import{Module: imp.Module(), Name: name, Kind: externKind(imp.Type())},
+			ExternType: externType,
+		})
+		if externType.Memory != nil {
+			moduleType.Memories = append(moduleType.Memories, wasm_binary.Memory{Imported: true, Limits: *externType.Memory})
+		}
+		if externType.Table != nil {
+			moduleType.Tables = append(moduleType.Tables, wasm_binary.Table{Imported: true, TableType: *externType.Table})
+		}
+	}
+
+	for _, exp := range module.Exports() {
+		externType := wasmtimeExternType(exp.Type())
+		moduleType.Exports = append(moduleType.Exports, wasm_binary.TypedExport{
+			Export:     wasm_binary.Export{Name: exp.Name(), Kind: externKind(exp.Type())},
+			ExternType: externType,
+		})
+		if externType.Memory != nil {
+			moduleType.Memories = append(moduleType.Memories, wasm_binary.Memory{Limits: *externType.Memory})
+		}
+		if externType.Table != nil {
+			moduleType.Tables = append(moduleType.Tables, wasm_binary.Table{TableType: *externType.Table})
+		}
+	}
+
+	return moduleType
+}
+
+func wasmtimeExternType(externType *wasmtime.ExternType) wasm_binary.ExternType {
+	switch {
+	case externType.FuncType() != nil:
+		funcType := wasmtimeFuncType(externType.FuncType())
+		return wasm_binary.ExternType{Func: &funcType}
+	case externType.TableType() != nil:
+		tableType := externType.TableType()
+		table := wasm_binary.TableType{
+			Element: valueType(tableType.Element()),
+			Limits:  wasm_binary.Limits{Min: uint64(tableType.Minimum())},
+		}
+		if ok, max := tableType.Maximum(); ok {
+			max := uint64(max)
+			table.Max = &max
+		}
+		return wasm_binary.ExternType{Table: &table}
+	case externType.MemoryType() != nil:
+		memoryType := externType.MemoryType()
+		limits := wasm_binary.Limits{Min: memoryType.Minimum(), Memory64: memoryType.Is64()}
+		if ok, max := memoryType.Maximum(); ok {
+			limits.Max = &max
+		}
+		return wasm_binary.ExternType{Memory: &limits}
+	case externType.GlobalType() != nil:
+		globalType := externType.GlobalType()
+		return wasm_binary.ExternType{Global: &wasm_binary.GlobalType{Type: valueType(globalType.Content()), Mutable: globalType.Mutable()}}
+	}
+
+	return wasm_binary.ExternType{}
+}
+
+func wasmtimeFuncType(funcType *wasmtime.FuncType) wasm_binary.FuncType {
+	ft := wasm_binary.FuncType{Params: []string{}, Results: []string{}}
+	for _, param := range funcType.Params() {
+		ft.Params = append(ft.Params, valueType(param))
+	}
+	for _, result := range funcType.Results() {
+		ft.Results = append(ft.Results, valueType(result))
+	}
+	return ft
+}
+
+// kindV128 is WASMTIME_V128, which wasmtime-go has no constant for.
+const kindV128 wasmtime.ValKind = 4
+
+// valueType names a value type like the WebAssembly text format. ValKind.String panics
+// on the kinds wasmtime-go has no constant for.
+func valueType(valType *wasmtime.ValType) string {
+	switch kind := valType.Kind(); kind {
+	case wasmtime.KindI32, wasmtime.KindI64, wasmtime.KindF32, wasmtime.KindF64, wasmtime.KindExternref, wasmtime.KindFuncref:
+		return kind.String()
+	case kindV128:
+		return "v128"
+	default:
+		return fmt.Sprintf("unknown(%d)", kind)
+	}
+}
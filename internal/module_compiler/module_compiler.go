@@ -0,0 +1,531 @@
+package module_compiler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/snapshot"
+	"webserver/internal/utils"
+	"webserver/internal/wasm_binary"
+
+	"github.com/bytecodealliance/wasmtime-go/v24"
+	"github.com/second-state/WasmEdge-go/wasmedge"
+)
+
+const (
+	RuntimeWasmtime = "wasmtime"
+	RuntimeWasmedge = "wasmedge"
+
+	WasmtimeArtifactSuffix = ".cwasm"
+	WasmedgeArtifactSuffix = "_aot.wasm"
+)
+
+type ArtifactKind string
+
+const (
+	// KindRaw is a plain WebAssembly module that still has to be compiled.
+	KindRaw ArtifactKind = "raw"
+	// KindWasmtime is a module serialized by Wasmtime (an ELF object with a .wasmtime.engine section).
+	KindWasmtime ArtifactKind = "wasmtime-serialized"
+	// KindWasmedgeAOT is a WebAssembly module carrying WasmEdge AOT code in its "wasmedge" custom section.
+	KindWasmedgeAOT ArtifactKind = "wasmedge-aot"
+	// KindWasmedgeNative is a WasmEdge AOT shared library.
+	KindWasmedgeNative ArtifactKind = "wasmedge-aot-native"
+	KindUnknown        ArtifactKind = "unknown"
+)
+
+func DetectKind(path string) (ArtifactKind, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return KindUnknown, err
+	}
+
+	return DetectKindBytes(data), nil
+}
+
+func DetectKindBytes(data []byte) ArtifactKind {
+	if wasm_binary.IsWasm(data) {
+		if wasm_binary.HasCustomSection(data, "wasmedge") {
+			return KindWasmedgeAOT
+		}
+		return KindRaw
+	}
+
+	elfFile, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return KindUnknown
+	}
+	defer elfFile.Close()
+
+	if elfFile.Section(".wasmtime.engine") != nil {
+		return KindWasmtime
+	}
+	if elfFile.Type == elf.ET_DYN {
+		return KindWasmedgeNative
+	}
+
+	return KindUnknown
+}
+
+// ValidRuntime reports whether runtime is one WasmBox can execute modules on.
+func ValidRuntime(runtime string) bool {
+	return runtime == RuntimeWasmtime || runtime == RuntimeWasmedge
+}
+
+// CanRun reports whether an artifact of the given kind can be executed by runtime.
+func CanRun(kind ArtifactKind, runtime string) bool {
+	switch kind {
+	case KindRaw:
+		return ValidRuntime(runtime)
+	case KindWasmedgeAOT:
+		// Wasmtime ignores the embedded AOT code and compiles the module itself
+		return ValidRuntime(runtime)
+	case KindWasmtime:
+		return runtime == RuntimeWasmtime
+	case KindWasmedgeNative:
+		return runtime == RuntimeWasmedge
+	}
+	return false
+}
+
+// DetectRuntime picks the runtime the module at path was built for from its format and
+// exports. wasmedge-bindgen modules export "_main", WASI commands export "_start".
+// It returns "" when nothing ties the module to one runtime.
+func DetectRuntime(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	kind := DetectKindBytes(data)
+	switch kind {
+	case KindWasmtime:
+		return RuntimeWasmtime, nil
+	case KindWasmedgeNative:
+		return RuntimeWasmedge, nil
+	case KindUnknown:
+		return "", fmt.Errorf("%s is neither a WebAssembly module nor a compiled artifact", filepath.Base(path))
+	}
+
+	exports, err := wasm_binary.ReadExports(data)
+	if err != nil {
+		return "", err
+	}
+
+	exportsFunc := func(name string) bool {
+		for _, export := range exports {
+			if export.Name == name && export.Kind == wasm_binary.KindFunc {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case exportsFunc("_main"):
+		return RuntimeWasmedge, nil
+	case exportsFunc("_start"):
+		return RuntimeWasmtime, nil
+	case kind == KindWasmedgeAOT:
+		return RuntimeWasmedge, nil
+	}
+
+	return "", nil
+}
+
+// ModuleCompiler turns plain .wasm modules into runtime specific artifacts. Artifacts are
+// stored in a cache shared by all pods and keyed by module hash and engine fingerprint.
+type ModuleCompiler struct {
+	Config *config.ModuleCompilerConfig
+	// NewWasmtimeEngine must return engines configured like the ones running the artifacts.
+	// Modules are compiled with epoch interruption, so their invocations can be interrupted.
+	NewWasmtimeEngine func(epochInterruption bool) *wasmtime.Engine
+	// Verifier refuses modules that must not be compiled or executed, such as unsigned ones.
+	// It is given the content of the module, which is then what gets compiled or loaded,
+	// so replacing the module file after it was verified has no effect.
+	Verifier func(modulePath string, module []byte) error
+	engines  map[string]*Engine
+	// plainWasmtime loads precompiled Wasmtime artifacts built without epoch interruption.
+	plainWasmtime *Engine
+}
+
+func (mc *ModuleCompiler) Init() error {
+	wasmtimeEngine, err := mc.wasmtimeEngine(true)
+	if err != nil {
+		return fmt.Errorf("failed to fingerprint the Wasmtime engine: %v", err)
+	}
+	mc.plainWasmtime, err = mc.wasmtimeEngine(false)
+	if err != nil {
+		return fmt.Errorf("failed to fingerprint the Wasmtime engine: %v", err)
+	}
+
+	mc.engines = map[string]*Engine{
+		RuntimeWasmtime: wasmtimeEngine,
+		RuntimeWasmedge: mc.wasmedgeEngine(),
+	}
+
+	for _, engine := range mc.engines {
+		if err := mc.initCacheDir(engine); err != nil {
+			return err
+		}
+		slog.Info("Using compiled artifact cache", "runtime", engine.Runtime, "version", engine.Version, "dir", mc.cacheDir(engine))
+	}
+
+	return nil
+}
+
+// Read returns the content of the module at modulePath, once the Verifier, if there is
+// one, accepted it.
+func (mc *ModuleCompiler) Read(modulePath string) ([]byte, error) {
+	module, err := os.ReadFile(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	if mc.Verifier != nil {
+		if err := mc.Verifier(modulePath, module); err != nil {
+			return nil, err
+		}
+	}
+	return module, nil
+}
+
+// source is a module to compile. With a Verifier, it is compiled from the content that
+// was verified instead of its file.
+type source struct {
+	path string
+	data []byte
+	hash string
+}
+
+func (mc *ModuleCompiler) source(modulePath string) (*source, error) {
+	if mc.Verifier == nil {
+		hash, err := snapshot.ModuleHash(modulePath)
+		return &source{path: modulePath, hash: hash}, err
+	}
+
+	data, err := mc.Read(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return &source{path: modulePath, data: data, hash: hex.EncodeToString(sum[:])}, nil
+}
+
+func (src *source) kind() (ArtifactKind, error) {
+	if src.data == nil {
+		return DetectKind(src.path)
+	}
+	return DetectKindBytes(src.data), nil
+}
+
+// Artifact returns the path of the artifact of "modulePath" that "runtime" should load,
+// compiling it first if the module is a plain .wasm that is not in the cache yet.
+func (mc *ModuleCompiler) Artifact(modulePath, runtime string) (string, error) {
+	engine, ok := mc.engines[runtime]
+	if !ok {
+		return "", fmt.Errorf("unknown runtime %s", runtime)
+	}
+
+	src, err := mc.source(modulePath)
+	if err != nil {
+		return "", err
+	}
+	kind, err := src.kind()
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case kind == KindRaw, runtime == RuntimeWasmtime && kind == KindWasmedgeAOT:
+		return mc.cached(src, engine)
+	case CanRun(kind, runtime) && src.data != nil:
+		return mc.pinned(src, runtime, engine)
+	case CanRun(kind, runtime):
+		// Uploaded precompiled, so there is nothing to recompile it from
+		if _, err := mc.precompiledEngine(modulePath, runtime); err != nil {
+			return "", fmt.Errorf("%s: %w", filepath.Base(modulePath), err)
+		}
+		return modulePath, nil
+	}
+
+	return "", fmt.Errorf("%s is a %s artifact and can not run on %s", filepath.Base(modulePath), kind, runtime)
+}
+
+// CompileAll compiles a plain .wasm module for every runtime. Other artifacts are left untouched.
+func (mc *ModuleCompiler) CompileAll(modulePath string) error {
+	src, err := mc.source(modulePath)
+	if err != nil {
+		return err
+	}
+
+	kind, err := src.kind()
+	if err != nil {
+		return err
+	}
+	if kind != KindRaw {
+		return nil
+	}
+
+	for _, runtime := range []string{RuntimeWasmtime, RuntimeWasmedge} {
+		if _, err := mc.cached(src, mc.engines[runtime]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that the module at path is valid WebAssembly, or an artifact the local engines can load.
+func (mc *ModuleCompiler) Validate(path string) (ArtifactKind, error) {
+	kind, err := DetectKind(path)
+	if err != nil {
+		return kind, err
+	}
+
+	switch kind {
+	case KindRaw, KindWasmedgeAOT:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return kind, err
+		}
+		err = wasmtime.ModuleValidate(mc.NewWasmtimeEngine(true), data)
+		return kind, err
+	case KindWasmtime:
+		_, err := mc.precompiledEngine(path, RuntimeWasmtime)
+		return kind, err
+	case KindWasmedgeNative:
+		return kind, checkArtifact(path, mc.engines[RuntimeWasmedge])
+	}
+
+	return kind, errors.New("neither a WebAssembly module nor a compiled artifact")
+}
+
+// Interface lists the imports and exports of the module at path.
+func (mc *ModuleCompiler) Interface(path string) ([]wasm_binary.Import, []wasm_binary.Export, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch DetectKindBytes(data) {
+	case KindRaw, KindWasmedgeAOT:
+		imports, err := wasm_binary.ReadImports(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		exports, err := wasm_binary.ReadExports(data)
+		return imports, exports, err
+	case KindWasmtime:
+		module, err := wasmtime.NewModuleDeserialize(mc.NewWasmtimeEngine(mc.epochInterruption(data)), data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return wasmtimeInterface(module)
+	}
+
+	// Native WasmEdge artifacts can only be inspected by loading them
+	return []wasm_binary.Import{}, []wasm_binary.Export{}, nil
+}
+
+func wasmtimeInterface(module *wasmtime.Module) ([]wasm_binary.Import, []wasm_binary.Export, error) {
+	imports := []wasm_binary.Import{}
+	for _, imp := range module.Imports() {
+		name := ""
+		if imp.Name() != nil {
+			name = *imp.Name()
+		}
+		imports = append(imports, wasm_binary.Import{Module: imp.Module(), Name: name, Kind: externKind(imp.Type())})
+	}
+
+	exports := []wasm_binary.Export{}
+	for _, exp := range module.Exports() {
+		exports = append(exports, wasm_binary.Export{Name: exp.Name(), Kind: externKind(exp.Type())})
+	}
+
+	return imports, exports, nil
+}
+
+func externKind(externType *wasmtime.ExternType) string {
+	switch {
+	case externType.FuncType() != nil:
+		return wasm_binary.KindFunc
+	case externType.TableType() != nil:
+		return wasm_binary.KindTable
+	case externType.MemoryType() != nil:
+		return wasm_binary.KindMemory
+	case externType.GlobalType() != nil:
+		return wasm_binary.KindGlobal
+	}
+	return "unknown"
+}
+
+// EpochInterruption reports whether the Wasmtime artifact at artifactPath was compiled with
+// epoch interruption. Precompiled artifacts built without it must be run on an engine
+// without it, and their invocations can not be interrupted for timeouts or checkpoints.
+func (mc *ModuleCompiler) EpochInterruption(artifactPath string) (bool, error) {
+	engine, err := mc.precompiledEngine(artifactPath, RuntimeWasmtime)
+	if err != nil {
+		return false, err
+	}
+	return engine.EpochInterruption, nil
+}
+
+// precompiledEngine returns the engine that can load the precompiled artifact at path.
+func (mc *ModuleCompiler) precompiledEngine(path, runtime string) (*Engine, error) {
+	engine := mc.engines[runtime]
+	err := checkArtifact(path, engine)
+	if runtime == RuntimeWasmtime && errors.Is(err, ErrIncompatible) && checkArtifact(path, mc.plainWasmtime) == nil {
+		return mc.plainWasmtime, nil
+	}
+	return engine, err
+}
+
+// epochInterruption reports whether the serialized Wasmtime module in data was compiled
+// with epoch interruption. Incompatible modules are reported as compiled with it, so
+// deserializing them fails like for any other artifact compiled by this pod.
+func (mc *ModuleCompiler) epochInterruption(data []byte) bool {
+	section, err := readWasmtimeSection(data)
+	return err != nil || !bytes.Equal(section, mc.plainWasmtime.wasmtimeSection)
+}
+
+// Evict removes the artifacts compiled from the module with the given hash from the cache.
+// Their lock files are kept, since other pods may hold them. Artifacts are shared by all
+// modules with the same content, so callers must make sure none of them is left.
+func (mc *ModuleCompiler) Evict(moduleHash string) {
+	for _, engine := range mc.engines {
+		path := mc.artifactPath(engine, moduleHash)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to evict compiled artifact", "artifact", path, "reason", err)
+		}
+	}
+}
+
+// artifactPath is where the artifact compiled by engine from the module with the given hash is cached.
+func (mc *ModuleCompiler) artifactPath(engine *Engine, moduleHash string) string {
+	if engine.Runtime == RuntimeWasmedge {
+		return filepath.Join(mc.cacheDir(engine), moduleHash+WasmedgeArtifactSuffix)
+	}
+	return filepath.Join(mc.cacheDir(engine), moduleHash+WasmtimeArtifactSuffix)
+}
+
+// pinned copies the verified content of a precompiled artifact into the cache, so that
+// the runtime loads what was verified even if the module file is replaced. Like compiled
+// artifacts, the copy is keyed by the hash of the content.
+func (mc *ModuleCompiler) pinned(src *source, runtime string, engine *Engine) (string, error) {
+	artifactPath := mc.artifactPath(engine, src.hash)
+
+	_, err := os.Stat(artifactPath)
+	if errors.Is(err, os.ErrNotExist) {
+		err = writeAtomic(artifactPath, func(tmpPath string) error {
+			return os.WriteFile(tmpPath, src.data, 0644)
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := mc.precompiledEngine(artifactPath, runtime); err != nil {
+		return "", fmt.Errorf("%s: %w", filepath.Base(src.path), err)
+	}
+	return artifactPath, nil
+}
+
+// cached returns the cached artifact of src for engine. The first pod to miss compiles
+// it while holding the entry's lock file, the others wait and reuse its result.
+func (mc *ModuleCompiler) cached(src *source, engine *Engine) (string, error) {
+	compile := mc.compileWasmtime
+	if engine.Runtime == RuntimeWasmedge {
+		compile = mc.compileWasmedge
+	}
+	artifactPath := mc.artifactPath(engine, src.hash)
+
+	if checkArtifact(artifactPath, engine) == nil {
+		return artifactPath, nil
+	}
+
+	lock, err := utils.LockFile(artifactPath + ".lock")
+	if err != nil {
+		return "", err
+	}
+	defer utils.UnlockFile(lock)
+
+	err = checkArtifact(artifactPath, engine)
+	if err == nil {
+		return artifactPath, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Rejecting cached artifact", "artifact", artifactPath, "reason", err)
+	}
+
+	start := time.Now()
+	err = writeAtomic(artifactPath, func(tmpPath string) error {
+		if err := compile(src, tmpPath); err != nil {
+			return fmt.Errorf("failed to compile %s: %v", filepath.Base(src.path), err)
+		}
+		return checkArtifact(tmpPath, engine)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	slog.Info("Compiled module", "module", src.path, "artifact", artifactPath, "time", time.Since(start))
+	return artifactPath, nil
+}
+
+func (mc *ModuleCompiler) compileWasmtime(src *source, dst string) error {
+	engine := mc.NewWasmtimeEngine(true)
+
+	var module *wasmtime.Module
+	var err error
+	if src.data != nil {
+		module, err = wasmtime.NewModule(engine, src.data)
+	} else {
+		module, err = wasmtime.NewModuleFromFile(engine, src.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	serialized, err := module.Serialize()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(dst, serialized, 0644)
+}
+
+func (mc *ModuleCompiler) compileWasmedge(src *source, dst string) error {
+	conf := wasmedge.NewConfigure()
+	defer conf.Release()
+	conf.SetCompilerOutputFormat(wasmedge.CompilerOutputFormat_Wasm)
+
+	compiler := wasmedge.NewCompilerWithConfig(conf)
+	defer compiler.Release()
+
+	if src.data == nil {
+		return compiler.Compile(src.path, dst)
+	}
+
+	// The compiler only reads files, so the verified content is compiled from a copy
+	input, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*.wasm")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(input.Name())
+	_, err = input.Write(src.data)
+	if closeErr := input.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return compiler.Compile(input.Name(), dst)
+}
@@ -0,0 +1,63 @@
+package module_source
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"webserver/internal/config"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// MinioStore reads objects from an S3 compatible bucket, such as one served by MinIO.
+type MinioStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewMinioStore(cfg *config.MinioConfig) (*MinioStore, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MinioStore{client: client, bucket: cfg.BucketName, prefix: cfg.Prefix}, nil
+}
+
+func (ms *MinioStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := ms.client.StatObject(ctx, ms.bucket, ms.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, storeError(err)
+	}
+
+	return ObjectInfo{ETag: info.ETag, Size: info.Size}, nil
+}
+
+func (ms *MinioStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	object, err := ms.client.GetObject(ctx, ms.bucket, ms.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, storeError(err)
+	}
+
+	// GetObject is lazy, requests only fail once the object is read or stat'ed
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, ObjectInfo{}, storeError(err)
+	}
+
+	return object, ObjectInfo{ETag: info.ETag, Size: info.Size}, nil
+}
+
+func storeError(err error) error {
+	// A missing bucket is a configuration error, not a missing module
+	if response := minio.ToErrorResponse(err); response.StatusCode == http.StatusNotFound && response.Code != "NoSuchBucket" {
+		return ErrObjectNotFound
+	}
+	return err
+}
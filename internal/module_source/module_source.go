@@ -0,0 +1,383 @@
+package module_source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/signature"
+)
+
+const (
+	fetchTimeout   = 2 * time.Minute
+	downloadPrefix = ".download-"
+	etagSuffix     = ".etag"
+)
+
+var (
+	ErrNotFound       = errors.New("module not found in the module source")
+	ErrObjectNotFound = errors.New("object not found")
+	ErrTooLarge       = errors.New("module does not fit in the module cache")
+)
+
+type ObjectInfo struct {
+	ETag string
+	Size int64
+}
+
+// ObjectStore is where modules are downloaded from. Keys are function names, and
+// signatures are stored under the name of their module followed by ".sig".
+type ObjectStore interface {
+	// Stat returns ErrObjectNotFound for missing objects.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Get returns ErrObjectNotFound for missing objects.
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+}
+
+// cachedModule is a module in the local cache. The fields are guarded by the
+// ModuleSource's mutex, fetching serializes downloads of the module.
+type cachedModule struct {
+	etag        string
+	size        int64
+	validatedAt time.Time
+	usedAt      time.Time
+	// pins counts the invocations using the module, which is not evicted while they run
+	pins     int
+	fetching sync.Mutex
+}
+
+// ModuleSource downloads modules from an object store the first time they are invoked,
+// and keeps them in a local cache bounded in size. Cached modules are revalidated with
+// their ETag once they are older than the revalidation interval, and the least recently
+// used ones are evicted when the cache is full.
+type ModuleSource struct {
+	Config  *config.ModuleSourceConfig
+	Store   ObjectStore
+	modules map[string]*cachedModule
+	mu      sync.Mutex
+}
+
+func (ms *ModuleSource) Init() error {
+	ms.modules = make(map[string]*cachedModule)
+
+	if err := os.MkdirAll(ms.Config.ModuleCacheDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(ms.Config.ModuleCacheDir)
+	if err != nil {
+		return err
+	}
+
+	// Modules cached before a restart are kept, and revalidated on their next use
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, downloadPrefix) {
+			os.Remove(filepath.Join(ms.Config.ModuleCacheDir, name))
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, signature.FileSuffix) {
+			continue
+		}
+
+		etag, err := os.ReadFile(ms.etagPath(name))
+		if err != nil {
+			ms.remove(name)
+			continue
+		}
+
+		ms.modules[name] = &cachedModule{etag: string(etag), size: info.Size(), usedAt: info.ModTime()}
+	}
+
+	ms.evict("")
+	slog.Info("Using module cache", "dir", ms.Config.ModuleCacheDir, "modules", len(ms.modules), "max_mb", ms.Config.ModuleCacheMaxMB)
+
+	return nil
+}
+
+func (ms *ModuleSource) path(name string) string {
+	return filepath.Join(ms.Config.ModuleCacheDir, name)
+}
+
+// etagPath is hidden, so that it never collides with a function name.
+func (ms *ModuleSource) etagPath(name string) string {
+	return filepath.Join(ms.Config.ModuleCacheDir, "."+name+etagSuffix)
+}
+
+func (ms *ModuleSource) maxSize() int64 {
+	return int64(ms.Config.ModuleCacheMaxMB) * 1024 * 1024
+}
+
+// Fetch returns the path of the cached copy of the module called name, downloading it
+// first if it is not cached yet or changed in the object store.
+func (ms *ModuleSource) Fetch(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || name[0] == '.' {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+
+	module := ms.lockModule(name)
+	defer module.fetching.Unlock()
+
+	ms.mu.Lock()
+	etag := module.etag
+	fresh := etag != "" && time.Since(module.validatedAt) < time.Duration(ms.Config.ModuleRevalidateIntervalMS)*time.Millisecond
+	module.usedAt = time.Now()
+	ms.mu.Unlock()
+
+	if fresh {
+		return ms.path(name), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	info, err := ms.Store.Stat(ctx, name)
+	switch {
+	case errors.Is(err, ErrObjectNotFound):
+		ms.drop(name, module)
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	case err != nil && etag != "":
+		// Serving a possibly stale module beats failing while the store is unreachable
+		slog.Warn("Failed to revalidate cached module", "name", name, "reason", err)
+		return ms.path(name), nil
+	case err != nil:
+		ms.forget(name, module)
+		return "", err
+	case info.ETag == etag:
+		ms.mu.Lock()
+		module.validatedAt = time.Now()
+		ms.mu.Unlock()
+		return ms.path(name), nil
+	}
+
+	if err := ms.download(ctx, name, module); err != nil {
+		if errors.Is(err, ErrObjectNotFound) {
+			ms.drop(name, module)
+			return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+		}
+		if etag == "" {
+			ms.forget(name, module)
+		}
+		return "", err
+	}
+
+	ms.evict(name)
+	return ms.path(name), nil
+}
+
+// Pin keeps the module called name from being evicted until the returned function is
+// called, so that the path Fetch returns stays valid while an invocation uses it. It is
+// called before Fetch, and the module does not have to be cached yet.
+func (ms *ModuleSource) Pin(name string) (unpin func()) {
+	ms.mu.Lock()
+	module, ok := ms.modules[name]
+	if !ok {
+		module = &cachedModule{}
+		ms.modules[name] = module
+	}
+	module.pins++
+	ms.mu.Unlock()
+
+	return func() {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+
+		module.pins--
+		// Entries of functions the module source does not serve are not kept around
+		if module.pins == 0 && module.etag == "" && ms.modules[name] == module && module.fetching.TryLock() {
+			delete(ms.modules, name)
+			module.fetching.Unlock()
+		}
+	}
+}
+
+// lockModule returns the cache entry of a module, holding its fetching lock.
+func (ms *ModuleSource) lockModule(name string) *cachedModule {
+	for {
+		ms.mu.Lock()
+		module, ok := ms.modules[name]
+		if !ok {
+			module = &cachedModule{}
+			ms.modules[name] = module
+		}
+		ms.mu.Unlock()
+
+		module.fetching.Lock()
+
+		// The entry may have been evicted or dropped while waiting for the lock
+		ms.mu.Lock()
+		current := ms.modules[name] == module
+		ms.mu.Unlock()
+		if current {
+			return module
+		}
+		module.fetching.Unlock()
+	}
+}
+
+func (ms *ModuleSource) download(ctx context.Context, name string, module *cachedModule) error {
+	start := time.Now()
+
+	reader, info, err := ms.Store.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if info.Size > ms.maxSize() {
+		return fmt.Errorf("%w: %s is %d bytes", ErrTooLarge, name, info.Size)
+	}
+
+	tmpFile, err := os.CreateTemp(ms.Config.ModuleCacheDir, downloadPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	written, err := io.Copy(tmpFile, io.LimitReader(reader, ms.maxSize()+1))
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	if written > ms.maxSize() {
+		return fmt.Errorf("%w: %s", ErrTooLarge, name)
+	}
+
+	// The signature is replaced before the module, so a new module is never checked
+	// against the signature of the old one
+	if err := ms.downloadSignature(ctx, name); err != nil {
+		return err
+	}
+
+	// Invocations that already opened the previous copy keep reading it
+	if err := os.Rename(tmpFile.Name(), ms.path(name)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(ms.etagPath(name), []byte(info.ETag), 0644); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	module.etag, module.size, module.validatedAt = info.ETag, written, time.Now()
+	ms.mu.Unlock()
+
+	slog.Info("Downloaded module", "name", name, "etag", info.ETag, "size", written, "time", time.Since(start))
+	return nil
+}
+
+func (ms *ModuleSource) downloadSignature(ctx context.Context, name string) error {
+	path := signature.Path(ms.path(name))
+
+	reader, _, err := ms.Store.Get(ctx, name+signature.FileSuffix)
+	if errors.Is(err, ErrObjectNotFound) {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, 64*1024))
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(ms.Config.ModuleCacheDir, downloadPrefix+name+signature.FileSuffix)
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Paths returns the paths of the modules in the local cache.
+func (ms *ModuleSource) Paths() []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	paths := make([]string, 0, len(ms.modules))
+	for name, module := range ms.modules {
+		if module.etag != "" {
+			paths = append(paths, ms.path(name))
+		}
+	}
+	return paths
+}
+
+// forget removes the entry of a module that was never downloaded, so that failed
+// lookups of unknown names do not accumulate.
+func (ms *ModuleSource) forget(name string, module *cachedModule) {
+	ms.mu.Lock()
+	if ms.modules[name] == module {
+		delete(ms.modules, name)
+	}
+	ms.mu.Unlock()
+}
+
+// drop forgets a module that was removed from the object store.
+func (ms *ModuleSource) drop(name string, module *cachedModule) {
+	ms.forget(name, module)
+	ms.remove(name)
+}
+
+func (ms *ModuleSource) remove(name string) {
+	for _, path := range []string{ms.path(name), signature.Path(ms.path(name)), ms.etagPath(name)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to remove cached module", "path", path, "reason", err)
+		}
+	}
+}
+
+// evict removes the least recently used modules until the cache fits in its maximum
+// size again. keep is never evicted, nor are modules that are pinned or being downloaded.
+func (ms *ModuleSource) evict(keep string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var total int64
+	for _, module := range ms.modules {
+		total += module.size
+	}
+
+	if total <= ms.maxSize() {
+		return
+	}
+
+	names := make([]string, 0, len(ms.modules))
+	for name, module := range ms.modules {
+		if name != keep && module.etag != "" && module.pins == 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return ms.modules[names[i]].usedAt.Before(ms.modules[names[j]].usedAt)
+	})
+
+	for _, name := range names {
+		if total <= ms.maxSize() {
+			return
+		}
+
+		module := ms.modules[name]
+		if !module.fetching.TryLock() {
+			continue
+		}
+		delete(ms.modules, name)
+		ms.remove(name)
+		module.fetching.Unlock()
+
+		total -= module.size
+		slog.Info("Evicted cached module", "name", name, "size", module.size)
+	}
+}
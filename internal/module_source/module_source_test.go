@@ -0,0 +1,290 @@
+package module_source
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"webserver/internal/config"
+	"webserver/internal/signature"
+)
+
+// fakeStore is an in-memory object store that counts the requests made to it.
+type fakeStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	etags   map[string]string
+	stats   int
+	gets    map[string]int
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{objects: make(map[string][]byte), etags: make(map[string]string), gets: make(map[string]int)}
+}
+
+func (fs *fakeStore) put(key string, data []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.objects[key] = data
+	fs.etags[key] = fmt.Sprintf("%q", fmt.Sprintf("etag-%d", len(fs.etags)))
+}
+
+func (fs *fakeStore) remove(key string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.objects, key)
+}
+
+func (fs *fakeStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.stats++
+	data, ok := fs.objects[key]
+	if !ok {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	return ObjectInfo{ETag: fs.etags[key], Size: int64(len(data))}, nil
+}
+
+func (fs *fakeStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.gets[key]++
+	data, ok := fs.objects[key]
+	if !ok {
+		return nil, ObjectInfo{}, ErrObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), ObjectInfo{ETag: fs.etags[key], Size: int64(len(data))}, nil
+}
+
+func (fs *fakeStore) getCount(key string) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.gets[key]
+}
+
+func newTestSource(t *testing.T, store ObjectStore, maxMB, revalidateMS int) *ModuleSource {
+	t.Helper()
+	ms := &ModuleSource{
+		Config: &config.ModuleSourceConfig{
+			ModuleCacheDir:             t.TempDir(),
+			ModuleCacheMaxMB:           maxMB,
+			ModuleRevalidateIntervalMS: revalidateMS,
+		},
+		Store: store,
+	}
+	if err := ms.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return ms
+}
+
+func fetchContent(t *testing.T, ms *ModuleSource, name string) []byte {
+	t.Helper()
+	path, err := ms.Fetch(name)
+	if err != nil {
+		t.Fatalf("Fetch(%s): %v", name, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFetch(t *testing.T) {
+	store := newFakeStore()
+	store.put("hello.wasm", []byte("module"))
+	store.put("hello.wasm"+signature.FileSuffix, []byte("signature"))
+	ms := newTestSource(t, store, 1, 60000)
+
+	if data := fetchContent(t, ms, "hello.wasm"); string(data) != "module" {
+		t.Errorf("fetched %q", data)
+	}
+	path, _ := ms.Fetch("hello.wasm")
+	if data, err := os.ReadFile(signature.Path(path)); err != nil || string(data) != "signature" {
+		t.Errorf("signature is %q, %v", data, err)
+	}
+
+	// Fresh modules are neither revalidated nor downloaded again
+	stats := store.stats
+	fetchContent(t, ms, "hello.wasm")
+	if store.stats != stats || store.getCount("hello.wasm") != 1 {
+		t.Errorf("fresh module was revalidated (%d stats) or downloaded again (%d gets)", store.stats-stats, store.getCount("hello.wasm"))
+	}
+
+	for _, name := range []string{"missing.wasm", "", "..", ".hello.wasm.etag", "../hello.wasm"} {
+		if _, err := ms.Fetch(name); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Fetch(%q) = %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestFetchRevalidatesWithETag(t *testing.T) {
+	store := newFakeStore()
+	store.put("hello.wasm", []byte("v1"))
+	ms := newTestSource(t, store, 1, 0)
+
+	fetchContent(t, ms, "hello.wasm")
+
+	// An unchanged ETag only costs a Stat
+	if data := fetchContent(t, ms, "hello.wasm"); string(data) != "v1" || store.getCount("hello.wasm") != 1 {
+		t.Errorf("unchanged module: got %q after %d downloads", data, store.getCount("hello.wasm"))
+	}
+
+	store.put("hello.wasm", []byte("v2"))
+	if data := fetchContent(t, ms, "hello.wasm"); string(data) != "v2" || store.getCount("hello.wasm") != 2 {
+		t.Errorf("changed module: got %q after %d downloads", data, store.getCount("hello.wasm"))
+	}
+
+	store.remove("hello.wasm")
+	path := ms.path("hello.wasm")
+	if _, err := ms.Fetch("hello.wasm"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("removed module: got %v, want ErrNotFound", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("removed module is still cached: %v", err)
+	}
+}
+
+func TestFetchKeepsServingWhenStoreFails(t *testing.T) {
+	store := newFakeStore()
+	store.put("hello.wasm", []byte("module"))
+	failing := &failingStore{fakeStore: store}
+	ms := newTestSource(t, failing, 1, 0)
+
+	fetchContent(t, ms, "hello.wasm")
+	failing.failing = true
+	if data := fetchContent(t, ms, "hello.wasm"); string(data) != "module" {
+		t.Errorf("got %q while the store is unreachable", data)
+	}
+	if _, err := ms.Fetch("other.wasm"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("uncached module got %v while the store is unreachable", err)
+	}
+}
+
+type failingStore struct {
+	*fakeStore
+	failing bool
+}
+
+func (fs *failingStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if fs.failing {
+		return ObjectInfo{}, errors.New("store is unreachable")
+	}
+	return fs.fakeStore.Stat(ctx, key)
+}
+
+func TestFetchTooLarge(t *testing.T) {
+	store := newFakeStore()
+	store.put("large.wasm", make([]byte, 1024*1024+1))
+	ms := newTestSource(t, store, 1, 60000)
+
+	if _, err := ms.Fetch("large.wasm"); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+	entries, err := os.ReadDir(ms.Config.ModuleCacheDir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("cache holds %v after a failed download, %v", entries, err)
+	}
+	if len(ms.Paths()) != 0 {
+		t.Errorf("failed download is cached: %v", ms.Paths())
+	}
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	store := newFakeStore()
+	for _, name := range []string{"a.wasm", "b.wasm", "c.wasm"} {
+		store.put(name, make([]byte, 400*1024))
+	}
+	ms := newTestSource(t, store, 1, 60000)
+
+	fetchContent(t, ms, "a.wasm")
+	fetchContent(t, ms, "b.wasm")
+	fetchContent(t, ms, "a.wasm")
+	fetchContent(t, ms, "c.wasm")
+
+	for name, cached := range map[string]bool{"a.wasm": true, "b.wasm": false, "c.wasm": true} {
+		if _, err := os.Stat(ms.path(name)); (err == nil) != cached {
+			t.Errorf("%s cached: %t, want %t", name, err == nil, cached)
+		}
+	}
+}
+
+func TestPinnedModulesAreNotEvicted(t *testing.T) {
+	store := newFakeStore()
+	for _, name := range []string{"a.wasm", "b.wasm", "c.wasm"} {
+		store.put(name, make([]byte, 400*1024))
+	}
+	ms := newTestSource(t, store, 1, 60000)
+
+	unpin := ms.Pin("a.wasm")
+	pinned, err := ms.Fetch("a.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchContent(t, ms, "b.wasm")
+	fetchContent(t, ms, "c.wasm")
+
+	if _, err := os.Stat(pinned); err != nil {
+		t.Errorf("pinned module was evicted: %v", err)
+	}
+	if _, err := os.Stat(ms.path("b.wasm")); err == nil {
+		t.Error("b.wasm was kept instead of the pinned module")
+	}
+
+	// Once unpinned, it is the least recently used one
+	unpin()
+	fetchContent(t, ms, "b.wasm")
+	if _, err := os.Stat(pinned); err == nil {
+		t.Error("unpinned module was not evicted")
+	}
+}
+
+func TestPinOfUnknownModuleIsForgotten(t *testing.T) {
+	ms := newTestSource(t, newFakeStore(), 1, 60000)
+
+	unpin := ms.Pin("uploaded.wasm")
+	unpin()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if len(ms.modules) != 0 {
+		t.Errorf("cache keeps %d entries", len(ms.modules))
+	}
+}
+
+func TestInitKeepsCachedModules(t *testing.T) {
+	store := newFakeStore()
+	store.put("hello.wasm", []byte("module"))
+	ms := newTestSource(t, store, 1, 60000)
+	fetchContent(t, ms, "hello.wasm")
+
+	// A partial download left by a crash
+	partial := filepath.Join(ms.Config.ModuleCacheDir, downloadPrefix+"123")
+	if err := os.WriteFile(partial, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := &ModuleSource{Config: ms.Config, Store: store}
+	if err := restarted.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if paths := restarted.Paths(); len(paths) != 1 || paths[0] != ms.path("hello.wasm") {
+		t.Errorf("Paths() = %v after restart", paths)
+	}
+	if _, err := os.Stat(partial); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial download was kept: %v", err)
+	}
+
+	// It is revalidated on its next use, not downloaded again
+	fetchContent(t, restarted, "hello.wasm")
+	if store.getCount("hello.wasm") != 1 {
+		t.Errorf("cached module was downloaded %d times", store.getCount("hello.wasm"))
+	}
+}
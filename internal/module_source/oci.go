@@ -0,0 +1,427 @@
+package module_source
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"webserver/internal/config"
+	"webserver/internal/signature"
+)
+
+const (
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	maxManifestSize = 4 * 1024 * 1024
+)
+
+// wasmLayerTypes are the media types of Wasm layers, as pushed by the Wasm OCI artifact
+// layout (e.g. "wkg oci push") and by wasm-to-oci.
+var wasmLayerTypes = []string{"application/wasm", "application/vnd.wasm.content.layer.v1+wasm"}
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestPattern     = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+	ErrInvalidReference = errors.New("invalid OCI reference")
+	ErrDigestMismatch   = errors.New("digest mismatch")
+)
+
+// Reference points to an artifact in a registry, by tag or by digest.
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+func (r Reference) String() string {
+	if r.Digest != "" {
+		return r.Registry + "/" + r.Repository + "@" + r.Digest
+	}
+	return r.Registry + "/" + r.Repository + ":" + r.Tag
+}
+
+// ParseReference parses "registry/repo:tag" or "registry/repo@sha256:...". References
+// without a tag use defaultTag, and references without a registry Docker Hub.
+func ParseReference(ref, defaultTag string) (Reference, error) {
+	name, digest, hasDigest := strings.Cut(ref, "@")
+
+	tag := ""
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+
+	registry, repository, ok := strings.Cut(name, "/")
+	if !ok || !strings.ContainsAny(registry, ".:") && registry != "localhost" {
+		registry, repository = "registry-1.docker.io", name
+		if !strings.Contains(repository, "/") {
+			repository = "library/" + repository
+		}
+	}
+
+	switch {
+	case hasDigest && !digestPattern.MatchString(digest):
+		return Reference{}, fmt.Errorf("%w %q: digests must be sha256:<hex>", ErrInvalidReference, ref)
+	case tag != "" && !tagPattern.MatchString(tag):
+		return Reference{}, fmt.Errorf("%w %q: invalid tag", ErrInvalidReference, ref)
+	case !repositoryPattern.MatchString(repository):
+		return Reference{}, fmt.Errorf("%w %q: invalid repository", ErrInvalidReference, ref)
+	}
+
+	if tag == "" && !hasDigest {
+		tag = defaultTag
+	}
+
+	return Reference{Registry: registry, Repository: repository, Tag: tag, Digest: digest}, nil
+}
+
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *platform `json:"platform,omitempty"`
+}
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// manifest is an image manifest or an index, they are told apart by their media type.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// OCIStore pulls modules pushed as Wasm OCI artifacts. The module of a function is the
+// Wasm layer of "<repository>/<name>:<tag>", where the tag is part of the function name
+// when it contains a colon. ETags are layer digests, so retagging the same module does
+// not download it again.
+type OCIStore struct {
+	Config *config.OCIConfig
+	client *http.Client
+	// tokens caches the bearer token of each repository
+	tokens map[string]string
+	mu     sync.Mutex
+}
+
+func NewOCIStore(cfg *config.OCIConfig) (*OCIStore, error) {
+	if _, err := ParseReference(strings.TrimSuffix(cfg.Repository, "/")+"/function", cfg.DefaultTag); err != nil {
+		return nil, fmt.Errorf("OCI_REPOSITORY: %w", err)
+	}
+
+	return &OCIStore{Config: cfg, client: &http.Client{}, tokens: make(map[string]string)}, nil
+}
+
+func (oc *OCIStore) reference(key string) (Reference, error) {
+	return ParseReference(strings.TrimSuffix(oc.Config.Repository, "/")+"/"+key, oc.Config.DefaultTag)
+}
+
+func (oc *OCIStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	layer, err := oc.resolve(ctx, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{ETag: layer.Digest, Size: layer.Size}, nil
+}
+
+func (oc *OCIStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	layer, err := oc.resolve(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	ref, _ := oc.reference(key)
+	resp, err := oc.do(ctx, ref, "blobs/"+layer.Digest, "")
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	reader := &verifyingReader{
+		body:   resp.Body,
+		reader: io.LimitReader(resp.Body, layer.Size+1),
+		hash:   sha256.New(),
+		digest: layer.Digest,
+		size:   layer.Size,
+	}
+	return reader, ObjectInfo{ETag: layer.Digest, Size: layer.Size}, nil
+}
+
+// resolve returns the Wasm layer of the artifact a key points to.
+func (oc *OCIStore) resolve(ctx context.Context, key string) (descriptor, error) {
+	// Signatures are not stored next to modules in registries
+	if strings.HasSuffix(key, signature.FileSuffix) {
+		return descriptor{}, ErrObjectNotFound
+	}
+
+	ref, err := oc.reference(key)
+	if err != nil {
+		// No artifact can exist under a name that is not a valid reference
+		return descriptor{}, ErrObjectNotFound
+	}
+
+	selector := ref.Tag
+	if ref.Digest != "" {
+		selector = ref.Digest
+	}
+
+	m, err := oc.manifest(ctx, ref, selector, ref.Digest)
+	if err != nil {
+		return descriptor{}, err
+	}
+
+	if m.MediaType == mediaTypeOCIIndex || m.MediaType == mediaTypeDockerList {
+		var wasm *descriptor
+		for i, candidate := range m.Manifests {
+			if candidate.Platform != nil && candidate.Platform.Architecture == "wasm" {
+				wasm = &m.Manifests[i]
+				break
+			}
+		}
+		if wasm == nil {
+			return descriptor{}, fmt.Errorf("%s is an index without a wasm manifest", ref)
+		}
+
+		m, err = oc.manifest(ctx, ref, wasm.Digest, wasm.Digest)
+		if err != nil {
+			return descriptor{}, err
+		}
+	}
+
+	for _, layer := range m.Layers {
+		for _, mediaType := range wasmLayerTypes {
+			if layer.MediaType == mediaType {
+				if !digestPattern.MatchString(layer.Digest) {
+					return descriptor{}, fmt.Errorf("%s has a layer with unsupported digest %s", ref, layer.Digest)
+				}
+				return layer, nil
+			}
+		}
+	}
+
+	return descriptor{}, fmt.Errorf("%s has no Wasm layer (%s)", ref, strings.Join(wasmLayerTypes, ", "))
+}
+
+// manifest fetches a manifest, checking it against digest unless that is empty.
+func (oc *OCIStore) manifest(ctx context.Context, ref Reference, selector, digest string) (manifest, error) {
+	accept := strings.Join([]string{mediaTypeOCIManifest, mediaTypeOCIIndex, mediaTypeDockerManifest, mediaTypeDockerList}, ", ")
+	resp, err := oc.do(ctx, ref, "manifests/"+selector, accept)
+	if err != nil {
+		return manifest{}, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return manifest{}, err
+	}
+	if len(data) > maxManifestSize {
+		return manifest{}, fmt.Errorf("manifest of %s is larger than %d bytes", ref, maxManifestSize)
+	}
+
+	if header := resp.Header.Get("Docker-Content-Digest"); digest == "" && digestPattern.MatchString(header) {
+		digest = header
+	}
+	if digest != "" && digest != sha256Digest(data) {
+		return manifest{}, fmt.Errorf("%w: manifest of %s is %s, expected %s", ErrDigestMismatch, ref, sha256Digest(data), digest)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return manifest{}, fmt.Errorf("invalid manifest of %s: %v", ref, err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	}
+
+	return m, nil
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// do sends a GET request to the registry API of the repository, authenticating when
+// the registry asks to. Missing manifests and blobs are reported as ErrObjectNotFound.
+func (oc *OCIStore) do(ctx context.Context, ref Reference, path, accept string) (*http.Response, error) {
+	scheme := "https"
+	if oc.Config.PlainHTTP {
+		scheme = "http"
+	}
+	endpoint := fmt.Sprintf("%s://%s/v2/%s/%s", scheme, ref.Registry, ref.Repository, path)
+
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		oc.mu.Lock()
+		token := oc.tokens[ref.Registry+"/"+ref.Repository]
+		oc.mu.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if oc.Config.Username != "" {
+			req.SetBasicAuth(oc.Config.Username, oc.Config.Password)
+		}
+
+		return oc.client.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+
+		if err := oc.authenticate(ctx, ref, challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = send(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp, nil
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrObjectNotFound
+	}
+
+	resp.Body.Close()
+	return nil, fmt.Errorf("registry answered %s to GET %s", resp.Status, endpoint)
+}
+
+// authenticate fetches a pull token for the repository from the realm of a Bearer challenge.
+func (oc *OCIStore) authenticate(ctx context.Context, ref Reference, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("registry %s requires %s authentication", ref.Registry, scheme)
+	}
+
+	values := parseChallenge(params)
+	realm, err := url.Parse(values["realm"])
+	if err != nil || values["realm"] == "" {
+		return fmt.Errorf("registry %s sent an invalid authentication challenge", ref.Registry)
+	}
+
+	query := realm.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	query.Set("scope", "repository:"+ref.Repository+":pull")
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if oc.Config.Username != "" {
+		req.SetBasicAuth(oc.Config.Username, oc.Config.Password)
+	}
+
+	resp, err := oc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to authenticate to %s: %s", ref.Registry, resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&body); err != nil {
+		return fmt.Errorf("invalid token from %s: %v", ref.Registry, err)
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+
+	oc.mu.Lock()
+	oc.tokens[ref.Registry+"/"+ref.Repository] = body.Token
+	oc.mu.Unlock()
+
+	return nil
+}
+
+// parseChallenge parses the comma separated key="value" parameters of a challenge.
+func parseChallenge(params string) map[string]string {
+	values := make(map[string]string)
+	for params != "" {
+		key, rest, ok := strings.Cut(strings.TrimLeft(params, ", "), "=")
+		if !ok {
+			break
+		}
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+
+		values[strings.ToLower(strings.TrimSpace(key))] = value
+		params = rest
+	}
+	return values
+}
+
+// verifyingReader fails the read that reaches the end of a blob if the blob does not
+// match its descriptor, so that the module is never stored.
+type verifyingReader struct {
+	body   io.Closer
+	reader io.Reader
+	hash   hash.Hash
+	digest string
+	size   int64
+	read   int64
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.reader.Read(p)
+	vr.hash.Write(p[:n])
+	vr.read += int64(n)
+
+	if vr.read > vr.size {
+		return n, fmt.Errorf("%w: blob %s is larger than %d bytes", ErrDigestMismatch, vr.digest, vr.size)
+	}
+	if err == io.EOF {
+		if digest := "sha256:" + hex.EncodeToString(vr.hash.Sum(nil)); digest != vr.digest || vr.read != vr.size {
+			return n, fmt.Errorf("%w: blob is %s, expected %s", ErrDigestMismatch, digest, vr.digest)
+		}
+	}
+	return n, err
+}
+
+func (vr *verifyingReader) Close() error {
+	return vr.body.Close()
+}
@@ -0,0 +1,303 @@
+package module_source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"webserver/internal/config"
+	"webserver/internal/signature"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		ref  string
+		want Reference
+	}{
+		{"ghcr.io/acme/functions/hello.wasm", Reference{Registry: "ghcr.io", Repository: "acme/functions/hello.wasm", Tag: "latest"}},
+		{"ghcr.io/acme/hello.wasm:v2", Reference{Registry: "ghcr.io", Repository: "acme/hello.wasm", Tag: "v2"}},
+		{"localhost:5000/hello@" + digest, Reference{Registry: "localhost:5000", Repository: "hello", Digest: digest}},
+		{"localhost/hello:v1@" + digest, Reference{Registry: "localhost", Repository: "hello", Tag: "v1", Digest: digest}},
+		{"acme/hello", Reference{Registry: "registry-1.docker.io", Repository: "acme/hello", Tag: "latest"}},
+		{"hello", Reference{Registry: "registry-1.docker.io", Repository: "library/hello", Tag: "latest"}},
+	}
+	for _, test := range tests {
+		got, err := ParseReference(test.ref, "latest")
+		if err != nil || got != test.want {
+			t.Errorf("ParseReference(%q) = %+v, %v, want %+v", test.ref, got, err, test.want)
+		}
+	}
+
+	for _, ref := range []string{
+		"ghcr.io/acme/Hello",
+		"ghcr.io/acme/hello:-v1",
+		"ghcr.io/acme/hello@sha256:abc",
+		"ghcr.io/acme/hello@md5:" + strings.Repeat("a", 32),
+		"ghcr.io/acme//hello",
+	} {
+		if _, err := ParseReference(ref, "latest"); !errors.Is(err, ErrInvalidReference) {
+			t.Errorf("ParseReference(%q) = %v, want ErrInvalidReference", ref, err)
+		}
+	}
+}
+
+// fakeRegistry serves manifests and blobs of a single repository. Manifests are served
+// by tag and by digest, with the digest of their content unless one is overridden.
+type fakeRegistry struct {
+	repository string
+	mu         sync.Mutex
+	manifests  map[string][]byte
+	mediaTypes map[string]string
+	// digests overrides the Docker-Content-Digest header of manifests
+	digests map[string]string
+	blobs   map[string][]byte
+	// token is required as a bearer token once set
+	token string
+}
+
+func newFakeRegistry(repository string) *fakeRegistry {
+	return &fakeRegistry{
+		repository: repository,
+		manifests:  make(map[string][]byte),
+		mediaTypes: make(map[string]string),
+		digests:    make(map[string]string),
+		blobs:      make(map[string][]byte),
+	}
+}
+
+func (fr *fakeRegistry) blob(data []byte) descriptor {
+	digest := sha256Digest(data)
+	fr.mu.Lock()
+	fr.blobs[digest] = data
+	fr.mu.Unlock()
+	return descriptor{MediaType: "application/wasm", Digest: digest, Size: int64(len(data))}
+}
+
+// manifest stores m under its digest and the given tags, and returns its descriptor.
+func (fr *fakeRegistry) manifest(t *testing.T, m manifest, tags ...string) descriptor {
+	t.Helper()
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256Digest(data)
+
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	for _, selector := range append(tags, digest) {
+		fr.manifests[selector] = data
+		fr.mediaTypes[selector] = m.MediaType
+	}
+	return descriptor{MediaType: m.MediaType, Digest: digest, Size: int64(len(data))}
+}
+
+func (fr *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if r.URL.Query().Get("scope") != "repository:"+fr.repository+":pull" {
+			http.Error(w, "wrong scope", http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": fr.token})
+		return
+	}
+
+	if fr.token != "" && r.Header.Get("Authorization") != "Bearer "+fr.token {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="http://`+r.Host+`/token",service="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	prefix := "/v2/" + fr.repository + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	kind, selector, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	switch kind {
+	case "manifests":
+		data, ok := fr.manifests[selector]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		digest, ok := fr.digests[selector]
+		if !ok {
+			digest = sha256Digest(data)
+		}
+		w.Header().Set("Content-Type", fr.mediaTypes[selector])
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Write(data)
+	case "blobs":
+		data, ok := fr.blobs[selector]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestOCIStore(t *testing.T, registry *fakeRegistry) *OCIStore {
+	t.Helper()
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+
+	store, err := NewOCIStore(&config.OCIConfig{
+		Repository: strings.TrimPrefix(server.URL, "http://") + "/acme/functions",
+		DefaultTag: "latest",
+		PlainHTTP:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func readObject(store ObjectStore, key string) ([]byte, ObjectInfo, error) {
+	reader, info, err := store.Get(context.Background(), key)
+	if err != nil {
+		return nil, info, err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	return data, info, err
+}
+
+func TestOCIResolvesTagsAndDigests(t *testing.T) {
+	registry := newFakeRegistry("acme/functions/hello.wasm")
+	v1, v2 := registry.blob([]byte("\x00asm v1")), registry.blob([]byte("\x00asm v2"))
+	config := registry.blob([]byte("{}"))
+	config.MediaType = "application/vnd.wasm.config.v0+json"
+	registry.manifest(t, manifest{MediaType: mediaTypeOCIManifest, Layers: []descriptor{config, v1}}, "latest")
+	pinned := registry.manifest(t, manifest{MediaType: mediaTypeOCIManifest, Layers: []descriptor{v2}}, "v2")
+	store := newTestOCIStore(t, registry)
+
+	for key, want := range map[string]descriptor{
+		"hello.wasm":                     v1,
+		"hello.wasm:v2":                  v2,
+		"hello.wasm@" + pinned.Digest:    v2,
+		"hello.wasm:v1@" + pinned.Digest: v2,
+		"hello.wasm:latest":              v1,
+	} {
+		info, err := store.Stat(context.Background(), key)
+		if err != nil || info.ETag != want.Digest || info.Size != want.Size {
+			t.Errorf("Stat(%s) = %+v, %v, want the layer %s", key, info, err, want.Digest)
+		}
+	}
+
+	data, info, err := readObject(store, "hello.wasm:v2")
+	if err != nil || string(data) != "\x00asm v2" || info.ETag != v2.Digest {
+		t.Errorf("Get(hello.wasm:v2) = %q, %+v, %v", data, info, err)
+	}
+
+	for _, key := range []string{"hello.wasm:v3", "missing.wasm", "hello.wasm" + signature.FileSuffix, "Invalid Name"} {
+		if _, err := store.Stat(context.Background(), key); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Stat(%s) = %v, want ErrObjectNotFound", key, err)
+		}
+	}
+}
+
+func TestOCIFollowsIndexes(t *testing.T) {
+	registry := newFakeRegistry("acme/functions/hello.wasm")
+	layer := registry.blob([]byte("\x00asm"))
+	image := registry.manifest(t, manifest{MediaType: mediaTypeOCIManifest, Layers: []descriptor{layer}})
+	image.Platform = &platform{Architecture: "wasm", OS: "wasip1"}
+	other := descriptor{MediaType: mediaTypeOCIManifest, Digest: sha256Digest([]byte("other")), Platform: &platform{Architecture: "amd64", OS: "linux"}}
+	registry.manifest(t, manifest{MediaType: mediaTypeOCIIndex, Manifests: []descriptor{other, image}}, "latest")
+
+	registry.manifest(t, manifest{MediaType: mediaTypeOCIIndex, Manifests: []descriptor{other}}, "native")
+	store := newTestOCIStore(t, registry)
+
+	if info, err := store.Stat(context.Background(), "hello.wasm"); err != nil || info.ETag != layer.Digest {
+		t.Errorf("Stat through an index = %+v, %v", info, err)
+	}
+	if _, err := store.Stat(context.Background(), "hello.wasm:native"); err == nil {
+		t.Error("index without a wasm manifest was resolved")
+	}
+}
+
+func TestOCIManifestDigestMismatch(t *testing.T) {
+	registry := newFakeRegistry("acme/functions/hello.wasm")
+	layer := registry.blob([]byte("\x00asm"))
+	genuine := registry.manifest(t, manifest{MediaType: mediaTypeOCIManifest, Layers: []descriptor{layer}}, "latest")
+
+	// The registry serves other content under the digest
+	registry.mu.Lock()
+	registry.manifests[genuine.Digest] = []byte(`{"mediaType":"` + mediaTypeOCIManifest + `","layers":[]}`)
+	registry.mu.Unlock()
+	store := newTestOCIStore(t, registry)
+
+	if _, err := store.Stat(context.Background(), "hello.wasm@"+genuine.Digest); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("got %v, want ErrDigestMismatch", err)
+	}
+
+	// A tag is checked against the digest the registry claims for it
+	registry.mu.Lock()
+	registry.digests["latest"] = "sha256:" + strings.Repeat("0", 64)
+	registry.mu.Unlock()
+	if _, err := store.Stat(context.Background(), "hello.wasm"); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("tag: got %v, want ErrDigestMismatch", err)
+	}
+
+	// Neither may an index point to tampered manifests
+	image := genuine
+	image.Platform = &platform{Architecture: "wasm", OS: "wasip1"}
+	registry.manifest(t, manifest{MediaType: mediaTypeOCIIndex, Manifests: []descriptor{image}}, "index")
+	if _, err := store.Stat(context.Background(), "hello.wasm:index"); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("index: got %v, want ErrDigestMismatch", err)
+	}
+}
+
+func TestOCIBlobDigestMismatch(t *testing.T) {
+	registry := newFakeRegistry("acme/functions/hello.wasm")
+	layer := registry.blob([]byte("\x00asm genuine"))
+	registry.manifest(t, manifest{MediaType: mediaTypeOCIManifest, Layers: []descriptor{layer}}, "latest")
+	store := newTestOCIStore(t, registry)
+
+	for name, served := range map[string]string{
+		"same size": "\x00asm tampere",
+		"shorter":   "\x00asm",
+		"longer":    "\x00asm genuine and more",
+	} {
+		registry.mu.Lock()
+		registry.blobs[layer.Digest] = []byte(served)
+		registry.mu.Unlock()
+
+		if _, _, err := readObject(store, "hello.wasm"); !errors.Is(err, ErrDigestMismatch) {
+			t.Errorf("%s blob: got %v, want ErrDigestMismatch", name, err)
+		}
+	}
+
+	// The module source never stores a blob that does not match
+	ms := newTestSource(t, store, 1, 60000)
+	if _, err := ms.Fetch("hello.wasm"); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("Fetch() = %v, want ErrDigestMismatch", err)
+	}
+	if _, err := os.Stat(ms.path("hello.wasm")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("mismatching blob was cached: %v", err)
+	}
+}
+
+func TestOCIAuthenticatesWithBearerTokens(t *testing.T) {
+	registry := newFakeRegistry("acme/functions/hello.wasm")
+	layer := registry.blob([]byte("\x00asm"))
+	registry.manifest(t, manifest{MediaType: mediaTypeOCIManifest, Layers: []descriptor{layer}}, "latest")
+	registry.token = "secret-token"
+	store := newTestOCIStore(t, registry)
+
+	if data, _, err := readObject(store, "hello.wasm"); err != nil || string(data) != "\x00asm" {
+		t.Errorf("Get() = %q, %v", data, err)
+	}
+}
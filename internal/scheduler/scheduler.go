@@ -0,0 +1,252 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/utils"
+
+	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	OverlapSkip  = "skip"
+	OverlapQueue = "queue"
+	OverlapAllow = "allow"
+)
+
+// Executor runs a single invocation and returns its output and timing headers.
+type Executor func(wasmFile, cpuLimit, memLimit, wasmParam string) (string, map[string]string, error)
+
+type RunStatus struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	DurationMS int64     `json:"duration_ms"`
+	Succeeded  bool      `json:"succeeded"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type ScheduleStatus struct {
+	Name     string     `json:"name"`
+	Cron     string     `json:"cron"`
+	Function string     `json:"function"`
+	Overlap  string     `json:"overlap"`
+	JitterMS int        `json:"jitter_ms"`
+	NextRun  time.Time  `json:"next_run"`
+	Running  int        `json:"running"`
+	Queued   int        `json:"queued"`
+	Runs     int        `json:"runs"`
+	Failures int        `json:"failures"`
+	Skipped  int        `json:"skipped"`
+	LastRun  *RunStatus `json:"last_run,omitempty"`
+}
+
+type schedule struct {
+	config  config.ScheduleConfig
+	entryID cron.EntryID
+	queue   sync.Mutex
+	status  ScheduleStatus
+}
+
+type Scheduler struct {
+	Config    *config.SchedulerConfig
+	Executor  Executor
+	cron      *cron.Cron
+	schedules []*schedule
+	mu        sync.Mutex
+}
+
+// Init loads and validates the schedules file. Without SCHEDULES_FILE the scheduler is empty.
+func (s *Scheduler) Init() error {
+	s.cron = cron.New()
+
+	if s.Config.SchedulesFile == "" {
+		return nil
+	}
+
+	var file config.SchedulesFile
+	if err := cleanenv.ReadConfig(s.Config.SchedulesFile, &file); err != nil {
+		return fmt.Errorf("failed to read schedules file %s: %v", s.Config.SchedulesFile, err)
+	}
+
+	names := make(map[string]bool)
+	for _, scheduleConfig := range file.Schedules {
+		if err := validateSchedule(&scheduleConfig); err != nil {
+			return fmt.Errorf("invalid schedule %q: %v", scheduleConfig.Name, err)
+		}
+		if names[scheduleConfig.Name] {
+			return fmt.Errorf("duplicate schedule %q", scheduleConfig.Name)
+		}
+		names[scheduleConfig.Name] = true
+
+		if scheduleConfig.Overlap == "" {
+			scheduleConfig.Overlap = OverlapSkip
+		}
+
+		sc := &schedule{config: scheduleConfig}
+		sc.status = ScheduleStatus{
+			Name:     scheduleConfig.Name,
+			Cron:     scheduleConfig.Cron,
+			Function: scheduleConfig.Function,
+			Overlap:  scheduleConfig.Overlap,
+			JitterMS: scheduleConfig.JitterMS,
+		}
+
+		entryID, err := s.cron.AddFunc(scheduleConfig.Cron, func() { s.trigger(sc) })
+		if err != nil {
+			return fmt.Errorf("invalid cron expression for schedule %q: %v", scheduleConfig.Name, err)
+		}
+		sc.entryID = entryID
+
+		s.schedules = append(s.schedules, sc)
+	}
+
+	return nil
+}
+
+// validateSchedule checks a schedule and converts its Kubernetes quantity limits to the
+// millicores and MiB its runs are executed with.
+func validateSchedule(sc *config.ScheduleConfig) error {
+	if sc.Name == "" {
+		return errors.New("name is required")
+	}
+	if sc.Cron == "" {
+		return errors.New("cron expression is required")
+	}
+	if sc.Function == "" {
+		return errors.New("function is required")
+	}
+	if sc.CPULimit == "" || sc.MemoryLimit == "" {
+		return errors.New("cpu_limit and memory_limit are required")
+	}
+	millicores, err := utils.ParseCPU(sc.CPULimit)
+	if err != nil {
+		return fmt.Errorf("cpu_limit: %v", err)
+	}
+	mebibytes, err := utils.ParseMemory(sc.MemoryLimit)
+	if err != nil {
+		return fmt.Errorf("memory_limit: %v", err)
+	}
+	sc.CPULimit, sc.MemoryLimit = strconv.Itoa(millicores), strconv.Itoa(mebibytes)
+	if sc.JitterMS < 0 {
+		return errors.New("jitter_ms must not be negative")
+	}
+
+	switch sc.Overlap {
+	case "", OverlapSkip, OverlapQueue, OverlapAllow:
+	default:
+		return fmt.Errorf("unknown overlap policy %q", sc.Overlap)
+	}
+
+	return nil
+}
+
+func (s *Scheduler) Start() {
+	s.cron.Start()
+	slog.Info("Started the Scheduler", "schedules", len(s.schedules))
+}
+
+func (s *Scheduler) Stop() {
+	<-s.cron.Stop().Done()
+}
+
+func (s *Scheduler) trigger(sc *schedule) {
+	if sc.config.JitterMS > 0 {
+		time.Sleep(time.Duration(rand.Intn(sc.config.JitterMS)) * time.Millisecond)
+	}
+
+	switch sc.config.Overlap {
+	case OverlapSkip:
+		s.mu.Lock()
+		if sc.status.Running > 0 {
+			sc.status.Skipped++
+			s.mu.Unlock()
+			slog.Info("Skipped scheduled run, previous run still in progress", "schedule", sc.config.Name)
+			return
+		}
+		sc.status.Running++
+		s.mu.Unlock()
+	case OverlapQueue:
+		// A single run waits for the previous one to finish, later ticks are coalesced
+		// into it, so a schedule faster than its runs does not pile up waiting runs
+		s.mu.Lock()
+		if sc.status.Queued > 0 {
+			sc.status.Skipped++
+			s.mu.Unlock()
+			slog.Info("Skipped scheduled run, a run is already queued", "schedule", sc.config.Name)
+			return
+		}
+		sc.status.Queued++
+		s.mu.Unlock()
+		sc.queue.Lock()
+		defer sc.queue.Unlock()
+		s.mu.Lock()
+		sc.status.Queued--
+		sc.status.Running++
+		s.mu.Unlock()
+	default:
+		s.mu.Lock()
+		sc.status.Running++
+		s.mu.Unlock()
+	}
+
+	s.run(sc)
+}
+
+func (s *Scheduler) run(sc *schedule) {
+	slog.Debug("Running scheduled function", "schedule", sc.config.Name, "wasm_file", sc.config.Function)
+
+	start := time.Now()
+	_, _, err := s.Executor(sc.config.Function, sc.config.CPULimit, sc.config.MemoryLimit, sc.config.Input)
+	end := time.Now()
+
+	lastRun := &RunStatus{
+		StartedAt:  start,
+		FinishedAt: end,
+		DurationMS: end.Sub(start).Milliseconds(),
+		Succeeded:  err == nil,
+	}
+	if err != nil {
+		lastRun.Error = err.Error()
+		slog.Error("Scheduled run failed", "schedule", sc.config.Name, "reason", err)
+	}
+
+	s.mu.Lock()
+	sc.status.Running--
+	sc.status.Runs++
+	if err != nil {
+		sc.status.Failures++
+	}
+	sc.status.LastRun = lastRun
+	s.mu.Unlock()
+}
+
+// Status returns a snapshot of every schedule ordered by name.
+func (s *Scheduler) Status() []ScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]ScheduleStatus, 0, len(s.schedules))
+	for _, sc := range s.schedules {
+		status := sc.status
+		status.NextRun = s.cron.Entry(sc.entryID).Next
+		if sc.status.LastRun != nil {
+			lastRun := *sc.status.LastRun
+			status.LastRun = &lastRun
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
+}
@@ -0,0 +1,80 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+	"webserver/internal/config"
+
+	"github.com/robfig/cron/v3"
+)
+
+func TestValidateScheduleParsesLimits(t *testing.T) {
+	sc := config.ScheduleConfig{Name: "nightly", Cron: "@daily", Function: "cleanup.wasm", CPULimit: "500m", MemoryLimit: "1Gi"}
+	if err := validateSchedule(&sc); err != nil {
+		t.Fatal(err)
+	}
+	if sc.CPULimit != "500" || sc.MemoryLimit != "1024" {
+		t.Fatalf("got cpu_limit %q and memory_limit %q", sc.CPULimit, sc.MemoryLimit)
+	}
+
+	for _, limits := range [][2]string{{"half", "200Mi"}, {"500m", "200Mb"}, {"500m", "512"}} {
+		sc := config.ScheduleConfig{Name: "nightly", Cron: "@daily", Function: "cleanup.wasm", CPULimit: limits[0], MemoryLimit: limits[1]}
+		if err := validateSchedule(&sc); err == nil {
+			t.Errorf("cpu_limit %q and memory_limit %q were accepted", limits[0], limits[1])
+		}
+	}
+}
+
+func TestQueueCoalescesPendingRuns(t *testing.T) {
+	release := make(chan struct{})
+	s := &Scheduler{
+		Executor: func(wasmFile, cpuLimit, memLimit, wasmParam string) (string, map[string]string, error) {
+			<-release
+			return "", nil, nil
+		},
+		cron: cron.New(),
+	}
+	sc := &schedule{config: config.ScheduleConfig{Name: "nightly", Overlap: OverlapQueue}}
+	s.schedules = []*schedule{sc}
+
+	done := make(chan struct{})
+	trigger := func() {
+		go func() {
+			s.trigger(sc)
+			done <- struct{}{}
+		}()
+	}
+
+	trigger()
+	waitForStatus(t, s, func(status ScheduleStatus) bool { return status.Running == 1 })
+	trigger()
+	waitForStatus(t, s, func(status ScheduleStatus) bool { return status.Queued == 1 })
+
+	// Ticks while a run is queued are coalesced into it
+	for range 3 {
+		trigger()
+		<-done
+	}
+	if status := s.Status()[0]; status.Queued != 1 || status.Skipped != 3 {
+		t.Fatalf("queued %d, skipped %d", status.Queued, status.Skipped)
+	}
+
+	for range 2 {
+		release <- struct{}{}
+		<-done
+	}
+	if status := s.Status()[0]; status.Queued != 0 || status.Runs != 2 {
+		t.Fatalf("queued %d, runs %d after the queue drained", status.Queued, status.Runs)
+	}
+}
+
+func waitForStatus(t *testing.T, s *Scheduler, ok func(ScheduleStatus) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok(s.Status()[0]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected status %+v", s.Status()[0])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,196 @@
+package scratch
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/utils"
+)
+
+// GuestPath is where the scratch directory is preopened inside the guest.
+const GuestPath = "/tmp"
+
+var ErrQuotaExceeded = errors.New("scratch directory exceeded its quota")
+
+// Dir is the scratch directory of one invocation.
+type Dir struct {
+	Path     string
+	quotaMiB int
+	mounted  bool
+	exceeded atomic.Bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Err returns ErrQuotaExceeded once the polled usage of the directory went above its
+// quota. Directories on their own tmpfs never exceed it, writes fail with ENOSPC instead.
+func (d *Dir) Err() error {
+	if d.exceeded.Load() {
+		return fmt.Errorf("%w of %s", ErrQuotaExceeded, utils.FormatMemory(d.quotaMiB))
+	}
+	return nil
+}
+
+// ScratchManager gives invocations a private directory, preopened as /tmp, that is
+// removed once they finish. Each directory is a tmpfs mounted with the quota as its size
+// when SCRATCH_TMPFS is set and mounting is allowed. Otherwise it is a plain directory
+// whose usage is polled, and onExceeded is called when it goes above the quota.
+type ScratchManager struct {
+	Config *config.ScratchConfig
+	tmpfs  bool
+	dirs   map[string]*Dir
+	mu     sync.Mutex
+}
+
+func (sm *ScratchManager) Init() error {
+	sm.dirs = make(map[string]*Dir)
+
+	if err := os.MkdirAll(sm.Config.ScratchDir, 0700); err != nil {
+		return err
+	}
+
+	// Directories left behind by a previous run
+	entries, err := os.ReadDir(sm.Config.ScratchDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(sm.Config.ScratchDir, entry.Name())
+		syscall.Unmount(path, syscall.MNT_DETACH)
+		if err := os.RemoveAll(path); err != nil {
+			slog.Error("Failed to remove scratch directory", "path", path, "reason", err)
+		}
+	}
+
+	if sm.Config.ScratchTmpfs {
+		sm.tmpfs = sm.canMount()
+		if !sm.tmpfs {
+			slog.Warn("Can not mount tmpfs scratch directories, polling their usage instead", "dir", sm.Config.ScratchDir)
+		}
+	}
+
+	slog.Info("Using scratch directories", "dir", sm.Config.ScratchDir, "tmpfs", sm.tmpfs, "quota_mb", sm.Config.ScratchQuotaMB)
+	return nil
+}
+
+func (sm *ScratchManager) canMount() bool {
+	probe, err := os.MkdirTemp(sm.Config.ScratchDir, ".probe-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(probe)
+
+	if err := mountTmpfs(probe, 1<<20); err != nil {
+		slog.Debug("Failed to mount tmpfs", "reason", err)
+		return false
+	}
+	syscall.Unmount(probe, syscall.MNT_DETACH)
+	return true
+}
+
+func mountTmpfs(path string, size int64) error {
+	return syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, fmt.Sprintf("size=%d,mode=0700", size))
+}
+
+// Create makes the scratch directory of the invocation id, limited to quotaMiB, or to
+// SCRATCH_QUOTA_MB when it is zero.
+func (sm *ScratchManager) Create(id string, quotaMiB int, onExceeded func()) (*Dir, error) {
+	if quotaMiB == 0 {
+		quotaMiB = sm.Config.ScratchQuotaMB
+	}
+
+	dir := &Dir{Path: filepath.Join(sm.Config.ScratchDir, id), quotaMiB: quotaMiB}
+	if err := os.Mkdir(dir.Path, 0700); err != nil {
+		return nil, err
+	}
+
+	if sm.tmpfs {
+		if err := mountTmpfs(dir.Path, int64(quotaMiB)<<20); err != nil {
+			os.Remove(dir.Path)
+			return nil, fmt.Errorf("failed to mount scratch directory: %v", err)
+		}
+		dir.mounted = true
+	} else {
+		dir.stop, dir.done = make(chan struct{}), make(chan struct{})
+		go dir.poll(time.Duration(sm.Config.ScratchPollIntervalMS)*time.Millisecond, onExceeded)
+	}
+
+	sm.mu.Lock()
+	sm.dirs[id] = dir
+	sm.mu.Unlock()
+
+	return dir, nil
+}
+
+func (d *Dir) poll(interval time.Duration, onExceeded func()) {
+	defer close(d.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			if usage(d.Path) > int64(d.quotaMiB)<<20 {
+				d.exceeded.Store(true)
+				if onExceeded != nil {
+					onExceeded()
+				}
+				return
+			}
+		}
+	}
+}
+
+// usage sums the sizes of the files under path. Files removed while walking are skipped.
+func usage(path string) int64 {
+	var total int64
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// Release removes the scratch directory of the invocation id, if it has one.
+func (sm *ScratchManager) Release(id string) {
+	sm.mu.Lock()
+	dir, ok := sm.dirs[id]
+	delete(sm.dirs, id)
+	sm.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	if dir.stop != nil {
+		close(dir.stop)
+		<-dir.done
+	}
+	if dir.mounted {
+		if err := syscall.Unmount(dir.Path, syscall.MNT_DETACH); err != nil {
+			slog.Error("Failed to unmount scratch directory", "path", dir.Path, "reason", err)
+		}
+	}
+	if err := os.RemoveAll(dir.Path); err != nil {
+		slog.Error("Failed to remove scratch directory", "path", dir.Path, "reason", err)
+		return
+	}
+
+	slog.Debug("Released the scratch directory", "path", dir.Path, "time", time.Since(start))
+}
@@ -0,0 +1,106 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"webserver/internal/config"
+)
+
+const redacted = "[redacted]"
+
+var (
+	ErrDisabled   = errors.New("no secrets directory is configured")
+	ErrNotMounted = errors.New("secret is not mounted")
+
+	// Names are file names, and can not start with a dot like the hidden entries of
+	// Kubernetes secret volumes
+	nameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+)
+
+// Value is the value of a secret. It formats and logs as "[redacted]", so that it can not
+// end up in logs or responses by accident.
+type Value string
+
+func (v Value) String() string {
+	return redacted
+}
+
+func (v Value) GoString() string {
+	return redacted
+}
+
+func (v Value) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+// Secrets are the secrets of an invocation by name.
+type Secrets map[string]Value
+
+// ValidName checks that name can be the file of a secret.
+func ValidName(name string) error {
+	if !nameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid secret name %q", name)
+	}
+	return nil
+}
+
+// SecretStore reads secrets from the files of SECRETS_DIR, such as a mounted Kubernetes
+// secret. They are read for every invocation, so rotated secrets are picked up.
+type SecretStore struct {
+	Config *config.SecretsConfig
+}
+
+func (ss *SecretStore) Init() error {
+	if !ss.Enabled() {
+		return nil
+	}
+
+	info, err := os.Stat(ss.Config.SecretsDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("secrets directory %s is not a directory", ss.Config.SecretsDir)
+	}
+
+	slog.Info("Using secrets", "dir", ss.Config.SecretsDir)
+	return nil
+}
+
+func (ss *SecretStore) Enabled() bool {
+	return ss.Config.SecretsDir != ""
+}
+
+// Read returns the secrets declared by a function's manifest.
+func (ss *SecretStore) Read(declared []config.SecretManifest) (Secrets, error) {
+	secrets := make(Secrets, len(declared))
+	if len(declared) == 0 {
+		return secrets, nil
+	}
+	if !ss.Enabled() {
+		return nil, ErrDisabled
+	}
+
+	for _, secret := range declared {
+		// Manifests are validated when they are loaded
+		if err := ValidName(secret.Name); err != nil {
+			return nil, err
+		}
+
+		// Errors name the secret but not its path
+		value, err := os.ReadFile(filepath.Join(ss.Config.SecretsDir, secret.Name))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrNotMounted, secret.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret %s", secret.Name)
+		}
+		secrets[secret.Name] = Value(value)
+	}
+
+	return secrets, nil
+}
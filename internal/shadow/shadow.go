@@ -0,0 +1,190 @@
+package shadow
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"webserver/internal/config"
+)
+
+// ErrUnsupported is returned by executors when the shadow runtime can not run the function.
+// Such samples are counted as unsupported rather than compared.
+var ErrUnsupported = errors.New("function can not run on the shadow runtime")
+
+// Executor runs an invocation on the given runtime in a low-priority cgroup. A seed
+// makes it deterministic, like the primary invocation it shadows.
+type Executor func(runtime, wasmFile, cpuLimit, memLimit, wasmParam, seed string) (string, error)
+
+// Result is the outcome of one execution of a function.
+type Result struct {
+	Runtime  string
+	Output   string
+	Err      error
+	Duration time.Duration
+}
+
+type FunctionStats struct {
+	Function         string  `json:"function"`
+	Compared         int64   `json:"compared"`
+	OutputMismatches int64   `json:"output_mismatches"`
+	ErrorMismatches  int64   `json:"error_mismatches"`
+	Dropped          int64   `json:"dropped"`
+	Unsupported      int64   `json:"unsupported"`
+	PrimaryMeanMS    float64 `json:"primary_mean_ms"`
+	ShadowMeanMS     float64 `json:"shadow_mean_ms"`
+
+	primaryTotal time.Duration
+	shadowTotal  time.Duration
+}
+
+// ShadowRunner re-executes a sampled fraction of invocations on the other runtime and
+// compares the results with the primary ones, without affecting the primary response.
+type ShadowRunner struct {
+	Config   *config.ShadowConfig
+	Executor Executor
+	slots    chan struct{}
+	stats    map[string]*FunctionStats
+	mu       sync.Mutex
+}
+
+func (sr *ShadowRunner) Init() {
+	sr.slots = make(chan struct{}, max(sr.Config.ShadowMaxConcurrent, 1))
+	sr.stats = make(map[string]*FunctionStats)
+}
+
+func (sr *ShadowRunner) Enabled() bool {
+	return sr.Config.ShadowSampleRate > 0
+}
+
+// Sample decides whether an invocation should be shadowed.
+func (sr *ShadowRunner) Sample() bool {
+	return sr.Enabled() && rand.Float64() < sr.Config.ShadowSampleRate
+}
+
+// Submit runs the shadow execution in the background. It is dropped when too many
+// shadow executions are already running, so shadowing never queues up work. Shadows of
+// deterministic invocations run with the same seed, so their outputs can be compared.
+func (sr *ShadowRunner) Submit(primary Result, shadowRuntime, wasmFile, cpuLimit, memLimit, wasmParam, seed string) {
+	select {
+	case sr.slots <- struct{}{}:
+	default:
+		sr.update(wasmFile, func(stats *FunctionStats) { stats.Dropped++ })
+		return
+	}
+
+	go func() {
+		defer func() { <-sr.slots }()
+
+		start := time.Now()
+		output, err := sr.Executor(shadowRuntime, wasmFile, cpuLimit, memLimit, wasmParam, seed)
+		sr.compare(wasmFile, primary, Result{Runtime: shadowRuntime, Output: output, Err: err, Duration: time.Since(start)})
+	}()
+}
+
+// Unsupported counts a sampled invocation that was not shadowed because the other runtime
+// can not run the function, e.g. a native artifact compiled for the primary runtime.
+func (sr *ShadowRunner) Unsupported(wasmFile string) {
+	sr.update(wasmFile, func(stats *FunctionStats) { stats.Unsupported++ })
+}
+
+// normalize ignores the trailing newlines and NUL bytes runtimes add to outputs.
+func normalize(output string) string {
+	return strings.TrimRight(output, "\x00\r\n")
+}
+
+// digest identifies an output in logs without leaking its content.
+func digest(output string) string {
+	sum := sha256.Sum256([]byte(output))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (sr *ShadowRunner) compare(wasmFile string, primary, shadow Result) {
+	// An error the primary runtime could not have had is not a mismatch
+	if errors.Is(shadow.Err, ErrUnsupported) {
+		sr.Unsupported(wasmFile)
+		slog.Debug("Shadow execution unsupported", "function", wasmFile, "shadow_runtime", shadow.Runtime, "reason", shadow.Err)
+		return
+	}
+
+	primaryOutput, shadowOutput := normalize(primary.Output), normalize(shadow.Output)
+	errorMismatch := (primary.Err == nil) != (shadow.Err == nil)
+	outputMismatch := !errorMismatch && primary.Err == nil && primaryOutput != shadowOutput
+
+	sr.update(wasmFile, func(stats *FunctionStats) {
+		stats.Compared++
+		stats.primaryTotal += primary.Duration
+		stats.shadowTotal += shadow.Duration
+		if errorMismatch {
+			stats.ErrorMismatches++
+		}
+		if outputMismatch {
+			stats.OutputMismatches++
+		}
+	})
+
+	attrs := []any{
+		"function", wasmFile,
+		"primary_runtime", primary.Runtime,
+		"shadow_runtime", shadow.Runtime,
+		"primary_ms", primary.Duration.Milliseconds(),
+		"shadow_ms", shadow.Duration.Milliseconds(),
+	}
+
+	switch {
+	case errorMismatch:
+		slog.Warn("Shadow execution error mismatch", append(attrs, "primary_error", errorString(primary.Err), "shadow_error", errorString(shadow.Err))...)
+	case outputMismatch:
+		slog.Warn("Shadow execution output mismatch", append(attrs,
+			"primary_output_length", len(primaryOutput), "primary_output_sha256", digest(primaryOutput),
+			"shadow_output_length", len(shadowOutput), "shadow_output_sha256", digest(shadowOutput))...)
+	default:
+		slog.Debug("Shadow execution matched", attrs...)
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (sr *ShadowRunner) update(wasmFile string, change func(stats *FunctionStats)) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	stats, ok := sr.stats[wasmFile]
+	if !ok {
+		stats = &FunctionStats{Function: wasmFile}
+		sr.stats[wasmFile] = stats
+	}
+	change(stats)
+}
+
+// Stats returns the comparison results of every shadowed function.
+func (sr *ShadowRunner) Stats() []FunctionStats {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	result := make([]FunctionStats, 0, len(sr.stats))
+	for _, stats := range sr.stats {
+		summary := *stats
+		if stats.Compared > 0 {
+			summary.PrimaryMeanMS = float64(stats.primaryTotal) / float64(time.Millisecond) / float64(stats.Compared)
+			summary.ShadowMeanMS = float64(stats.shadowTotal) / float64(time.Millisecond) / float64(stats.Compared)
+		}
+		result = append(result, summary)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Function < result[j].Function
+	})
+
+	return result
+}
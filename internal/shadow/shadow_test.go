@@ -0,0 +1,68 @@
+package shadow
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"webserver/internal/config"
+)
+
+func newTestRunner() *ShadowRunner {
+	sr := &ShadowRunner{Config: &config.ShadowConfig{ShadowSampleRate: 1, ShadowMaxConcurrent: 1}}
+	sr.Init()
+	return sr
+}
+
+func TestCompare(t *testing.T) {
+	sr := newTestRunner()
+	primary := Result{Runtime: "wasmtime", Output: "hello\n"}
+
+	sr.compare("f", primary, Result{Runtime: "wasmedge", Output: "hello\x00"})
+	sr.compare("f", primary, Result{Runtime: "wasmedge", Output: "world"})
+	sr.compare("f", primary, Result{Runtime: "wasmedge", Err: errors.New("trap")})
+	sr.compare("f", primary, Result{Runtime: "wasmedge", Err: fmt.Errorf("%w: wasmedge", ErrUnsupported)})
+	sr.Unsupported("f")
+
+	stats := sr.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("got %d functions", len(stats))
+	}
+	got := stats[0]
+	if got.Compared != 3 || got.OutputMismatches != 1 || got.ErrorMismatches != 1 || got.Unsupported != 2 {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestSubmitCountsUnsupported(t *testing.T) {
+	sr := newTestRunner()
+	done := make(chan struct{})
+	sr.Executor = func(runtime, wasmFile, cpuLimit, memLimit, wasmParam, seed string) (string, error) {
+		defer close(done)
+		return "", ErrUnsupported
+	}
+
+	sr.Submit(Result{Runtime: "wasmtime", Err: errors.New("trap")}, "wasmedge", "f", "", "", "", "")
+	<-done
+
+	// The slot is freed once the comparison is recorded
+	sr.slots <- struct{}{}
+
+	got := sr.Stats()[0]
+	if got.Compared != 0 || got.ErrorMismatches != 0 || got.Unsupported != 1 {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestSubmitPassesSeed(t *testing.T) {
+	sr := newTestRunner()
+	seeds := make(chan string, 1)
+	sr.Executor = func(runtime, wasmFile, cpuLimit, memLimit, wasmParam, seed string) (string, error) {
+		seeds <- seed
+		return "", nil
+	}
+
+	sr.Submit(Result{Runtime: "wasmtime"}, "wasmedge", "f", "", "", "", "42")
+	if seed := <-seeds; seed != "42" {
+		t.Fatalf("shadow ran with seed %q", seed)
+	}
+}
@@ -0,0 +1,272 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"webserver/internal/config"
+)
+
+// FileSuffix is appended to a module's path to find its signature.
+const FileSuffix = ".sig"
+
+const (
+	StatusVerified = "verified"
+	StatusUnsigned = "unsigned"
+	StatusInvalid  = "invalid"
+	// StatusDisabled is reported when no trusted keys are configured.
+	StatusDisabled = "disabled"
+)
+
+var (
+	ErrUnsigned         = errors.New("module is not signed")
+	ErrInvalidSignature = errors.New("module signature does not match any trusted key")
+)
+
+// Result is the outcome of verifying a module.
+type Result struct {
+	Status string `json:"status"`
+	KeyID  string `json:"key_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Err returns why a module with this result must not be used, or nil.
+func (r Result) Err(required bool) error {
+	switch {
+	case r.Status == StatusInvalid:
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, r.Error)
+	case r.Status == StatusUnsigned && required:
+		return ErrUnsigned
+	}
+	return nil
+}
+
+type trustedKey struct {
+	id  string
+	key any
+}
+
+// verifiedModule caches a result for as long as the content of the module and its
+// signature are unchanged. File metadata is not enough, as it can be restored after
+// replacing the module.
+type verifiedModule struct {
+	digest    [sha256.Size]byte
+	signature []byte
+	result    Result
+}
+
+// SignatureVerifier checks module signatures against the public keys in TrustedKeysDir.
+// Ed25519 signatures are made over the module, ECDSA P-256 signatures (as made by
+// "cosign sign-blob") over its SHA-256 digest. Signatures are stored base64 encoded.
+type SignatureVerifier struct {
+	Config   *config.SignatureConfig
+	keys     []trustedKey
+	verified map[string]verifiedModule
+	mu       sync.Mutex
+}
+
+func (sv *SignatureVerifier) Init() error {
+	sv.verified = make(map[string]verifiedModule)
+
+	if sv.Config.TrustedKeysDir == "" {
+		if sv.Config.RequireSignatures {
+			return errors.New("REQUIRE_SIGNATURES is set but TRUSTED_KEYS_DIR is not")
+		}
+		return nil
+	}
+
+	entries, err := os.ReadDir(sv.Config.TrustedKeysDir)
+	if err != nil {
+		return fmt.Errorf("failed to read trusted keys: %v", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(sv.Config.TrustedKeysDir, entry.Name())
+		key, err := readPublicKey(path)
+		if err != nil {
+			return fmt.Errorf("invalid trusted key %s: %v", path, err)
+		}
+
+		id := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		sv.keys = append(sv.keys, trustedKey{id: id, key: key})
+		slog.Info("Loaded trusted key", "key_id", id)
+	}
+
+	if len(sv.keys) == 0 && sv.Config.RequireSignatures {
+		return fmt.Errorf("no trusted keys in %s", sv.Config.TrustedKeysDir)
+	}
+
+	return nil
+}
+
+func readPublicKey(path string) (any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("expected a PEM encoded PUBLIC KEY")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return key, nil
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().Name != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+func (sv *SignatureVerifier) Enabled() bool {
+	return len(sv.keys) > 0
+}
+
+// Path returns where the signature of the module at modulePath is stored.
+func Path(modulePath string) string {
+	return modulePath + FileSuffix
+}
+
+// Verify checks the module at modulePath against the signature stored next to it.
+func (sv *SignatureVerifier) Verify(modulePath string) Result {
+	if !sv.Enabled() {
+		return Result{Status: StatusDisabled}
+	}
+
+	module, err := os.ReadFile(modulePath)
+	if err != nil {
+		return Result{Status: StatusInvalid, Error: err.Error()}
+	}
+	return sv.VerifyModule(modulePath, module)
+}
+
+// VerifyModule checks module, the content of the module at modulePath, against the
+// signature stored next to it. Callers that go on using the module must use module
+// rather than read the file again, which could have been replaced in the meantime.
+func (sv *SignatureVerifier) VerifyModule(modulePath string, module []byte) Result {
+	if !sv.Enabled() {
+		return Result{Status: StatusDisabled}
+	}
+
+	signature, err := os.ReadFile(Path(modulePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return Result{Status: StatusUnsigned}
+	} else if err != nil {
+		return Result{Status: StatusInvalid, Error: err.Error()}
+	}
+
+	digest := sha256.Sum256(module)
+	sv.mu.Lock()
+	cached, ok := sv.verified[modulePath]
+	sv.mu.Unlock()
+	if ok && cached.digest == digest && bytes.Equal(cached.signature, signature) {
+		return cached.result
+	}
+
+	result := sv.verify(module, digest, signature)
+	if result.Status == StatusInvalid {
+		slog.Warn("Module signature verification failed", "module", modulePath, "reason", result.Error)
+	}
+
+	sv.mu.Lock()
+	sv.verified[modulePath] = verifiedModule{digest: digest, signature: signature, result: result}
+	sv.mu.Unlock()
+
+	return result
+}
+
+// VerifySignature checks module against a base64 encoded signature.
+func (sv *SignatureVerifier) VerifySignature(module, encoded []byte) Result {
+	if !sv.Enabled() {
+		return Result{Status: StatusDisabled}
+	}
+	return sv.verify(module, sha256.Sum256(module), encoded)
+}
+
+func (sv *SignatureVerifier) verify(module []byte, digest [sha256.Size]byte, encoded []byte) Result {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return Result{Status: StatusInvalid, Error: "signature is not base64 encoded"}
+	}
+
+	for _, trusted := range sv.keys {
+		var ok bool
+		switch key := trusted.key.(type) {
+		case ed25519.PublicKey:
+			ok = ed25519.Verify(key, module, signature)
+		case *ecdsa.PublicKey:
+			ok = ecdsa.VerifyASN1(key, digest[:], signature)
+		}
+		if ok {
+			return Result{Status: StatusVerified, KeyID: trusted.id}
+		}
+	}
+
+	ids := make([]string, 0, len(sv.keys))
+	for _, trusted := range sv.keys {
+		ids = append(ids, trusted.id)
+	}
+	sort.Strings(ids)
+
+	return Result{Status: StatusInvalid, Error: "tried keys " + strings.Join(ids, ", ")}
+}
+
+// Admit verifies a module before it is stored, against the base64 encoded signature
+// uploaded with it, and refuses it the way Check would.
+func (sv *SignatureVerifier) Admit(modulePath string, encoded []byte) (Result, error) {
+	result := Result{Status: StatusDisabled}
+	if sv.Enabled() && len(encoded) == 0 {
+		result = Result{Status: StatusUnsigned}
+	} else if sv.Enabled() {
+		module, err := os.ReadFile(modulePath)
+		if err != nil {
+			return Result{}, err
+		}
+		result = sv.VerifySignature(module, encoded)
+	}
+
+	return result, result.Err(sv.Config.RequireSignatures)
+}
+
+// Forget drops the cached result of a deleted module.
+func (sv *SignatureVerifier) Forget(modulePath string) {
+	sv.mu.Lock()
+	delete(sv.verified, modulePath)
+	sv.mu.Unlock()
+}
+
+// Check refuses modules whose signature is invalid, and unsigned modules when signatures
+// are required. It is called with the content of the module at modulePath before it is
+// compiled or executed from that content.
+func (sv *SignatureVerifier) Check(modulePath string, module []byte) error {
+	if err := sv.VerifyModule(modulePath, module).Err(sv.Config.RequireSignatures); err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(modulePath), err)
+	}
+	return nil
+}
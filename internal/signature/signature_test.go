@@ -0,0 +1,233 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"webserver/internal/config"
+)
+
+// writeKey stores the PEM encoded public key as <id>.pub in dir.
+func writeKey(t *testing.T, dir, id string, key crypto.PublicKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, id+".pub"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeModule stores module and, unless signature is nil, its base64 encoded signature.
+func writeModule(t *testing.T, path string, module, signature []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, module, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if signature != nil {
+		encoded := base64.StdEncoding.EncodeToString(signature) + "\n"
+		if err := os.WriteFile(Path(path), []byte(encoded), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type keys struct {
+	ed25519 ed25519.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+}
+
+// newVerifier returns a verifier trusting a new Ed25519 and a new ECDSA P-256 key.
+func newVerifier(t *testing.T, required bool) (*SignatureVerifier, keys) {
+	t.Helper()
+	dir := t.TempDir()
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKey(t, dir, "ed", edPublic)
+
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKey(t, dir, "cosign", &ecPrivate.PublicKey)
+
+	sv := &SignatureVerifier{Config: &config.SignatureConfig{TrustedKeysDir: dir, RequireSignatures: required}}
+	if err := sv.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return sv, keys{ed25519: edPrivate, ecdsa: ecPrivate}
+}
+
+// cosignSign signs module like "cosign sign-blob", over its SHA-256 digest.
+func cosignSign(t *testing.T, key *ecdsa.PrivateKey, module []byte) []byte {
+	t.Helper()
+	digest := sha256.Sum256(module)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func TestVerify(t *testing.T) {
+	sv, keys := newVerifier(t, false)
+	dir := t.TempDir()
+	module := []byte("\x00asm\x01\x00\x00\x00module")
+
+	edPath := filepath.Join(dir, "ed.wasm")
+	writeModule(t, edPath, module, ed25519.Sign(keys.ed25519, module))
+	if result := sv.Verify(edPath); result.Status != StatusVerified || result.KeyID != "ed" {
+		t.Errorf("Ed25519 signed module: %+v", result)
+	}
+
+	cosignPath := filepath.Join(dir, "cosign.wasm")
+	writeModule(t, cosignPath, module, cosignSign(t, keys.ecdsa, module))
+	if result := sv.Verify(cosignPath); result.Status != StatusVerified || result.KeyID != "cosign" {
+		t.Errorf("cosign signed module: %+v", result)
+	}
+
+	_, untrusted, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrustedPath := filepath.Join(dir, "untrusted.wasm")
+	writeModule(t, untrustedPath, module, ed25519.Sign(untrusted, module))
+	if result := sv.Verify(untrustedPath); result.Status != StatusInvalid {
+		t.Errorf("module signed by an untrusted key: %+v", result)
+	}
+
+	garbledPath := filepath.Join(dir, "garbled.wasm")
+	writeModule(t, garbledPath, module, nil)
+	if err := os.WriteFile(Path(garbledPath), []byte("not base64!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if result := sv.Verify(garbledPath); result.Status != StatusInvalid {
+		t.Errorf("module with a garbled signature: %+v", result)
+	}
+
+	unsignedPath := filepath.Join(dir, "unsigned.wasm")
+	writeModule(t, unsignedPath, module, nil)
+	if result := sv.Verify(unsignedPath); result.Status != StatusUnsigned {
+		t.Errorf("unsigned module: %+v", result)
+	}
+}
+
+func TestVerifyDetectsTamperingWithRestoredMetadata(t *testing.T) {
+	sv, keys := newVerifier(t, false)
+	path := filepath.Join(t.TempDir(), "function.wasm")
+	module := []byte("\x00asm\x01\x00\x00\x00original")
+	writeModule(t, path, module, ed25519.Sign(keys.ed25519, module))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := sv.Verify(path); result.Status != StatusVerified {
+		t.Fatalf("original module: %+v", result)
+	}
+
+	// Same size and modification time, so only the content tells them apart
+	tampered := []byte("\x00asm\x01\x00\x00\x00tampered")
+	if err := os.WriteFile(path, tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, time.Time{}, info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	if result := sv.Verify(path); result.Status != StatusInvalid {
+		t.Errorf("tampered module: %+v", result)
+	}
+	if err := sv.Check(path, tampered); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Check(tampered) = %v, want ErrInvalidSignature", err)
+	}
+
+	// The file is only used for the signature, the content checked is the one given
+	if err := sv.Check(path, module); err != nil {
+		t.Errorf("Check(original) = %v", err)
+	}
+}
+
+func TestRequireSignatures(t *testing.T) {
+	module := []byte("\x00asm\x01\x00\x00\x00module")
+	for _, required := range []bool{false, true} {
+		sv, _ := newVerifier(t, required)
+		path := filepath.Join(t.TempDir(), "unsigned.wasm")
+		writeModule(t, path, module, nil)
+
+		err := sv.Check(path, module)
+		if required && !errors.Is(err, ErrUnsigned) {
+			t.Errorf("required: Check(unsigned) = %v, want ErrUnsigned", err)
+		} else if !required && err != nil {
+			t.Errorf("not required: Check(unsigned) = %v", err)
+		}
+
+		if _, err := sv.Admit(path, nil); required != errors.Is(err, ErrUnsigned) {
+			t.Errorf("required %t: Admit(unsigned) = %v", required, err)
+		}
+	}
+
+	sv := &SignatureVerifier{Config: &config.SignatureConfig{RequireSignatures: true}}
+	if err := sv.Init(); err == nil {
+		t.Error("REQUIRE_SIGNATURES without TRUSTED_KEYS_DIR was accepted")
+	}
+	sv = &SignatureVerifier{Config: &config.SignatureConfig{TrustedKeysDir: t.TempDir(), RequireSignatures: true}}
+	if err := sv.Init(); err == nil {
+		t.Error("REQUIRE_SIGNATURES without trusted keys was accepted")
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	sv, keys := newVerifier(t, true)
+	path := filepath.Join(t.TempDir(), "upload.wasm")
+	module := []byte("\x00asm\x01\x00\x00\x00module")
+	writeModule(t, path, module, nil)
+
+	signature := []byte(base64.StdEncoding.EncodeToString(cosignSign(t, keys.ecdsa, module)))
+	if result, err := sv.Admit(path, signature); err != nil || result.KeyID != "cosign" {
+		t.Errorf("Admit(signed) = %+v, %v", result, err)
+	}
+
+	forged := []byte(base64.StdEncoding.EncodeToString(cosignSign(t, keys.ecdsa, []byte("other module"))))
+	if _, err := sv.Admit(path, forged); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Admit(forged) = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestInitRejectsUnsupportedKeys(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKey(t, dir, "p384", &key.PublicKey)
+
+	sv := &SignatureVerifier{Config: &config.SignatureConfig{TrustedKeysDir: dir}}
+	if err := sv.Init(); err == nil {
+		t.Error("P-384 key was accepted")
+	}
+
+	disabled := &SignatureVerifier{Config: &config.SignatureConfig{}}
+	if err := disabled.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if result := disabled.Verify(filepath.Join(dir, "missing.wasm")); result.Status != StatusDisabled {
+		t.Errorf("verifier without keys: %+v", result)
+	}
+}
@@ -0,0 +1,238 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	WasmPageSize = 64 * 1024
+	FileSuffix   = ".snapshot"
+)
+
+var ErrStale = errors.New("snapshot does not match the module or its manifest")
+
+// Global is a mutable exported global, stored as raw bits so it is runtime agnostic.
+type Global struct {
+	Name string
+	Type string
+	Bits uint64
+}
+
+// Page is a non-zero 64KiB page of linear memory.
+type Page struct {
+	Index uint32
+	Data  []byte
+}
+
+// Snapshot is the state of an instance right after its init export returned.
+//
+// Only linear memory and exported mutable globals are captured. Unexported
+// globals such as the shadow stack pointer are expected to be back at their
+// initial value once the init export returns, which holds for Rust and C
+// toolchains targeting WASI.
+type Snapshot struct {
+	ModuleHash string
+	// ManifestHash identifies the manifest settings init ran with, and is empty for
+	// checkpoints
+	ManifestHash string
+	InitExport   string
+	MemoryPages  uint64
+	Pages        []Page
+	Globals      []Global
+	CreatedAt    time.Time
+}
+
+// Instance is the runtime specific view of an instantiated module.
+type Instance interface {
+	Memory() ([]byte, error)
+	GrowMemory(pages uint64) error
+	Globals() ([]Global, error)
+	SetGlobal(global Global) error
+}
+
+func Path(modulePath string) string {
+	return modulePath + FileSuffix
+}
+
+// Capture records the memory and globals of an instance whose init export already ran.
+func Capture(instance Instance, moduleHash, manifestHash, initExport string) (*Snapshot, error) {
+	memory, err := instance.Memory()
+	if err != nil {
+		return nil, err
+	}
+
+	globals, err := instance.Globals()
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{
+		ModuleHash:   moduleHash,
+		ManifestHash: manifestHash,
+		InitExport:   initExport,
+		MemoryPages:  uint64(len(memory) / WasmPageSize),
+		Globals:      globals,
+		CreatedAt:    time.Now(),
+	}
+
+	for offset := 0; offset < len(memory); offset += WasmPageSize {
+		page := memory[offset : offset+WasmPageSize]
+		if isZero(page) {
+			continue
+		}
+		snap.Pages = append(snap.Pages, Page{
+			Index: uint32(offset / WasmPageSize),
+			Data:  bytes.Clone(page),
+		})
+	}
+
+	return snap, nil
+}
+
+// Restore overwrites the memory and globals of a freshly instantiated module.
+func (snap *Snapshot) Restore(instance Instance) error {
+	if err := instance.GrowMemory(snap.MemoryPages); err != nil {
+		return fmt.Errorf("failed to grow memory to %d pages: %v", snap.MemoryPages, err)
+	}
+
+	memory, err := instance.Memory()
+	if err != nil {
+		return err
+	}
+
+	// Data segments were already applied by instantiation, so pages that are
+	// zero in the snapshot have to be cleared explicitly.
+	next := 0
+	for offset := 0; offset < len(memory); offset += WasmPageSize {
+		index := uint32(offset / WasmPageSize)
+		page := memory[offset : offset+WasmPageSize]
+
+		if next < len(snap.Pages) && snap.Pages[next].Index == index {
+			copy(page, snap.Pages[next].Data)
+			next++
+		} else if !isZero(page) {
+			clear(page)
+		}
+	}
+
+	for _, global := range snap.Globals {
+		if err := instance.SetGlobal(global); err != nil {
+			return fmt.Errorf("failed to restore global %s: %v", global.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Save atomically writes the snapshot so concurrent readers never see a partial file.
+func Save(path string, snap *Snapshot) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(snap); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load reads a snapshot and returns ErrStale if it was taken from a different module, or
+// with different manifest settings.
+func Load(path, moduleHash, manifestHash string) (*Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var snap Snapshot
+	if err := gob.NewDecoder(file).Decode(&snap); err != nil {
+		return nil, err
+	}
+
+	if snap.ModuleHash != moduleHash || snap.ManifestHash != manifestHash {
+		return nil, ErrStale
+	}
+
+	return &snap, nil
+}
+
+type hashEntry struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+var (
+	hashCache   = make(map[string]hashEntry)
+	hashCacheMu sync.Mutex
+)
+
+// ModuleHash returns the sha256 of a module file, recomputing it only when
+// the file size or modification time changed.
+func ModuleHash(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	hashCacheMu.Lock()
+	entry, ok := hashCache[path]
+	hashCacheMu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.hash, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	hashCacheMu.Lock()
+	hashCache[path] = hashEntry{size: info.Size(), modTime: info.ModTime(), hash: hash}
+	hashCacheMu.Unlock()
+
+	return hash, nil
+}
+
+// ForgetHash drops the cached hash of a module file, for when it was replaced without
+// its size or modification time changing.
+func ForgetHash(path string) {
+	hashCacheMu.Lock()
+	delete(hashCache, path)
+	hashCacheMu.Unlock()
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeInstance is an instance whose memory and globals are plain Go values.
+type fakeInstance struct {
+	memory  []byte
+	globals map[string]Global
+}
+
+func newFakeInstance(pages int) *fakeInstance {
+	return &fakeInstance{memory: make([]byte, pages*WasmPageSize), globals: make(map[string]Global)}
+}
+
+func (fi *fakeInstance) Memory() ([]byte, error) {
+	return fi.memory, nil
+}
+
+func (fi *fakeInstance) GrowMemory(pages uint64) error {
+	if current := uint64(len(fi.memory) / WasmPageSize); pages > current {
+		fi.memory = append(fi.memory, make([]byte, (pages-current)*WasmPageSize)...)
+	}
+	return nil
+}
+
+func (fi *fakeInstance) Globals() ([]Global, error) {
+	var globals []Global
+	for _, global := range fi.globals {
+		globals = append(globals, global)
+	}
+	return globals, nil
+}
+
+func (fi *fakeInstance) SetGlobal(global Global) error {
+	if _, ok := fi.globals[global.Name]; !ok {
+		return errors.New("global is not exported")
+	}
+	fi.globals[global.Name] = global
+	return nil
+}
+
+func TestCaptureRestore(t *testing.T) {
+	initialized := newFakeInstance(3)
+	copy(initialized.memory[2*WasmPageSize:], "initialized")
+	initialized.globals["counter"] = Global{Name: "counter", Type: "i32", Bits: 42}
+
+	snap, err := Capture(initialized, "module", "manifest", "wizer.initialize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Pages) != 1 || snap.Pages[0].Index != 2 || snap.MemoryPages != 3 {
+		t.Fatalf("captured %d pages of %d, want only page 2 of 3", len(snap.Pages), snap.MemoryPages)
+	}
+
+	// A fresh instance has its data segments applied, which init may have cleared
+	fresh := newFakeInstance(1)
+	copy(fresh.memory, "data segment")
+	fresh.globals["counter"] = Global{Name: "counter", Type: "i32"}
+
+	if err := snap.Restore(fresh); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fresh.memory, initialized.memory) {
+		t.Error("restored memory differs from the captured one")
+	}
+	if fresh.globals["counter"].Bits != 42 {
+		t.Errorf("restored counter is %d, want 42", fresh.globals["counter"].Bits)
+	}
+}
+
+func TestLoadRejectsMismatchedSnapshots(t *testing.T) {
+	instance := newFakeInstance(1)
+	copy(instance.memory, "initialized")
+	snap, err := Capture(instance, "module", "manifest", "wizer.initialize")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := Path(filepath.Join(t.TempDir(), "function.wasm"))
+	if err := Save(path, snap); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(path, "module", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Pages) != 1 || !bytes.Equal(loaded.Pages[0].Data, snap.Pages[0].Data) {
+		t.Error("loaded snapshot differs from the saved one")
+	}
+
+	for _, hashes := range [][2]string{{"other module", "manifest"}, {"module", "other manifest"}, {"module", ""}} {
+		if _, err := Load(path, hashes[0], hashes[1]); !errors.Is(err, ErrStale) {
+			t.Errorf("Load(%q, %q) = %v, want ErrStale", hashes[0], hashes[1], err)
+		}
+	}
+
+	if _, err := Load(Path(filepath.Join(t.TempDir(), "missing.wasm")), "module", "manifest"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want os.ErrNotExist", err)
+	}
+}
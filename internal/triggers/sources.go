@@ -0,0 +1,264 @@
+package triggers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxRecordSize bounds a single newline-delimited record.
+const MaxRecordSize = 16 * 1024 * 1024
+
+var errRecordTooLong = errors.New("record is longer than the maximum record size")
+
+func (tm *TriggerManager) readFIFO(t *trigger) {
+	// Opening with O_RDWR keeps a writer attached to the FIFO, so the read side
+	// neither blocks on open nor sees EOF when a producer closes its end.
+	fifo, err := os.OpenFile(t.config.FIFO, os.O_RDWR, 0)
+	if err != nil {
+		slog.Error("Failed to open trigger FIFO", "trigger", t.config.Name, "fifo", t.config.FIFO, "reason", err)
+		return
+	}
+	go func() {
+		<-tm.stop
+		fifo.Close()
+	}()
+
+	reader := bufio.NewReaderSize(fifo, 64*1024)
+	for {
+		line, _, err := readLine(reader)
+		if errors.Is(err, errRecordTooLong) {
+			// The producer keeps the FIFO, so the records after it are still read
+			slog.Error("Discarding trigger record", "trigger", t.config.Name, "reason", err, "max_record_size", MaxRecordSize)
+			continue
+		} else if err != nil {
+			select {
+			case <-tm.stop:
+			default:
+				slog.Error("Failed to read trigger FIFO", "trigger", t.config.Name, "reason", err)
+			}
+			return
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		record, ok := parseRecord(t, line)
+		if !ok {
+			continue
+		}
+
+		if !tm.dispatch(t, record) {
+			return
+		}
+	}
+}
+
+// readLine returns the next newline-terminated line of reader and the number of bytes it
+// consumed. Lines longer than MaxRecordSize are skipped up to their newline without being
+// buffered, and reported with errRecordTooLong.
+func readLine(reader *bufio.Reader) ([]byte, int64, error) {
+	var line []byte
+	var consumed int64
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		consumed += int64(len(chunk))
+		size := len(chunk)
+		if err == nil {
+			size-- // the newline
+		}
+		if !tooLong && len(line)+size > MaxRecordSize {
+			tooLong, line = true, nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case err != nil:
+			return line, consumed, err
+		case tooLong:
+			return nil, consumed, errRecordTooLong
+		}
+		return line, consumed, nil
+	}
+}
+
+const (
+	// ProcessingSuffix marks spool files whose records are being dispatched. They are
+	// resumed on startup, so a spool file is only deleted once all its records were
+	// handed to a worker.
+	ProcessingSuffix = ".processing"
+	// FailedSuffix marks spool files that could not be read to the end.
+	FailedSuffix = ".failed"
+)
+
+// pollSpool processes every file dropped into the spool directory in name order.
+// Producers should write to a dot-file and rename it once complete; dot-files are ignored.
+func (tm *TriggerManager) pollSpool(t *trigger) {
+	if !tm.recoverSpool(t) {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(t.config.PollIntervalMS) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tm.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, name := range spoolFiles(t, func(name string) bool {
+			return !strings.HasSuffix(name, ProcessingSuffix) && !strings.HasSuffix(name, FailedSuffix)
+		}) {
+			if !tm.processSpoolFile(t, filepath.Join(t.config.SpoolDir, name)) {
+				return
+			}
+		}
+	}
+}
+
+// recoverSpool resumes the files that were being processed when WasmBox stopped. Files
+// interrupted by a crash rather than a shutdown are replayed from their first record.
+func (tm *TriggerManager) recoverSpool(t *trigger) bool {
+	for _, name := range spoolFiles(t, func(name string) bool {
+		return strings.HasSuffix(name, ProcessingSuffix)
+	}) {
+		slog.Info("Resuming spool file", "trigger", t.config.Name, "file", name)
+		if !tm.processSpoolFile(t, filepath.Join(t.config.SpoolDir, name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// spoolFiles returns the names of the regular files of the spool directory accepted by
+// match, in name order. Dot-files are never returned.
+func spoolFiles(t *trigger, match func(name string) bool) []string {
+	entries, err := os.ReadDir(t.config.SpoolDir)
+	if err != nil {
+		slog.Error("Failed to read spool directory", "trigger", t.config.Name, "reason", err)
+		return nil
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") && match(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// processSpoolFile renames the file to <name>.processing and dispatches its records. It
+// is removed once every record was dispatched. When the manager stops first, the records
+// that were not dispatched are kept in the .processing file for the next start.
+func (tm *TriggerManager) processSpoolFile(t *trigger, path string) bool {
+	if !strings.HasSuffix(path, ProcessingSuffix) {
+		processing := path + ProcessingSuffix
+		if err := os.Rename(path, processing); err != nil {
+			slog.Error("Failed to claim spool file", "trigger", t.config.Name, "file", path, "reason", err)
+			return true
+		}
+		path = processing
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		slog.Error("Failed to open spool file", "trigger", t.config.Name, "file", path, "reason", err)
+		return true
+	}
+	defer file.Close()
+
+	// offset counts the bytes consumed so far, so that the start of the current record is
+	// known when the manager stops before dispatching it
+	var offset int64
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		recordStart := offset
+		line, consumed, err := readLine(reader)
+		offset += consumed
+		if errors.Is(err, errRecordTooLong) {
+			slog.Error("Discarding trigger record", "trigger", t.config.Name, "file", path, "reason", err, "max_record_size", MaxRecordSize)
+			continue
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			slog.Error("Failed to read spool file", "trigger", t.config.Name, "file", path, "reason", err)
+			failed := strings.TrimSuffix(path, ProcessingSuffix) + FailedSuffix
+			if err := os.Rename(path, failed); err != nil {
+				slog.Error("Failed to set aside spool file", "trigger", t.config.Name, "file", path, "reason", err)
+			}
+			return true
+		}
+		last := err != nil
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			if last {
+				break
+			}
+			continue
+		}
+
+		if record, ok := parseRecord(t, line); ok && !tm.dispatch(t, record) {
+			if err := truncateFront(path, recordStart); err != nil {
+				slog.Error("Failed to save the rest of the spool file, it will be replayed", "trigger", t.config.Name, "file", path, "reason", err)
+			}
+			return false
+		}
+		if last {
+			break
+		}
+	}
+
+	if err := os.Remove(path); err != nil {
+		slog.Error("Failed to remove spool file", "trigger", t.config.Name, "file", path, "reason", err)
+	}
+
+	return true
+}
+
+// truncateFront atomically replaces the file at path with its content from offset on.
+func truncateFront(path string, offset int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// A dot-file is never picked up by the poller
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".rest-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,162 @@
+package triggers
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"webserver/internal/config"
+	"webserver/internal/utils"
+)
+
+func newSpoolTrigger(t *testing.T) (*TriggerManager, *trigger) {
+	t.Helper()
+	tm := &TriggerManager{stop: make(chan struct{})}
+	tr := &trigger{
+		config:  config.TriggerConfig{Name: "test", SpoolDir: t.TempDir()},
+		records: make(chan Record),
+	}
+	return tm, tr
+}
+
+func writeSpoolFile(t *testing.T, tr *trigger, name, content string) string {
+	t.Helper()
+	path := filepath.Join(tr.config.SpoolDir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// receive collects the IDs of n dispatched records.
+func receive(tr *trigger, n int) <-chan []string {
+	ids := make(chan []string, 1)
+	go func() {
+		var received []string
+		for range n {
+			received = append(received, (<-tr.records).ID)
+		}
+		ids <- received
+	}()
+	return ids
+}
+
+func TestProcessSpoolFile(t *testing.T) {
+	tm, tr := newSpoolTrigger(t)
+	path := writeSpoolFile(t, tr, "batch", "{\"id\": \"1\"}\n\nnot json\n{\"id\": \"2\"}")
+
+	ids := receive(tr, 2)
+	if !tm.processSpoolFile(tr, path) {
+		t.Fatal("processSpoolFile stopped")
+	}
+
+	if got := <-ids; len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Fatalf("dispatched %v", got)
+	}
+	if entries, _ := os.ReadDir(tr.config.SpoolDir); len(entries) != 0 {
+		t.Fatalf("spool directory not empty: %v", entries)
+	}
+}
+
+func TestProcessSpoolFileSkipsOversizedRecords(t *testing.T) {
+	tm, tr := newSpoolTrigger(t)
+	path := writeSpoolFile(t, tr, "batch", "{\"id\": \"1\"}\n"+strings.Repeat("x", MaxRecordSize+1)+"\n{\"id\": \"2\"}\n")
+
+	ids := receive(tr, 2)
+	if !tm.processSpoolFile(tr, path) {
+		t.Fatal("processSpoolFile stopped")
+	}
+
+	if got := <-ids; len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Fatalf("dispatched %v", got)
+	}
+	if entries, _ := os.ReadDir(tr.config.SpoolDir); len(entries) != 0 {
+		t.Fatalf("spool directory not empty: %v", entries)
+	}
+}
+
+func TestProcessSpoolFileKeepsUndispatchedRecords(t *testing.T) {
+	tm, tr := newSpoolTrigger(t)
+	path := writeSpoolFile(t, tr, "batch", "{\"id\": \"1\"}\n{\"id\": \"2\"}\n{\"id\": \"3\"}\n")
+
+	// Stop once the first record was dispatched
+	ids := receive(tr, 1)
+	go func() {
+		<-ids
+		close(tm.stop)
+	}()
+	if tm.processSpoolFile(tr, path) {
+		t.Fatal("processSpoolFile did not stop")
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("original file still exists: %v", err)
+	}
+	rest, err := os.ReadFile(path + ProcessingSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "{\"id\": \"2\"}\n{\"id\": \"3\"}\n" {
+		t.Fatalf("kept %q", rest)
+	}
+
+	// The next start resumes the .processing file
+	tm, _ = newSpoolTrigger(t)
+	resumed := receive(tr, 2)
+	if !tm.recoverSpool(tr) {
+		t.Fatal("recoverSpool stopped")
+	}
+	if got := <-resumed; got[0] != "2" || got[1] != "3" {
+		t.Fatalf("resumed %v", got)
+	}
+	if entries, _ := os.ReadDir(tr.config.SpoolDir); len(entries) != 0 {
+		t.Fatalf("spool directory not empty: %v", entries)
+	}
+}
+
+func TestRecoverSpoolIgnoresNewFiles(t *testing.T) {
+	tm, tr := newSpoolTrigger(t)
+	writeSpoolFile(t, tr, "new", "{\"id\": \"1\"}\n")
+	writeSpoolFile(t, tr, ".partial"+ProcessingSuffix, "{\"id\": \"2\"}\n")
+
+	if !tm.recoverSpool(tr) {
+		t.Fatal("recoverSpool stopped")
+	}
+	if entries, _ := os.ReadDir(tr.config.SpoolDir); len(entries) != 2 {
+		t.Fatalf("files were consumed: %v", entries)
+	}
+}
+
+func TestReadFIFOSkipsOversizedRecords(t *testing.T) {
+	tm := &TriggerManager{stop: make(chan struct{})}
+	tr := &trigger{
+		config:  config.TriggerConfig{Name: "test", FIFO: filepath.Join(t.TempDir(), "in")},
+		records: make(chan Record),
+	}
+	if err := utils.CreatePipe(tr.config.FIFO); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tm.readFIFO(tr)
+		close(done)
+	}()
+
+	go func() {
+		fifo, err := os.OpenFile(tr.config.FIFO, os.O_WRONLY, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer fifo.Close()
+		fifo.WriteString("{\"id\": \"1\"}\n" + strings.Repeat("x", MaxRecordSize+1) + "\n{\"id\": \"2\"}\n")
+	}()
+
+	if got := <-receive(tr, 2); got[0] != "1" || got[1] != "2" {
+		t.Fatalf("dispatched %v", got)
+	}
+
+	close(tm.stop)
+	<-done
+}
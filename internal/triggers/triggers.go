@@ -0,0 +1,257 @@
+package triggers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+	"webserver/internal/config"
+	"webserver/internal/utils"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+const (
+	OutputFile = "file"
+	OutputFIFO = "fifo"
+
+	DefaultPollIntervalMS = 1000
+)
+
+// Executor runs a single invocation and returns its output and timing headers.
+type Executor func(wasmFile, cpuLimit, memLimit, wasmParam string) (string, map[string]string, error)
+
+// Record is a single newline-delimited JSON event read from a trigger source.
+type Record struct {
+	ID        string `json:"id"`
+	Parameter string `json:"parameter"`
+}
+
+type Result struct {
+	ID         string `json:"id,omitempty"`
+	Trigger    string `json:"trigger"`
+	Function   string `json:"function"`
+	Succeeded  bool   `json:"succeeded"`
+	Output     string `json:"output,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+type trigger struct {
+	config  config.TriggerConfig
+	records chan Record
+	output  *os.File
+	outMu   sync.Mutex
+}
+
+type TriggerManager struct {
+	Config   *config.TriggersConfig
+	Executor Executor
+	triggers []*trigger
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Init loads and validates the triggers file, creating input FIFOs, spool
+// directories and outputs. Without TRIGGERS_FILE no trigger is configured.
+func (tm *TriggerManager) Init() error {
+	tm.stop = make(chan struct{})
+
+	if tm.Config.TriggersFile == "" {
+		return nil
+	}
+
+	var file config.TriggersFile
+	if err := cleanenv.ReadConfig(tm.Config.TriggersFile, &file); err != nil {
+		return fmt.Errorf("failed to read triggers file %s: %v", tm.Config.TriggersFile, err)
+	}
+
+	for _, triggerConfig := range file.Triggers {
+		if err := validateTrigger(&triggerConfig); err != nil {
+			return fmt.Errorf("invalid trigger %q: %v", triggerConfig.Name, err)
+		}
+
+		if triggerConfig.Concurrency == 0 {
+			triggerConfig.Concurrency = 1
+		}
+		if triggerConfig.PollIntervalMS == 0 {
+			triggerConfig.PollIntervalMS = DefaultPollIntervalMS
+		}
+		if triggerConfig.OutputType == "" {
+			triggerConfig.OutputType = OutputFile
+		}
+
+		t := &trigger{
+			config:  triggerConfig,
+			records: make(chan Record),
+		}
+
+		if triggerConfig.FIFO != "" {
+			if err := utils.CreatePipe(triggerConfig.FIFO); err != nil {
+				return fmt.Errorf("failed to create FIFO for trigger %q: %v", triggerConfig.Name, err)
+			}
+		} else if err := os.MkdirAll(triggerConfig.SpoolDir, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create spool directory for trigger %q: %v", triggerConfig.Name, err)
+		}
+
+		output, err := openOutput(triggerConfig)
+		if err != nil {
+			return fmt.Errorf("failed to open output for trigger %q: %v", triggerConfig.Name, err)
+		}
+		t.output = output
+
+		tm.triggers = append(tm.triggers, t)
+	}
+
+	return nil
+}
+
+// validateTrigger checks a trigger and converts its Kubernetes quantity limits to the
+// millicores and MiB its invocations are executed with.
+func validateTrigger(tc *config.TriggerConfig) error {
+	if tc.Name == "" {
+		return errors.New("name is required")
+	}
+	if (tc.FIFO == "") == (tc.SpoolDir == "") {
+		return errors.New("exactly one of fifo or spool_dir is required")
+	}
+	if tc.Function == "" {
+		return errors.New("function is required")
+	}
+	if tc.CPULimit == "" || tc.MemoryLimit == "" {
+		return errors.New("cpu_limit and memory_limit are required")
+	}
+	millicores, err := utils.ParseCPU(tc.CPULimit)
+	if err != nil {
+		return fmt.Errorf("cpu_limit: %v", err)
+	}
+	mebibytes, err := utils.ParseMemory(tc.MemoryLimit)
+	if err != nil {
+		return fmt.Errorf("memory_limit: %v", err)
+	}
+	tc.CPULimit, tc.MemoryLimit = strconv.Itoa(millicores), strconv.Itoa(mebibytes)
+	if tc.Output == "" {
+		return errors.New("output is required")
+	}
+	if tc.OutputType != "" && tc.OutputType != OutputFile && tc.OutputType != OutputFIFO {
+		return fmt.Errorf("unknown output_type %q", tc.OutputType)
+	}
+	if tc.Concurrency < 0 || tc.PollIntervalMS < 0 {
+		return errors.New("concurrency and poll_interval_ms must not be negative")
+	}
+
+	return nil
+}
+
+func openOutput(tc config.TriggerConfig) (*os.File, error) {
+	if tc.OutputType == OutputFIFO {
+		if err := utils.CreatePipe(tc.Output); err != nil {
+			return nil, err
+		}
+		// O_RDWR keeps the open from blocking until a reader attaches;
+		// writes block once the pipe buffer is full, which gives us backpressure.
+		return os.OpenFile(tc.Output, os.O_RDWR, 0)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(tc.Output), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(tc.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+func (tm *TriggerManager) Start() {
+	for _, t := range tm.triggers {
+		for i := 0; i < t.config.Concurrency; i++ {
+			tm.wg.Add(1)
+			go tm.worker(t)
+		}
+
+		if t.config.FIFO != "" {
+			go tm.readFIFO(t)
+		} else {
+			go tm.pollSpool(t)
+		}
+	}
+
+	slog.Info("Started the Trigger Manager", "triggers", len(tm.triggers))
+}
+
+// Stop stops reading new records and waits for in-flight invocations to finish.
+func (tm *TriggerManager) Stop() {
+	close(tm.stop)
+	tm.wg.Wait()
+
+	for _, t := range tm.triggers {
+		t.output.Close()
+	}
+}
+
+func (tm *TriggerManager) worker(t *trigger) {
+	defer tm.wg.Done()
+
+	for {
+		select {
+		case <-tm.stop:
+			return
+		case record := <-t.records:
+			tm.invoke(t, record)
+		}
+	}
+}
+
+// dispatch hands a record to a worker, giving up if the manager is stopping.
+func (tm *TriggerManager) dispatch(t *trigger, record Record) bool {
+	select {
+	case <-tm.stop:
+		return false
+	case t.records <- record:
+		return true
+	}
+}
+
+func (tm *TriggerManager) invoke(t *trigger, record Record) {
+	start := time.Now()
+	output, _, err := tm.Executor(t.config.Function, t.config.CPULimit, t.config.MemoryLimit, record.Parameter)
+
+	result := Result{
+		ID:         record.ID,
+		Trigger:    t.config.Name,
+		Function:   t.config.Function,
+		Succeeded:  err == nil,
+		Output:     output,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		slog.Error("Triggered invocation failed", "trigger", t.config.Name, "id", record.ID, "reason", err)
+	}
+
+	line, err := json.Marshal(result)
+	if err != nil {
+		slog.Error("Failed to marshal trigger result", "trigger", t.config.Name, "reason", err)
+		return
+	}
+
+	t.outMu.Lock()
+	defer t.outMu.Unlock()
+
+	_, err = t.output.Write(append(line, '\n'))
+	if err != nil {
+		slog.Error("Failed to write trigger result", "trigger", t.config.Name, "output", t.config.Output, "reason", err)
+	}
+}
+
+func parseRecord(t *trigger, line []byte) (Record, bool) {
+	var record Record
+	if err := json.Unmarshal(line, &record); err != nil {
+		slog.Error("Discarding invalid trigger record", "trigger", t.config.Name, "reason", err)
+		return record, false
+	}
+
+	return record, true
+}
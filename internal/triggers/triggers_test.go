@@ -0,0 +1,23 @@
+package triggers
+
+import (
+	"testing"
+	"webserver/internal/config"
+)
+
+func TestValidateTriggerParsesLimits(t *testing.T) {
+	tc := config.TriggerConfig{Name: "thumbnails", FIFO: "in", Function: "imageblur.wasm", CPULimit: "1.5", MemoryLimit: "256Mi", Output: "out"}
+	if err := validateTrigger(&tc); err != nil {
+		t.Fatal(err)
+	}
+	if tc.CPULimit != "1500" || tc.MemoryLimit != "256" {
+		t.Fatalf("got cpu_limit %q and memory_limit %q", tc.CPULimit, tc.MemoryLimit)
+	}
+
+	for _, limits := range [][2]string{{"-1", "256Mi"}, {"500m", "lots"}, {"500m", "200"}} {
+		tc := config.TriggerConfig{Name: "thumbnails", FIFO: "in", Function: "imageblur.wasm", CPULimit: limits[0], MemoryLimit: limits[1], Output: "out"}
+		if err := validateTrigger(&tc); err == nil {
+			t.Errorf("cpu_limit %q and memory_limit %q were accepted", limits[0], limits[1])
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// memoryUnits maps Kubernetes memory suffixes to their size in bytes.
+var memoryUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+func parseDecimal(value string) (float64, error) {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) || strings.ContainsAny(value, "eExXpP") {
+		return 0, fmt.Errorf("%q is not a decimal number", value)
+	}
+	return number, nil
+}
+
+// MinCPU is the smallest CPU limit in millicores. cgroups refuse quotas below 1ms per
+// 100ms period.
+const MinCPU = 10
+
+// ParseCPU parses a Kubernetes CPU quantity such as "500m" or "2" into millicores.
+// Quantities below MinCPU are refused.
+func ParseCPU(value string) (int, error) {
+	var millicores float64
+	if number, ok := strings.CutSuffix(value, "m"); ok {
+		parsed, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a CPU quantity", value)
+		}
+		millicores = float64(parsed)
+	} else {
+		cores, err := parseDecimal(value)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a CPU quantity", value)
+		}
+		millicores = math.Round(cores * 1000)
+	}
+
+	if millicores < MinCPU || millicores > math.MaxInt32 {
+		return 0, fmt.Errorf("CPU quantity %q is out of range, the minimum is %s", value, FormatCPU(MinCPU))
+	}
+	return int(millicores), nil
+}
+
+// ParseMemory parses a Kubernetes memory quantity such as "256Mi", "1Gi" or "128M" into
+// MiB, rounding up. Quantities below 1Mi are refused.
+func ParseMemory(value string) (int, error) {
+	number, multiplier := value, 1.0
+	for _, unit := range memoryUnits {
+		if trimmed, ok := strings.CutSuffix(value, unit.suffix); ok {
+			number, multiplier = trimmed, unit.bytes
+			break
+		}
+	}
+
+	parsed, err := parseDecimal(number)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a memory quantity", value)
+	}
+
+	mebibytes := math.Ceil(parsed * multiplier / (1 << 20))
+	if parsed*multiplier < 1<<20 || mebibytes > math.MaxInt32 {
+		return 0, fmt.Errorf("memory quantity %q is out of range, the minimum is 1Mi", value)
+	}
+	return int(mebibytes), nil
+}
+
+func FormatCPU(millicores int) string {
+	return strconv.Itoa(millicores) + "m"
+}
+
+func FormatMemory(mebibytes int) string {
+	return strconv.Itoa(mebibytes) + "Mi"
+}
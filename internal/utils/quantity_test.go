@@ -0,0 +1,79 @@
+package utils
+
+import "testing"
+
+func TestParseCPU(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  int
+		ok    bool
+	}{
+		{"500m", 500, true},
+		{"10m", 10, true},
+		{"2", 2000, true},
+		{"0.5", 500, true},
+		{"1.25", 1250, true},
+		{"9m", 0, false},
+		{"1m", 0, false},
+		{"0.005", 0, false},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"1e3", 0, false},
+		{"0.5m", 0, false},
+		{"", 0, false},
+		{"one", 0, false},
+	} {
+		got, err := ParseCPU(test.value)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("ParseCPU(%q) = %d, %v", test.value, got, err)
+		}
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  int
+		ok    bool
+	}{
+		{"256Mi", 256, true},
+		{"1Gi", 1024, true},
+		{"1024Ki", 1, true},
+		{"128M", 123, true},
+		{"1.5Gi", 1536, true},
+		{"1048576", 1, true},
+		{"1048577", 2, true},
+		{"1023Ki", 0, false},
+		{"512", 0, false},
+		{"0Mi", 0, false},
+		{"256Mb", 0, false},
+		{"1e9", 0, false},
+		{"", 0, false},
+	} {
+		got, err := ParseMemory(test.value)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("ParseMemory(%q) = %d, %v", test.value, got, err)
+		}
+	}
+}
+
+func TestFormatQuantities(t *testing.T) {
+	if got := FormatCPU(1500); got != "1500m" {
+		t.Errorf("FormatCPU(1500) = %q", got)
+	}
+	if got := FormatMemory(256); got != "256Mi" {
+		t.Errorf("FormatMemory(256) = %q", got)
+	}
+
+	// Formatted quantities parse back to the same value
+	for _, millicores := range []int{MinCPU, 500, 2000} {
+		if got, err := ParseCPU(FormatCPU(millicores)); err != nil || got != millicores {
+			t.Errorf("ParseCPU(FormatCPU(%d)) = %d, %v", millicores, got, err)
+		}
+	}
+	for _, mebibytes := range []int{1, 200, 4096} {
+		if got, err := ParseMemory(FormatMemory(mebibytes)); err != nil || got != mebibytes {
+			t.Errorf("ParseMemory(FormatMemory(%d)) = %d, %v", mebibytes, got, err)
+		}
+	}
+}
@@ -24,7 +24,10 @@ func DeleteDirectory(directoryPath string) error {
 func CreatePipe(pipePath string) error {
 	_ = syscall.Unlink(pipePath)
 	_ = syscall.Umask(0)
-	syscall.Mkfifo(pipePath, 0666)
+	err := syscall.Mkfifo(pipePath, 0666)
+	if err != nil {
+		return err
+	}
 
 	// Open the FIFO file to set permissions explicitly
 	// file, err := os.OpenFile(pipePath, os.O_RDONLY, 0)
@@ -41,3 +44,24 @@ func CreatePipe(pipePath string) error {
 
 	return nil
 }
+
+// LockFile takes an exclusive advisory lock on path, creating it if needed. The lock is
+// shared with every pod mounting the same volume as well as other goroutines of this process.
+func LockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func UnlockFile(file *os.File) {
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	file.Close()
+}
@@ -0,0 +1,197 @@
+package wasm_binary
+
+import "fmt"
+
+const (
+	KindFunc   = "func"
+	KindTable  = "table"
+	KindMemory = "memory"
+	KindGlobal = "global"
+	KindTag    = "tag"
+)
+
+var externKinds = []string{KindFunc, KindTable, KindMemory, KindGlobal, KindTag}
+
+type Import struct {
+	Module string `json:"module"`
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+}
+
+type Export struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+// reader decodes the values making up a section payload.
+type reader struct {
+	data   []byte
+	offset int
+}
+
+func (r *reader) byte() (byte, error) {
+	if r.offset >= len(r.data) {
+		return 0, ErrTruncated
+	}
+	b := r.data[r.offset]
+	r.offset++
+	return b, nil
+}
+
+func (r *reader) uleb() (uint64, error) {
+	value, n, err := ReadULEB128(r.data[r.offset:])
+	r.offset += n
+	return value, err
+}
+
+func (r *reader) name() (string, error) {
+	length, err := r.uleb()
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(len(r.data)-r.offset) {
+		return "", ErrTruncated
+	}
+
+	name := string(r.data[r.offset : r.offset+int(length)])
+	r.offset += int(length)
+	return name, nil
+}
+
+func (r *reader) externKind() (string, error) {
+	kind, err := r.byte()
+	if err != nil {
+		return "", err
+	}
+	if int(kind) >= len(externKinds) {
+		return "", fmt.Errorf("unknown external kind 0x%02x", kind)
+	}
+	return externKinds[kind], nil
+}
+
+func (r *reader) limits() (Limits, error) {
+	flags, err := r.byte()
+	if err != nil {
+		return Limits{}, err
+	}
+
+	limits := Limits{Shared: flags&0x02 != 0, Memory64: flags&0x04 != 0}
+	limits.Min, err = r.uleb()
+	if err != nil || flags&0x01 == 0 {
+		return limits, err
+	}
+
+	max, err := r.uleb()
+	limits.Max = &max
+	return limits, err
+}
+
+// skipImportDesc skips the type of an import of the given kind.
+func (r *reader) skipImportDesc(kind string) error {
+	var err error
+	switch kind {
+	case KindFunc:
+		_, err = r.uleb()
+	case KindTable:
+		if _, err = r.byte(); err == nil {
+			_, err = r.limits()
+		}
+	case KindMemory:
+		_, err = r.limits()
+	case KindGlobal:
+		if _, err = r.byte(); err == nil {
+			_, err = r.byte()
+		}
+	case KindTag:
+		if _, err = r.byte(); err == nil {
+			_, err = r.uleb()
+		}
+	}
+	return err
+}
+
+func section(data []byte, id byte) (*reader, error) {
+	sections, err := ReadSections(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, section := range sections {
+		if section.ID == id {
+			return &reader{data: section.Payload}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func ReadImports(data []byte) ([]Import, error) {
+	r, err := section(data, SectionImport)
+	if err != nil || r == nil {
+		return []Import{}, err
+	}
+
+	count, err := r.uleb()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every entry takes more than one byte, so this bounds the allocation below
+	if count > uint64(len(r.data)) {
+		return nil, ErrTruncated
+	}
+
+	imports := make([]Import, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var imp Import
+		if imp.Module, err = r.name(); err != nil {
+			return nil, err
+		}
+		if imp.Name, err = r.name(); err != nil {
+			return nil, err
+		}
+		if imp.Kind, err = r.externKind(); err != nil {
+			return nil, err
+		}
+		if err = r.skipImportDesc(imp.Kind); err != nil {
+			return nil, err
+		}
+		imports = append(imports, imp)
+	}
+
+	return imports, nil
+}
+
+func ReadExports(data []byte) ([]Export, error) {
+	r, err := section(data, SectionExport)
+	if err != nil || r == nil {
+		return []Export{}, err
+	}
+
+	count, err := r.uleb()
+	if err != nil {
+		return nil, err
+	}
+
+	// See ReadImports
+	if count > uint64(len(r.data)) {
+		return nil, ErrTruncated
+	}
+
+	exports := make([]Export, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var exp Export
+		if exp.Name, err = r.name(); err != nil {
+			return nil, err
+		}
+		if exp.Kind, err = r.externKind(); err != nil {
+			return nil, err
+		}
+		if _, err = r.uleb(); err != nil {
+			return nil, err
+		}
+		exports = append(exports, exp)
+	}
+
+	return exports, nil
+}
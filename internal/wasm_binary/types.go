@@ -0,0 +1,438 @@
+package wasm_binary
+
+import (
+	"fmt"
+	"strings"
+)
+
+var valueTypes = map[byte]string{
+	0x7f: "i32",
+	0x7e: "i64",
+	0x7d: "f32",
+	0x7c: "f64",
+	0x7b: "v128",
+	0x70: "funcref",
+	0x6f: "externref",
+}
+
+type FuncType struct {
+	Params  []string `json:"params"`
+	Results []string `json:"results"`
+}
+
+func (ft FuncType) String() string {
+	return "(" + strings.Join(ft.Params, ", ") + ") -> (" + strings.Join(ft.Results, ", ") + ")"
+}
+
+// Limits are those of a memory, in 64 KiB pages, or of a table, in elements.
+type Limits struct {
+	Min      uint64  `json:"min"`
+	Max      *uint64 `json:"max,omitempty"`
+	Shared   bool    `json:"shared,omitempty"`
+	Memory64 bool    `json:"memory64,omitempty"`
+}
+
+type TableType struct {
+	Element string `json:"element"`
+	Limits
+}
+
+type GlobalType struct {
+	Type    string `json:"type"`
+	Mutable bool   `json:"mutable"`
+}
+
+// ExternType is the type of an import or an export. Only the field of its kind is set,
+// tags use Func for the types of their values.
+type ExternType struct {
+	Func   *FuncType   `json:"func,omitempty"`
+	Table  *TableType  `json:"table,omitempty"`
+	Memory *Limits     `json:"memory,omitempty"`
+	Global *GlobalType `json:"global,omitempty"`
+}
+
+type TypedImport struct {
+	Import
+	ExternType
+}
+
+type TypedExport struct {
+	Export
+	ExternType
+}
+
+type Memory struct {
+	Imported bool `json:"imported"`
+	Limits
+}
+
+type Table struct {
+	Imported bool `json:"imported"`
+	TableType
+}
+
+type CustomSection struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+// ModuleType is the interface of a module along with the memories and tables it uses.
+type ModuleType struct {
+	Imports        []TypedImport   `json:"imports"`
+	Exports        []TypedExport   `json:"exports"`
+	Memories       []Memory        `json:"memories"`
+	Tables         []Table         `json:"tables"`
+	CustomSections []CustomSection `json:"custom_sections"`
+}
+
+// NewModuleType returns the type of a module without imports, exports, memories, tables
+// or custom sections.
+func NewModuleType() *ModuleType {
+	return &ModuleType{
+		Imports:        []TypedImport{},
+		Exports:        []TypedExport{},
+		Memories:       []Memory{},
+		Tables:         []Table{},
+		CustomSections: []CustomSection{},
+	}
+}
+
+// index spaces of a module, imports first
+type indexSpaces struct {
+	types    []FuncType
+	funcs    []uint64
+	tables   []TableType
+	memories []Limits
+	globals  []GlobalType
+	tags     []uint64
+}
+
+func (r *reader) valueType() (string, error) {
+	b, err := r.byte()
+	if err != nil {
+		return "", err
+	}
+
+	valueType, ok := valueTypes[b]
+	if !ok {
+		return "", fmt.Errorf("unsupported value type 0x%02x", b)
+	}
+	return valueType, nil
+}
+
+func (r *reader) valueTypes() ([]string, error) {
+	count, err := r.uleb()
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(r.data)) {
+		return nil, ErrTruncated
+	}
+
+	types := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		valueType, err := r.valueType()
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, valueType)
+	}
+	return types, nil
+}
+
+func (r *reader) funcType() (FuncType, error) {
+	form, err := r.byte()
+	if err != nil {
+		return FuncType{}, err
+	}
+	if form != 0x60 {
+		return FuncType{}, fmt.Errorf("unsupported type form 0x%02x", form)
+	}
+
+	var ft FuncType
+	if ft.Params, err = r.valueTypes(); err != nil {
+		return FuncType{}, err
+	}
+	ft.Results, err = r.valueTypes()
+	return ft, err
+}
+
+func (r *reader) tableType() (TableType, error) {
+	element, err := r.valueType()
+	if err != nil {
+		return TableType{}, err
+	}
+
+	limits, err := r.limits()
+	return TableType{Element: element, Limits: limits}, err
+}
+
+func (r *reader) globalType() (GlobalType, error) {
+	valueType, err := r.valueType()
+	if err != nil {
+		return GlobalType{}, err
+	}
+
+	mutable, err := r.byte()
+	return GlobalType{Type: valueType, Mutable: mutable == 0x01}, err
+}
+
+// skipConstExpr skips the initializer of a global, up to and including its end opcode.
+func (r *reader) skipConstExpr() error {
+	for {
+		opcode, err := r.byte()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case 0x0b: // end
+			return nil
+		case 0x41, 0x42, 0x23, 0xd2: // i32.const, i64.const, global.get, ref.func
+			// Skipping a signed LEB128 value takes as many bytes as an unsigned one
+			_, err = r.uleb()
+		case 0x43: // f32.const
+			err = r.skip(4)
+		case 0x44: // f64.const
+			err = r.skip(8)
+		case 0xd0: // ref.null
+			_, err = r.byte()
+		case 0x6a, 0x6b, 0x6c, 0x7c, 0x7d, 0x7e: // extended constant expressions
+		case 0xfd: // v128.const
+			var op uint64
+			if op, err = r.uleb(); err != nil {
+				return err
+			}
+			if op != 0x0c {
+				return fmt.Errorf("unsupported constant instruction 0xfd 0x%02x", op)
+			}
+			err = r.skip(16)
+		default:
+			return fmt.Errorf("unsupported constant instruction 0x%02x", opcode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *reader) skip(n int) error {
+	if n > len(r.data)-r.offset {
+		return ErrTruncated
+	}
+	r.offset += n
+	return nil
+}
+
+// vector calls read for each entry of the vector at the start of r.
+func (r *reader) vector(read func() error) error {
+	count, err := r.uleb()
+	if err != nil {
+		return err
+	}
+
+	// Every entry takes at least one byte
+	if count > uint64(len(r.data)) {
+		return ErrTruncated
+	}
+
+	for i := uint64(0); i < count; i++ {
+		if err := read(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadModuleType decodes the types of the imports and exports of a module, and the
+// limits of its memories and tables.
+func ReadModuleType(data []byte) (*ModuleType, error) {
+	sections, err := ReadSections(data)
+	if err != nil {
+		return nil, err
+	}
+
+	module := NewModuleType()
+	var spaces indexSpaces
+	var exports []uint64
+
+	for _, section := range sections {
+		r := &reader{data: section.Payload}
+
+		switch section.ID {
+		case SectionCustom:
+			module.CustomSections = append(module.CustomSections, CustomSection{Name: section.Name, Size: len(section.Payload)})
+		case SectionType:
+			err = r.vector(func() error {
+				ft, err := r.funcType()
+				spaces.types = append(spaces.types, ft)
+				return err
+			})
+		case SectionImport:
+			err = r.vector(func() error {
+				imp, err := r.typedImport(&spaces)
+				if err != nil {
+					return err
+				}
+				module.Imports = append(module.Imports, imp)
+				if imp.Memory != nil {
+					module.Memories = append(module.Memories, Memory{Imported: true, Limits: *imp.Memory})
+				}
+				if imp.Table != nil {
+					module.Tables = append(module.Tables, Table{Imported: true, TableType: *imp.Table})
+				}
+				return nil
+			})
+		case SectionFunction:
+			err = r.vector(func() error {
+				typeIndex, err := r.uleb()
+				spaces.funcs = append(spaces.funcs, typeIndex)
+				return err
+			})
+		case SectionTable:
+			err = r.vector(func() error {
+				table, err := r.tableType()
+				spaces.tables = append(spaces.tables, table)
+				module.Tables = append(module.Tables, Table{TableType: table})
+				return err
+			})
+		case SectionMemory:
+			err = r.vector(func() error {
+				limits, err := r.limits()
+				spaces.memories = append(spaces.memories, limits)
+				module.Memories = append(module.Memories, Memory{Limits: limits})
+				return err
+			})
+		case SectionGlobal:
+			err = r.vector(func() error {
+				global, err := r.globalType()
+				if err != nil {
+					return err
+				}
+				spaces.globals = append(spaces.globals, global)
+				return r.skipConstExpr()
+			})
+		case SectionExport:
+			err = r.vector(func() error {
+				var exp TypedExport
+				var err error
+				if exp.Name, err = r.name(); err != nil {
+					return err
+				}
+				if exp.Kind, err = r.externKind(); err != nil {
+					return err
+				}
+				index, err := r.uleb()
+				module.Exports = append(module.Exports, exp)
+				exports = append(exports, index)
+				return err
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Exports may refer to functions whose types are only known once all sections are read
+	for i := range module.Exports {
+		exp := &module.Exports[i]
+		if exp.ExternType, err = spaces.externType(exp.Kind, exports[i]); err != nil {
+			return nil, fmt.Errorf("export %q: %w", exp.Name, err)
+		}
+	}
+
+	return module, nil
+}
+
+func (r *reader) typedImport(spaces *indexSpaces) (TypedImport, error) {
+	var imp TypedImport
+	var err error
+	if imp.Module, err = r.name(); err != nil {
+		return imp, err
+	}
+	if imp.Name, err = r.name(); err != nil {
+		return imp, err
+	}
+	if imp.Kind, err = r.externKind(); err != nil {
+		return imp, err
+	}
+
+	switch imp.Kind {
+	case KindFunc:
+		typeIndex, err := r.uleb()
+		if err != nil {
+			return imp, err
+		}
+		spaces.funcs = append(spaces.funcs, typeIndex)
+		imp.ExternType, err = spaces.externType(KindFunc, uint64(len(spaces.funcs)-1))
+		return imp, err
+	case KindTable:
+		table, err := r.tableType()
+		spaces.tables = append(spaces.tables, table)
+		imp.Table = &table
+		return imp, err
+	case KindMemory:
+		limits, err := r.limits()
+		spaces.memories = append(spaces.memories, limits)
+		imp.Memory = &limits
+		return imp, err
+	case KindGlobal:
+		global, err := r.globalType()
+		spaces.globals = append(spaces.globals, global)
+		imp.Global = &global
+		return imp, err
+	case KindTag:
+		if _, err := r.byte(); err != nil {
+			return imp, err
+		}
+		typeIndex, err := r.uleb()
+		if err != nil {
+			return imp, err
+		}
+		spaces.tags = append(spaces.tags, typeIndex)
+		imp.ExternType, err = spaces.externType(KindTag, uint64(len(spaces.tags)-1))
+		return imp, err
+	}
+
+	return imp, nil
+}
+
+func (s *indexSpaces) externType(kind string, index uint64) (ExternType, error) {
+	outOfRange := fmt.Errorf("%s index %d out of range", kind, index)
+
+	switch kind {
+	case KindFunc, KindTag:
+		indices := s.funcs
+		if kind == KindTag {
+			indices = s.tags
+		}
+		if index >= uint64(len(indices)) {
+			return ExternType{}, outOfRange
+		}
+		if indices[index] >= uint64(len(s.types)) {
+			return ExternType{}, fmt.Errorf("type index %d out of range", indices[index])
+		}
+		ft := s.types[indices[index]]
+		return ExternType{Func: &ft}, nil
+	case KindTable:
+		if index >= uint64(len(s.tables)) {
+			return ExternType{}, outOfRange
+		}
+		table := s.tables[index]
+		return ExternType{Table: &table}, nil
+	case KindMemory:
+		if index >= uint64(len(s.memories)) {
+			return ExternType{}, outOfRange
+		}
+		limits := s.memories[index]
+		return ExternType{Memory: &limits}, nil
+	case KindGlobal:
+		if index >= uint64(len(s.globals)) {
+			return ExternType{}, outOfRange
+		}
+		global := s.globals[index]
+		return ExternType{Global: &global}, nil
+	}
+
+	return ExternType{}, nil
+}
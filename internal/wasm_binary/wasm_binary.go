@@ -0,0 +1,118 @@
+package wasm_binary
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	SectionCustom   byte = 0
+	SectionType     byte = 1
+	SectionImport   byte = 2
+	SectionFunction byte = 3
+	SectionTable    byte = 4
+	SectionMemory   byte = 5
+	SectionGlobal   byte = 6
+	SectionExport   byte = 7
+	SectionStart    byte = 8
+	SectionElement  byte = 9
+	SectionCode     byte = 10
+	SectionData     byte = 11
+	SectionDataCnt  byte = 12
+)
+
+var (
+	Magic   = []byte{0x00, 'a', 's', 'm'}
+	Version = []byte{0x01, 0x00, 0x00, 0x00}
+
+	ErrNotWasm   = errors.New("not a WebAssembly binary")
+	ErrTruncated = errors.New("truncated WebAssembly binary")
+)
+
+// Section is a top-level section of a module. Name is only set for custom sections,
+// and Payload excludes the custom section name.
+type Section struct {
+	ID      byte
+	Name    string
+	Offset  int
+	Payload []byte
+}
+
+func IsWasm(data []byte) bool {
+	return len(data) >= 8 && bytes.Equal(data[:4], Magic) && bytes.Equal(data[4:8], Version)
+}
+
+// ReadSections splits a module into its top-level sections without decoding them.
+func ReadSections(data []byte) ([]Section, error) {
+	if !IsWasm(data) {
+		return nil, ErrNotWasm
+	}
+
+	var sections []Section
+	offset := 8
+	for offset < len(data) {
+		id := data[offset]
+		size, n, err := ReadULEB128(data[offset+1:])
+		if err != nil {
+			return nil, err
+		}
+
+		start := offset + 1 + n
+		end := start + int(size)
+		if size > uint64(len(data)) || end > len(data) {
+			return nil, ErrTruncated
+		}
+
+		section := Section{ID: id, Offset: offset, Payload: data[start:end]}
+		if id == SectionCustom {
+			nameLen, n, err := ReadULEB128(section.Payload)
+			if err != nil {
+				return nil, err
+			}
+			if uint64(n)+nameLen > uint64(len(section.Payload)) {
+				return nil, ErrTruncated
+			}
+			section.Name = string(section.Payload[n : n+int(nameLen)])
+			section.Payload = section.Payload[n+int(nameLen):]
+		}
+
+		sections = append(sections, section)
+		offset = end
+	}
+
+	return sections, nil
+}
+
+// HasCustomSection reports whether the module contains a custom section called name.
+func HasCustomSection(data []byte, name string) bool {
+	sections, err := ReadSections(data)
+	if err != nil {
+		return false
+	}
+
+	for _, section := range sections {
+		if section.ID == SectionCustom && section.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func ReadULEB128(data []byte) (uint64, int, error) {
+	var result uint64
+	var shift uint
+	for i, b := range data {
+		if shift >= 64 {
+			return 0, 0, fmt.Errorf("LEB128 value overflows 64 bits")
+		}
+		result |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return result, i + 1, nil
+		}
+		shift += 7
+	}
+
+	return 0, 0, ErrTruncated
+}